@@ -295,20 +295,14 @@ function App() {
       return;
     }
 
-    const ws = new WebSocket(`ws://localhost:8080/ws?roomId=${selectedRoom.id}`);
+    // Browsers cannot set headers on WebSocket requests, so the session
+    // token travels as a query parameter
+    const token = localStorage.getItem('chatToken');
+    const ws = new WebSocket(`ws://localhost:8080/ws?roomId=${encodeURIComponent(selectedRoom.id)}&token=${encodeURIComponent(token || '')}`);
     
     ws.onopen = () => {
       console.log('Connected to WebSocket server');
       setConnected(true);
-      
-      // Send username as the first message
-      const initMessage = {
-        type: 'init',
-        content: 'Joining chat',
-        sender: username
-      };
-      
-      ws.send(JSON.stringify(initMessage));
       setIsJoined(true);
     };
     
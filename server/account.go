@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// passwordResetTTL is how long a password reset token stays valid
+var passwordResetTTL = time.Duration(envInt("PASSWORD_RESET_TTL_MINUTES", 60)) * time.Minute
+
+var passwordResetRateLimit = loadRatePolicy("password_reset", 5, time.Hour)
+
+// ResetSender delivers password reset tokens to users
+type ResetSender interface {
+	SendPasswordReset(username, token string, expiresAt time.Time) error
+}
+
+// resetSender is the delivery backend used by the reset flow
+var resetSender ResetSender = outboxResetSender{}
+
+// outboxResetSender logs reset tokens and keeps them in a Redis outbox list,
+// standing in for email or SMS delivery during local development
+type outboxResetSender struct{}
+
+func (outboxResetSender) SendPasswordReset(username, token string, expiresAt time.Time) error {
+	fmt.Printf("Password reset for %s: token %s (expires %s)\n", username, token, expiresAt.Format(time.RFC3339))
+
+	entry, err := json.Marshal(map[string]interface{}{
+		"kind":      "passwordReset",
+		"username":  username,
+		"token":     token,
+		"expiresAt": expiresAt,
+		"createdAt": time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.LPush(ctx, "outbox", entry)
+	pipe.LTrim(ctx, "outbox", 0, 999)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func passwordResetKey(token string) string {
+	return "password_reset:" + token
+}
+
+// userResetsKey is the set of a user's outstanding password reset tokens
+func userResetsKey(username string) string {
+	return "user:" + username + ":resets"
+}
+
+// revokePasswordResets invalidates every outstanding reset token of a user
+func revokePasswordResets(username string) error {
+	tokens, err := rdb.SMembers(ctx, userResetsKey(username)).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	for _, token := range tokens {
+		pipe.Del(ctx, passwordResetKey(token))
+	}
+	pipe.Del(ctx, userResetsKey(username))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// sessionUser authenticates a request, writing the error response on failure
+func sessionUser(w http.ResponseWriter, r *http.Request) (string, string) {
+	token := requestToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, errCodeAuthRequired, "Authorization required")
+		return "", ""
+	}
+
+	username := extractUsernameFromToken(token)
+	if username == "" {
+		writeError(w, http.StatusUnauthorized, errCodeInvalidToken, "Invalid session token")
+		return "", ""
+	}
+	return username, token
+}
+
+// checkPassword reports whether password matches the stored hash of a user
+func checkPassword(username, password string) (bool, error) {
+	storedHash, err := rdb.Get(ctx, username).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	matches, legacy := passwordMatches(storedHash, password)
+	if matches && legacy {
+		upgradePasswordHash(username, password)
+	}
+	return matches, nil
+}
+
+// verifyPassword re-checks the password of a signed in user before a
+// sensitive change. Failures count towards the login lockout so a stolen
+// session cannot be used to guess the password. It writes the error response
+// and returns false when the check does not pass.
+func verifyPassword(w http.ResponseWriter, username, password, failMsg string) bool {
+	if lockout := lockedOutFor(username); lockout > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockout.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, errCodeAccountLocked, "Too many failed password attempts, try again later")
+		return false
+	}
+
+	ok, err := checkPassword(username, password)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error checking password")
+		return false
+	}
+	if !ok {
+		time.Sleep(recordLoginFailure(username))
+		writeError(w, http.StatusUnauthorized, errCodeInvalidCredentials, failMsg)
+		return false
+	}
+
+	clearLoginFailures(username)
+	return true
+}
+
+// changePasswordHandler lets a logged in user change their password. Every
+// other session of the user is signed out.
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, token := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	if !verifyPassword(w, username, req.CurrentPassword, "Current password is incorrect") {
+		return
+	}
+
+	var errs ValidationErrors
+	validatePassword(&errs, "newPassword", req.NewPassword, username)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := setPassword(username, req.NewPassword); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing password")
+		return
+	}
+
+	revoked, err := revokeSessions(username, token)
+	if err != nil {
+		fmt.Printf("Error revoking sessions of %s: %v\n", username, err)
+	}
+	if err := revokePasswordResets(username); err != nil {
+		fmt.Printf("Error revoking password resets of %s: %v\n", username, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"message":         "Password changed",
+		"revokedSessions": revoked,
+	})
+}
+
+// requestPasswordResetHandler sends a reset token to a user. It answers the
+// same way whether or not the user exists.
+func requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	if rateLimited(w, passwordResetRateLimit, clientIP(r)) {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	isUser, err := rdb.SIsMember(ctx, "users", req.Username).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error checking username")
+		return
+	}
+
+	if isUser && !isDisabled(req.Username) {
+		if ok, _ := allow(passwordResetRateLimit, "user:"+req.Username); ok {
+			sendPasswordReset(req.Username)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "If the account exists, a password reset has been sent",
+	})
+}
+
+func sendPasswordReset(username string) {
+	token, err := randomToken(32)
+	if err != nil {
+		fmt.Printf("Error generating reset token: %v\n", err)
+		return
+	}
+
+	// The user's outstanding tokens are tracked so they can be revoked, the
+	// set lives as long as the newest token
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, passwordResetKey(token), username, passwordResetTTL)
+	pipe.SAdd(ctx, userResetsKey(username), token)
+	pipe.Expire(ctx, userResetsKey(username), passwordResetTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		fmt.Printf("Error storing reset token: %v\n", err)
+		return
+	}
+
+	if err := resetSender.SendPasswordReset(username, token, time.Now().Add(passwordResetTTL)); err != nil {
+		fmt.Printf("Error sending password reset to %s: %v\n", username, err)
+	}
+}
+
+// confirmPasswordResetHandler sets a new password using a reset token
+func confirmPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	// GETDEL makes the token single use even with concurrent requests
+	username, err := rdb.GetDel(ctx, passwordResetKey(req.Token)).Result()
+	if err != nil || req.Token == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidToken, "Reset token is invalid or expired")
+		return
+	}
+
+	// The account may have been deleted or disabled since the token was sent
+	isUser, err := rdb.SIsMember(ctx, "users", username).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error checking username")
+		return
+	}
+	if !isUser || isDisabled(username) {
+		writeError(w, http.StatusBadRequest, errCodeInvalidToken, "Reset token is invalid or expired")
+		return
+	}
+
+	var errs ValidationErrors
+	validatePassword(&errs, "newPassword", req.NewPassword, username)
+	if len(errs) > 0 {
+		// Give the token back so the user can retry with a better password
+		rdb.Set(ctx, passwordResetKey(req.Token), username, passwordResetTTL)
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := setPassword(username, req.NewPassword); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing password")
+		return
+	}
+
+	if _, err := revokeSessions(username, ""); err != nil {
+		fmt.Printf("Error revoking sessions of %s: %v\n", username, err)
+	}
+	if err := revokePasswordResets(username); err != nil {
+		fmt.Printf("Error revoking password resets of %s: %v\n", username, err)
+	}
+	clearLoginFailures(username)
+	rdb.Del(ctx, loginLockoutKey(username))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Password has been reset",
+	})
+}
+
+// handOverRoom transfers a room to one of its moderators, or archives it when
+// there is nobody to take it over. It returns the new owner, if any.
+func handOverRoom(room *Chatroom) (string, error) {
+	moderators, err := rdb.SMembers(ctx, roomModeratorsKey(room.ID)).Result()
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(moderators)
+
+	newOwner := ""
+	if len(moderators) > 0 {
+		newOwner = moderators[0]
+	}
+	updated, err := updateChatroom(room.ID, func(room *Chatroom) {
+		if newOwner != "" {
+			room.CreatorID = newOwner
+		} else {
+			room.Archived = true
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.SRem(ctx, "user:"+room.CreatorID+":chatrooms", room.ID)
+	if newOwner != "" {
+		pipe.SRem(ctx, roomModeratorsKey(room.ID), newOwner)
+		pipe.SAdd(ctx, "user:"+newOwner+":chatrooms", room.ID)
+	} else {
+		pipe.SRem(ctx, "chatrooms", room.ID)
+		pipe.SAdd(ctx, "chatrooms:archived", room.ID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+
+	// Nobody may keep chatting in an archived room
+	if newOwner == "" {
+		stopHub(room.ID, "chatroom archived")
+	}
+
+	emitRoomUpdated(updated)
+	return newOwner, nil
+}
+
+// deleteAccountHandler deletes the calling user's account. Owned rooms are
+// handed to a moderator or archived, memberships and credentials are removed.
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	if !verifyPassword(w, username, req.Password, "Password is incorrect") {
+		return
+	}
+
+	// Sign out everywhere first so nothing can act on the account mid-deletion
+	if _, err := revokeSessions(username, ""); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error revoking sessions")
+		return
+	}
+
+	ownedIDs, err := rdb.SMembers(ctx, "user:"+username+":chatrooms").Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching user's chatrooms")
+		return
+	}
+
+	transferred := map[string]string{}
+	archived := []string{}
+	for _, id := range ownedIDs {
+		room, err := getChatroom(id)
+		if err != nil || room.CreatorID != username {
+			continue
+		}
+
+		newOwner, err := handOverRoom(room)
+		if err != nil {
+			fmt.Printf("Error handing over room %s: %v\n", id, err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error handing over owned chatrooms")
+			return
+		}
+		if newOwner != "" {
+			transferred[id] = newOwner
+		} else {
+			archived = append(archived, id)
+		}
+	}
+
+	// Remove room memberships: moderator roles and read markers
+	allRooms, _ := rdb.SUnion(ctx, "chatrooms", "chatrooms:archived").Result()
+	pipe := rdb.TxPipeline()
+	for _, id := range allRooms {
+		pipe.SRem(ctx, roomModeratorsKey(id), username)
+		pipe.HDel(ctx, roomReadsKey(id), username)
+	}
+
+	// Bots must not outlive their owner, disable them so their keys stop working
+	bots, _ := rdb.SMembers(ctx, userBotsKey(username)).Result()
+	for _, bot := range bots {
+		pipe.Set(ctx, userDisabledKey(bot), "owner deleted", 0)
+	}
+
+	// Unlink single sign-on identities
+	identities, _ := rdb.SMembers(ctx, userIdentitiesKey(username)).Result()
+	for _, identity := range identities {
+		provider, subject, _ := strings.Cut(identity, ":")
+		pipe.Del(ctx, oidcIdentityKey(provider, subject))
+	}
+
+	// Outstanding reset tokens must not bring the account back
+	resets, _ := rdb.SMembers(ctx, userResetsKey(username)).Result()
+	for _, token := range resets {
+		pipe.Del(ctx, passwordResetKey(token))
+	}
+
+	// Remove credentials and per-user records
+	pipe.Del(ctx,
+		username,
+		userResetsKey(username),
+		"user:"+username+":chatrooms",
+		userProfileKey(username),
+		userSessionsKey(username),
+		userDisabledKey(username),
+		userIdentitiesKey(username),
+		userBotsKey(username),
+		userInvitesKey(username),
+		loginFailuresKey(username),
+		loginLockoutKey(username),
+	)
+	pipe.SRem(ctx, "users", username)
+	pipe.SRem(ctx, "admins", username)
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error deleting account")
+		return
+	}
+
+	// Close any connections still open under the account
+	disconnectUser(username, "account deleted")
+
+	fmt.Printf("Deleted account %s\n", username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"message":          "Account deleted",
+		"transferredRooms": transferred,
+		"archivedRooms":    archived,
+	})
+}
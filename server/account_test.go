@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyPasswordLockout(t *testing.T) {
+	useTestRedis(t)
+
+	if err := setPassword("alice", "correct-horse"); err != nil {
+		t.Fatalf("storing password: %v", err)
+	}
+	token := testSession(t, "alice")
+
+	deleteAccount := func(password string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/users/me/delete", strings.NewReader(`{"password":"`+password+`"}`))
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		deleteAccountHandler(w, r)
+		return w.Code
+	}
+
+	if code := deleteAccount("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if n, _ := rdb.Get(ctx, loginFailuresKey("alice")).Int(); n != 1 {
+		t.Errorf("failures = %d, want 1", n)
+	}
+
+	// Once locked out even the right password is refused
+	if err := rdb.Set(ctx, loginLockoutKey("alice"), 1, loginLockoutFor).Err(); err != nil {
+		t.Fatalf("locking account: %v", err)
+	}
+	if code := deleteAccount("correct-horse"); code != http.StatusTooManyRequests {
+		t.Fatalf("locked out: status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if n, _ := rdb.Exists(ctx, "alice").Result(); n != 1 {
+		t.Errorf("account was deleted while locked out")
+	}
+}
+
+// recordingResetSender keeps the reset tokens it is asked to deliver
+type recordingResetSender struct {
+	tokens []string
+}
+
+func (s *recordingResetSender) SendPasswordReset(username, token string, expiresAt time.Time) error {
+	s.tokens = append(s.tokens, token)
+	return nil
+}
+
+func TestPasswordResetTokens(t *testing.T) {
+	cases := []struct {
+		name   string
+		before func(t *testing.T)
+	}{
+		{"account deleted", func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/users/me/delete", strings.NewReader(`{"password":"correct-horse"}`))
+			r.Header.Set("Authorization", testSession(t, "alice"))
+			w := httptest.NewRecorder()
+			deleteAccountHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("deleting the account: status %d: %s", w.Code, w.Body)
+			}
+		}},
+		{"token outlived the account", func(t *testing.T) {
+			// As if the token had been issued while the account was deleted
+			rdb.Del(ctx, "alice")
+			rdb.SRem(ctx, "users", "alice")
+		}},
+		{"account disabled", func(t *testing.T) {
+			rdb.Set(ctx, userDisabledKey("alice"), "root.admin", 0)
+		}},
+		{"password changed", func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/users/me/password", strings.NewReader(`{"currentPassword":"correct-horse","newPassword":"battery-staple-9"}`))
+			r.Header.Set("Authorization", testSession(t, "alice"))
+			w := httptest.NewRecorder()
+			changePasswordHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("changing the password: status %d: %s", w.Code, w.Body)
+			}
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestRedis(t)
+			sender := &recordingResetSender{}
+			previous := resetSender
+			resetSender = sender
+			t.Cleanup(func() { resetSender = previous })
+
+			if err := setPassword("alice", "correct-horse"); err != nil {
+				t.Fatalf("storing password: %v", err)
+			}
+			rdb.SAdd(ctx, "users", "alice")
+
+			sendPasswordReset("alice")
+			if len(sender.tokens) != 1 {
+				t.Fatalf("sent %d reset tokens, want 1", len(sender.tokens))
+			}
+			tc.before(t)
+			after, _ := rdb.Get(ctx, "alice").Result()
+
+			body := `{"token":"` + sender.tokens[0] + `","newPassword":"new-secret-42"}`
+			r := httptest.NewRequest(http.MethodPost, "/api/password-reset/confirm", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			confirmPasswordResetHandler(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+			if stored, _ := rdb.Get(ctx, "alice").Result(); stored != after {
+				t.Errorf("credential changed from %q to %q, want the reset refused", after, stored)
+			}
+		})
+	}
+}
+
+func TestHandOverRoom(t *testing.T) {
+	useTestRedis(t)
+
+	// A moderator takes over without losing changes made in the meantime
+	room := testRoom(t, "alice")
+	rdb.SAdd(ctx, roomModeratorsKey(room.ID), "bob")
+	if _, err := updateChatroom(room.ID, func(r *Chatroom) { r.Topic = "changed" }); err != nil {
+		t.Fatalf("changing the topic: %v", err)
+	}
+	if owner, err := handOverRoom(room); err != nil || owner != "bob" {
+		t.Fatalf("handOverRoom() = %q, %v, want bob", owner, err)
+	}
+	got, _ := getChatroom(room.ID)
+	if got.CreatorID != "bob" || got.Topic != "changed" {
+		t.Errorf("room = owner %q, topic %q, want bob and the changed topic", got.CreatorID, got.Topic)
+	}
+	if !rdb.SIsMember(ctx, "user:bob:chatrooms", room.ID).Val() || rdb.SIsMember(ctx, "user:alice:chatrooms", room.ID).Val() {
+		t.Error("room was not moved to bob's rooms")
+	}
+
+	// Without moderators the room is archived and its hub stopped
+	lonely := testRoom(t, "alice")
+	hub := hubFor(lonely.ID)
+	if owner, err := handOverRoom(lonely); err != nil || owner != "" {
+		t.Fatalf("handOverRoom() = %q, %v, want no new owner", owner, err)
+	}
+	select {
+	case <-hub.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub of the archived room was not stopped")
+	}
+	if got, _ := getChatroom(lonely.ID); !got.Archived || !rdb.SIsMember(ctx, "chatrooms:archived", lonely.ID).Val() {
+		t.Error("room was not archived")
+	}
+}
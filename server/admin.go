@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// adminUsers lists usernames that are always admins (ADMIN_USERS=alice,bob).
+// Further superusers are granted through the admin API and kept in Redis.
+var adminUsers = parseList(envOr("ADMIN_USERS", ""))
+
+func parseList(v string) map[string]bool {
+	list := make(map[string]bool)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list[item] = true
+		}
+	}
+	return list
+}
+
+func isAdmin(username string) bool {
+	if username == "" {
+		return false
+	}
+	if adminUsers[username] {
+		return true
+	}
+
+	isSuper, err := rdb.SIsMember(ctx, "admins", username).Result()
+	if err != nil {
+		fmt.Printf("Error checking admin role: %v\n", err)
+	}
+	return isSuper
+}
+
+// requireAdmin returns the calling admin's username, or writes an error and
+// returns an empty string when the caller is not an admin
+func requireAdmin(w http.ResponseWriter, r *http.Request) string {
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return ""
+	}
+
+	if !isAdmin(username) {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "Admin access required")
+		return ""
+	}
+	return username
+}
+
+// HubStats is a snapshot of a running hub
+type HubStats struct {
+	RoomID         string   `json:"roomId"`
+	Clients        int      `json:"clients"`
+	Subscribers    int      `json:"subscribers"`
+	Users          []string `json:"users"`
+	Anonymous      int      `json:"anonymous"`
+	Typing         int      `json:"typing"`
+	BroadcastQueue int      `json:"broadcastQueue"`
+	QueueCapacity  int      `json:"queueCapacity"`
+}
+
+// stats is called from Run, which owns the hub state
+func (h *Hub) stats() HubStats {
+	stats := HubStats{
+		RoomID:         h.roomID,
+		Clients:        len(h.clients),
+		Subscribers:    len(h.subscribers),
+		Users:          []string{},
+		Typing:         len(h.typing),
+		BroadcastQueue: len(h.broadcast),
+		QueueCapacity:  cap(h.broadcast),
+	}
+
+	seen := make(map[string]bool)
+	for _, client := range h.clients {
+		if client.username == "" {
+			stats.Anonymous++
+		} else if !seen[client.username] {
+			seen[client.username] = true
+			stats.Users = append(stats.Users, client.username)
+		}
+	}
+	for sub := range h.subscribers {
+		if sub.username == "" {
+			stats.Anonymous++
+		} else if !seen[sub.username] {
+			seen[sub.username] = true
+			stats.Users = append(stats.Users, sub.username)
+		}
+	}
+	sort.Strings(stats.Users)
+	return stats
+}
+
+// disconnectAll closes every connection of the hub, used when a room is closed
+func (h *Hub) disconnectAll(reason string) {
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	for conn := range h.clients {
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		conn.Close()
+		delete(h.clients, conn)
+		delete(h.typing, conn)
+	}
+	for sub := range h.subscribers {
+		h.dropSubscriber(sub)
+	}
+	h.updateUserCount(0)
+}
+
+// inspectHub asks a hub for its stats, giving up if it is stuck
+func inspectHub(hub *Hub) (HubStats, bool) {
+	reply := make(chan HubStats, 1)
+	select {
+	case hub.inspect <- reply:
+		return <-reply, true
+	case <-hub.done:
+		return HubStats{RoomID: hub.roomID}, false
+	case <-time.After(2 * time.Second):
+		return HubStats{RoomID: hub.roomID}, false
+	}
+}
+
+// runningHubs returns a snapshot of all hubs
+func runningHubs() []*Hub {
+	hubsMutex.Lock()
+	defer hubsMutex.Unlock()
+
+	hubs := make([]*Hub, 0, len(chatHubs))
+	for _, hub := range chatHubs {
+		hubs = append(hubs, hub)
+	}
+	return hubs
+}
+
+// disconnectUser closes every connection open under an account: WebSocket
+// clients, the SSE, long-poll and gRPC streams subscribed to a hub, and IRC
+// sessions. These check the session only when they connect, so revoking it
+// does not end them.
+func disconnectUser(username, reason string) {
+	for _, hub := range runningHubs() {
+		hubSend(hub, hub.kick, kickRequest{username: username, reason: reason})
+	}
+	closeIRCSessions(username, reason)
+}
+
+// AdminUser is a user account as seen by admins
+type AdminUser struct {
+	Username       string `json:"username"`
+	Admin          bool   `json:"admin"`
+	Disabled       bool   `json:"disabled"`
+	Rooms          int64  `json:"rooms"`
+	ActiveSessions int    `json:"activeSessions"`
+}
+
+// adminUsersHandler lists user accounts. Query parameters: query (substring match).
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	usernames, err := rdb.SMembers(ctx, "users").Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching users")
+		return
+	}
+	sort.Strings(usernames)
+
+	query := strings.ToLower(r.URL.Query().Get("query"))
+	users := []AdminUser{}
+	for _, username := range usernames {
+		if query != "" && !strings.Contains(strings.ToLower(username), query) {
+			continue
+		}
+
+		rooms, _ := rdb.SCard(ctx, "user:"+username+":chatrooms").Result()
+		users = append(users, AdminUser{
+			Username:       username,
+			Admin:          isAdmin(username),
+			Disabled:       isDisabled(username),
+			Rooms:          rooms,
+			ActiveSessions: activeSessions(username),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users": users,
+	})
+}
+
+// adminUserActionHandler applies an action to a user account:
+// disable, enable, resetPassword, revokeSessions, grantAdmin or revokeAdmin
+func adminUserActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Action   string `json:"action"`
+		Password string `json:"password"` // resetPassword only, generated when empty
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	isUser, err := rdb.SIsMember(ctx, "users", req.Username).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching user")
+		return
+	}
+	if !isUser {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "User not found")
+		return
+	}
+
+	if req.Username == admin && (req.Action == "disable" || req.Action == "revokeAdmin") {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Admins cannot disable or demote themselves")
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":  true,
+		"username": req.Username,
+		"action":   req.Action,
+	}
+
+	switch req.Action {
+	case "disable":
+		if err = rdb.Set(ctx, userDisabledKey(req.Username), admin, 0).Err(); err == nil {
+			_, err = revokeSessions(req.Username, "")
+			disconnectUser(req.Username, "account disabled")
+		}
+
+	case "enable":
+		err = rdb.Del(ctx, userDisabledKey(req.Username)).Err()
+
+	case "resetPassword":
+		password := req.Password
+		if password == "" {
+			password, err = randomToken(9)
+			if err != nil {
+				break
+			}
+			response["temporaryPassword"] = password
+		} else {
+			var errs ValidationErrors
+			validatePassword(&errs, "password", password, req.Username)
+			if len(errs) > 0 {
+				writeValidationErrors(w, errs)
+				return
+			}
+		}
+		if err = setPassword(req.Username, password); err == nil {
+			if _, err = revokeSessions(req.Username, ""); err == nil {
+				err = revokePasswordResets(req.Username)
+			}
+			disconnectUser(req.Username, "password reset")
+		}
+
+	case "revokeSessions":
+		var revoked int
+		revoked, err = revokeSessions(req.Username, "")
+		response["revoked"] = revoked
+		disconnectUser(req.Username, "sessions revoked")
+
+	case "grantAdmin":
+		err = rdb.SAdd(ctx, "admins", req.Username).Err()
+
+	case "revokeAdmin":
+		if adminUsers[req.Username] {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "User is an admin through ADMIN_USERS")
+			return
+		}
+		err = rdb.SRem(ctx, "admins", req.Username).Err()
+
+	default:
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Unknown user action")
+		return
+	}
+
+	if err != nil {
+		fmt.Printf("Error applying admin action %s: %v\n", req.Action, err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error applying user action")
+		return
+	}
+
+	fmt.Printf("Admin %s applied %s to user %s\n", admin, req.Action, req.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// adminRoomsHandler lists every chatroom with live connection counts.
+// Query parameters: creator.
+func adminRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	chatroomIDs, err := rdb.SMembers(ctx, "chatrooms").Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching chatrooms")
+		return
+	}
+
+	creator := r.URL.Query().Get("creator")
+	type adminRoom struct {
+		Chatroom
+		Live bool `json:"live"`
+	}
+
+	rooms := []adminRoom{}
+	for _, id := range chatroomIDs {
+		room, err := getChatroom(id)
+		if err != nil {
+			continue // Skip this chatroom if there was an error
+		}
+		if creator != "" && room.CreatorID != creator {
+			continue
+		}
+		rooms = append(rooms, adminRoom{Chatroom: *room, Live: lookupHub(id) != nil})
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].CreatedAt.After(rooms[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chatrooms": rooms,
+	})
+}
+
+// stopHub disconnects everyone from a room's hub and stops it. Connections
+// opened afterwards start a new hub.
+func stopHub(roomID, reason string) {
+	hubsMutex.Lock()
+	hub := chatHubs[roomID]
+	delete(chatHubs, roomID)
+	hubsMutex.Unlock()
+
+	if hub != nil {
+		hubSend(hub, hub.stop, reason)
+	}
+}
+
+// deleteChatroom removes a chatroom and its data from Redis and disconnects
+// everyone still in it
+func deleteChatroom(room *Chatroom, reason string) error {
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx,
+		"chatroom:"+room.ID,
+		roomSeqKey(room.ID),
+		roomReadsKey(room.ID),
+		roomPublishedKey(room.ID),
+		roomMessagesKey(room.ID),
+		roomModeratorsKey(room.ID),
+		roomBansKey(room.ID),
+		roomMutesKey(room.ID),
+		roomModLogKey(room.ID),
+		roomFiltersKey(room.ID),
+		roomQuarantineKey(room.ID),
+		roomWebhooksKey(room.ID),
+		roomIncomingWebhooksKey(room.ID),
+	)
+	pipe.SRem(ctx, "chatrooms", room.ID)
+	pipe.SRem(ctx, "chatrooms:archived", room.ID)
+	pipe.SRem(ctx, "user:"+room.CreatorID+":chatrooms", room.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	stopHub(room.ID, reason)
+	invalidateFilterChain(room.ID)
+
+	if err := messageIndex.dropRoom(room.ID); err != nil {
+		fmt.Printf("Error removing room from search index: %v\n", err)
+	}
+	return nil
+}
+
+// adminCloseRoomHandler disconnects everyone from a room and optionally deletes it
+func adminCloseRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	var req struct {
+		RoomID string `json:"roomId"`
+		Reason string `json:"reason"`
+		Delete bool   `json:"delete"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	room, err := getChatroom(req.RoomID)
+	if err != nil {
+		if err == redis.Nil {
+			writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+		} else {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching chatroom")
+		}
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "room closed by an administrator"
+	}
+
+	// A deleted room has no moderation log left to write to
+	if req.Delete {
+		if err := deleteChatroom(room, reason); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error deleting chatroom")
+			return
+		}
+		fmt.Printf("Admin %s deleted room %s: %s\n", admin, room.ID, reason)
+	} else {
+		if hub := lookupHub(room.ID); hub != nil {
+			hubSend(hub, hub.closeAll, reason)
+		}
+		logModeration(room.ID, ModerationEntry{Action: "closeRoom", By: admin, Reason: reason, Timestamp: time.Now()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"roomId":  room.ID,
+		"deleted": req.Delete,
+	})
+}
+
+// adminHubsHandler reports the state of every running hub
+func adminHubsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	hubs := []HubStats{}
+	unresponsive := []string{}
+	for _, hub := range runningHubs() {
+		stats, ok := inspectHub(hub)
+		if !ok {
+			unresponsive = append(unresponsive, hub.roomID)
+			continue
+		}
+		hubs = append(hubs, stats)
+	}
+
+	sort.Slice(hubs, func(i, j int) bool {
+		return hubs[i].Clients > hubs[j].Clients
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hubs":         hubs,
+		"unresponsive": unresponsive,
+	})
+}
+
+// adminAnnounceHandler broadcasts a server-wide announcement to every hub
+func adminAnnounceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	admin := requireAdmin(w, r)
+	if admin == "" {
+		return
+	}
+
+	var req struct {
+		Content string `json:"content"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	content, errs := validateMessageContent(req.Content)
+	if content == "" {
+		errs.add("content", "required", "Announcement content is required")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	msg := map[string]interface{}{
+		"type":      "announcement",
+		"content":   content,
+		"sender":    "system",
+		"author":    admin,
+		"timestamp": time.Now(),
+	}
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating announcement")
+		return
+	}
+
+	hubs := runningHubs()
+	for _, hub := range hubs {
+		hubSend(hub, hub.broadcast, msgJSON)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"hubs":    len(hubs),
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBackfillUsersIndex(t *testing.T) {
+	useTestRedis(t)
+
+	// Records written before the users set existed, next to keys that are not users
+	for _, key := range []string{"alice", "bob.smith", "chatrooms", "session:alice_x", "chatroom_1"} {
+		rdb.Set(ctx, key, "hash", 0)
+	}
+	rdb.SAdd(ctx, "admins", "alice")
+
+	if err := backfillUsersIndex(); err != nil {
+		t.Fatalf("backfillUsersIndex: %v", err)
+	}
+
+	cases := []struct {
+		key  string
+		want bool
+	}{
+		{"alice", true},
+		{"bob.smith", true},
+		{"chatrooms", false},
+		{"session:alice_x", false},
+		{"chatroom_1", false},
+		{"admins", false},
+	}
+	for _, tc := range cases {
+		if got := rdb.SIsMember(ctx, "users", tc.key).Val(); got != tc.want {
+			t.Errorf("users contains %q = %v, want %v", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestAdminDeleteRoom(t *testing.T) {
+	useTestRedis(t)
+
+	admin := testSession(t, "root.admin")
+	rdb.SAdd(ctx, "admins", "root.admin")
+	room := testRoom(t, "alice")
+	logModeration(room.ID, ModerationEntry{Action: "ban", Username: "bob", By: "alice", Timestamp: time.Now()})
+
+	hub := hubFor(room.ID)
+	sub := newSubscriber("carol")
+	hubSend(hub, hub.subscribe, sub)
+
+	body := fmt.Sprintf(`{"roomId":%q,"delete":true}`, room.ID)
+	r := httptest.NewRequest(http.MethodPost, "/admin/api/rooms/close", strings.NewReader(body))
+	r.Header.Set("Authorization", admin)
+	w := httptest.NewRecorder()
+	adminCloseRoomHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	select {
+	case <-hub.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub was not stopped")
+	}
+	if lookupHub(room.ID) != nil {
+		t.Error("deleted room still has a hub")
+	}
+
+	// Subscribers are dropped and leaving no longer blocks
+	for range sub.frames {
+	}
+	hubSend(hub, hub.unsubscribe, sub)
+
+	for _, key := range []string{"chatroom:" + room.ID, roomModLogKey(room.ID)} {
+		if n := rdb.Exists(ctx, key).Val(); n != 0 {
+			t.Errorf("%s still exists", key)
+		}
+	}
+}
+
+func TestAdminUserActionsDisconnect(t *testing.T) {
+	for _, action := range []string{"disable", "resetPassword", "revokeSessions"} {
+		t.Run(action, func(t *testing.T) {
+			useTestRedis(t)
+			admin := testSession(t, "root.admin")
+			rdb.SAdd(ctx, "admins", "root.admin")
+			rdb.SAdd(ctx, "users", "alice")
+			room := testRoom(t, "bob")
+			token := testSession(t, "alice")
+
+			srv := httptest.NewServer(http.HandlerFunc(serveWs))
+			defer srv.Close()
+			conn, _, err := dialRoom(t, srv, room.ID, token)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			readFrame(t, conn, "userList")
+
+			// An IRC session logged in with the same session token
+			server, client := net.Pipe()
+			defer client.Close()
+			go newIRCSession(server).serve()
+			lines := make(chan string, 32)
+			go func() {
+				scanner := bufio.NewScanner(client)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+				close(lines)
+			}()
+			fmt.Fprintf(client, "PASS %s\r\nNICK alice\r\nUSER alice 0 * :alice\r\n", token)
+			waitForLine := func(prefix string) {
+				t.Helper()
+				timeout := time.After(5 * time.Second)
+				for {
+					select {
+					case line, ok := <-lines:
+						if !ok {
+							t.Fatalf("IRC connection closed before %q", prefix)
+						}
+						if strings.HasPrefix(line, prefix) {
+							return
+						}
+					case <-timeout:
+						t.Fatalf("timed out waiting for %q", prefix)
+					}
+				}
+			}
+			waitForLine(":chat.local 001 alice")
+
+			body := fmt.Sprintf(`{"username":"alice","action":%q}`, action)
+			r := httptest.NewRequest(http.MethodPost, "/admin/api/users/action", strings.NewReader(body))
+			r.Header.Set("Authorization", admin)
+			w := httptest.NewRecorder()
+			adminUserActionHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+						t.Errorf("WebSocket ended with %v, want it closed by the server", err)
+					}
+					break
+				}
+			}
+
+			waitForLine("ERROR :Closing link")
+			for range lines {
+			}
+		})
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// API key scopes. A key only reaches the parts of the API its scopes cover;
+// account management always needs a human session.
+const (
+	scopeRead  = "read"  // GET requests to the REST API
+	scopeWrite = "write" // other REST API requests
+	scopeChat  = "chat"  // WebSocket connections
+	scopeAdmin = "admin" // admin API, still subject to isAdmin
+)
+
+var validScopes = map[string]bool{scopeRead: true, scopeWrite: true, scopeChat: true, scopeAdmin: true}
+
+// apiKeyRateLimit applies to keys created without their own limit
+var apiKeyRateLimit = loadRatePolicy("api_key", 600, time.Minute)
+
+// realtimePaths accept the token as a query parameter and need the chat scope
+var realtimePaths = map[string]bool{
+	"/ws":                       true,
+	"/api/chatrooms/events":     true,
+	"/api/chatrooms/poll/open":  true,
+	"/api/chatrooms/poll":       true,
+	"/api/chatrooms/poll/close": true,
+	"/api/chatrooms/messages":   true,
+}
+
+// sessionOnlyPaths are never reachable with an API key
+var sessionOnlyPaths = map[string]bool{
+	"/api/users/me/password": true,
+	"/api/users/me/delete":   true,
+	"/api/bots":              true,
+	"/api/bots/keys":         true,
+	"/api/bots/keys/revoke":  true,
+}
+
+// Bot is a non-human account that authenticates with API keys only
+type Bot struct {
+	Username  string    `json:"username"`
+	Owner     string    `json:"owner"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// APIKey is a long lived credential for a bot. The secret itself is only
+// shown once, when the key is created.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Username   string     `json:"username"`
+	Scopes     []string   `json:"scopes"`
+	RateLimit  string     `json:"rateLimit,omitempty"`
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type storedAPIKey struct {
+	APIKey
+	SecretHash string `json:"secretHash"`
+}
+
+func botKey(username string) string {
+	return "bot:" + username
+}
+
+func userBotsKey(username string) string {
+	return "user:" + username + ":bots"
+}
+
+func apiKeyKey(id string) string {
+	return "apikey:" + id
+}
+
+// botAPIKeysKey is the set of key ids issued to a bot
+func botAPIKeysKey(username string) string {
+	return "bot:" + username + ":apikeys"
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// isAPIKeyToken tells API keys ("key_<id>_<secret>") apart from session
+// tokens ("<username>_<secret>"), which never contain a second underscore
+// because usernames cannot contain one
+func isAPIKeyToken(token string) bool {
+	return strings.HasPrefix(token, "key_") && strings.Count(token, "_") == 2
+}
+
+func isBot(username string) bool {
+	member, err := rdb.SIsMember(ctx, "bots", username).Result()
+	if err != nil {
+		fmt.Printf("Error checking bot account: %v\n", err)
+		return false
+	}
+	return member
+}
+
+func getBot(username string) (*Bot, error) {
+	botJSON, err := rdb.Get(ctx, botKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var bot Bot
+	if err := json.Unmarshal([]byte(botJSON), &bot); err != nil {
+		return nil, err
+	}
+	return &bot, nil
+}
+
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) ratePolicy() ratePolicy {
+	if n, d, ok := parseRateLimit(k.RateLimit); ok {
+		return ratePolicy{name: "api_key", limit: n, per: d}
+	}
+	return apiKeyRateLimit
+}
+
+// lookupAPIKey returns the key a token belongs to, or nil for unknown and
+// revoked keys and disabled bots
+func lookupAPIKey(token string) *APIKey {
+	if !isAPIKeyToken(token) {
+		return nil
+	}
+	parts := strings.SplitN(token, "_", 3)
+
+	keyJSON, err := rdb.Get(ctx, apiKeyKey(parts[1])).Result()
+	if err != nil {
+		if err != redis.Nil {
+			fmt.Printf("Error looking up API key: %v\n", err)
+		}
+		return nil
+	}
+
+	var stored storedAPIKey
+	if err := json.Unmarshal([]byte(keyJSON), &stored); err != nil {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[2])), []byte(stored.SecretHash)) != 1 {
+		return nil
+	}
+	if isDisabled(stored.Username) {
+		return nil
+	}
+	return &stored.APIKey
+}
+
+// requiredScope maps a request to the scope an API key needs for it. An
+// empty result means API keys are not accepted at all.
+func requiredScope(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case sessionOnlyPaths[path], strings.HasPrefix(path, "/auth/"):
+		return ""
+	case realtimePaths[path]:
+		return scopeChat
+	case strings.HasPrefix(path, "/admin/"):
+		return scopeAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return scopeRead
+	case strings.HasPrefix(path, "/api/"):
+		return scopeWrite
+	}
+	return ""
+}
+
+// apiKeyMiddleware checks scopes and per-key rate limits of requests made
+// with an API key and records when the key was last used. Handlers then
+// resolve the key to its bot through extractUsernameFromToken as usual.
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if !isAPIKeyToken(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := lookupAPIKey(token)
+		if key == nil {
+			writeError(w, http.StatusUnauthorized, errCodeInvalidToken, "Invalid API key")
+			return
+		}
+
+		scope := requiredScope(r)
+		if scope == "" {
+			writeError(w, http.StatusForbidden, errCodeForbidden, "This endpoint does not accept API keys")
+			return
+		}
+		if !key.hasScope(scope) {
+			writeErrorDetails(w, http.StatusForbidden, errCodeForbidden, "API key is missing a required scope", map[string]string{
+				"requiredScope": scope,
+			})
+			return
+		}
+
+		if rateLimited(w, key.ratePolicy(), key.ID) {
+			return
+		}
+
+		touchAPIKey(key.ID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// touchAPIKey records that a key was just used
+func touchAPIKey(id string) {
+	rdb.HSet(ctx, "apikeys:last_used", id, time.Now().UTC().Format(time.RFC3339))
+}
+
+// manageableBot loads a bot the caller owns, or any bot for admins. It
+// writes the error response and returns nil when the caller may not manage it.
+func manageableBot(w http.ResponseWriter, caller, username string) *Bot {
+	bot, err := getBot(username)
+	if err == redis.Nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Bot not found")
+		return nil
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching bot")
+		return nil
+	}
+
+	if bot.Owner != caller && !isAdmin(caller) {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "Only the bot's owner can manage it")
+		return nil
+	}
+	return bot
+}
+
+// botsHandler lists the caller's bots (GET) or creates a new one (POST)
+func botsHandler(w http.ResponseWriter, r *http.Request) {
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		names, err := rdb.SMembers(ctx, userBotsKey(username)).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching bots")
+			return
+		}
+		sort.Strings(names)
+
+		bots := []Bot{}
+		for _, name := range names {
+			if bot, err := getBot(name); err == nil {
+				bots = append(bots, *bot)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bots)
+
+	case http.MethodPost:
+		createBot(w, r, username)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+	}
+}
+
+func createBot(w http.ResponseWriter, r *http.Request, owner string) {
+	if rateLimited(w, registerRateLimit, "bot:"+owner) {
+		return
+	}
+
+	var req struct {
+		Username    string `json:"username"`
+		DisplayName string `json:"displayName"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	var errs ValidationErrors
+	validateUsername(&errs, req.Username)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	// Bots live in the user namespace but can never log in with a password
+	created, err := rdb.SetNX(ctx, req.Username, unusablePasswordHash, 0).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing bot")
+		return
+	}
+	if !created {
+		writeError(w, http.StatusConflict, errCodeUsernameTaken, "Username already exists")
+		return
+	}
+
+	bot := Bot{Username: req.Username, Owner: owner, CreatedAt: time.Now()}
+	botJSON, err := json.Marshal(bot)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing bot")
+		return
+	}
+
+	displayName := normalizeText(req.DisplayName, false)
+	if displayName == "" {
+		displayName = req.Username
+	}
+	profileJSON, _ := json.Marshal(Profile{Username: req.Username, DisplayName: displayName, UpdatedAt: time.Now()})
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, botKey(req.Username), botJSON, 0)
+	pipe.Set(ctx, userProfileKey(req.Username), profileJSON, 0)
+	pipe.SAdd(ctx, "bots", req.Username)
+	pipe.SAdd(ctx, "users", req.Username)
+	pipe.SAdd(ctx, userBotsKey(owner), req.Username)
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing bot")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bot)
+}
+
+// botKeysHandler lists a bot's API keys (GET ?bot=) or issues a new one (POST)
+func botKeysHandler(w http.ResponseWriter, r *http.Request) {
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		bot := manageableBot(w, username, r.URL.Query().Get("bot"))
+		if bot == nil {
+			return
+		}
+
+		keys, err := listAPIKeys(bot.Username)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching API keys")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+
+	case http.MethodPost:
+		createAPIKey(w, r, username)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+	}
+}
+
+func listAPIKeys(botName string) ([]APIKey, error) {
+	ids, err := rdb.SMembers(ctx, botAPIKeysKey(botName)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	lastUsed := map[string]string{}
+	if len(ids) > 0 {
+		values, err := rdb.HMGet(ctx, "apikeys:last_used", ids...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				lastUsed[ids[i]] = s
+			}
+		}
+	}
+
+	keys := []APIKey{}
+	for _, id := range ids {
+		keyJSON, err := rdb.Get(ctx, apiKeyKey(id)).Result()
+		if err != nil {
+			continue
+		}
+
+		var stored storedAPIKey
+		if err := json.Unmarshal([]byte(keyJSON), &stored); err != nil {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, lastUsed[id]); err == nil {
+			stored.LastUsedAt = &t
+		}
+		keys = append(keys, stored.APIKey)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request, caller string) {
+	var req struct {
+		Bot       string   `json:"bot"`
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		RateLimit string   `json:"rateLimit"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	bot := manageableBot(w, caller, req.Bot)
+	if bot == nil {
+		return
+	}
+
+	var errs ValidationErrors
+	req.Name = normalizeText(req.Name, false)
+	if req.Name == "" {
+		errs.add("name", "required", "Key name is required")
+	}
+	if len(req.Scopes) == 0 {
+		errs.add("scopes", "required", "At least one scope is required")
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			errs.add("scopes", "invalid", "Unknown scope %q", scope)
+		}
+	}
+	if req.RateLimit != "" {
+		if _, _, ok := parseRateLimit(req.RateLimit); !ok {
+			errs.add("rateLimit", "invalid", "Rate limit must look like <count>/<duration>, e.g. 60/1m")
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	id, err := randomToken(6)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error generating API key")
+		return
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error generating API key")
+		return
+	}
+
+	stored := storedAPIKey{
+		APIKey: APIKey{
+			ID:        id,
+			Name:      req.Name,
+			Username:  bot.Username,
+			Scopes:    req.Scopes,
+			RateLimit: req.RateLimit,
+			CreatedBy: caller,
+			CreatedAt: time.Now(),
+		},
+		SecretHash: hashSecret(secret),
+	}
+	keyJSON, err := json.Marshal(stored)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing API key")
+		return
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, apiKeyKey(id), keyJSON, 0)
+	pipe.SAdd(ctx, botAPIKeysKey(bot.Username), id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing API key")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":    "key_" + id + "_" + secret,
+		"apiKey": stored.APIKey,
+	})
+}
+
+// revokeAPIKeyHandler permanently revokes one API key
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	keyJSON, err := rdb.Get(ctx, apiKeyKey(req.ID)).Result()
+	if err == redis.Nil || req.ID == "" {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching API key")
+		return
+	}
+
+	var stored storedAPIKey
+	if err := json.Unmarshal([]byte(keyJSON), &stored); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching API key")
+		return
+	}
+
+	if manageableBot(w, username, stored.Username) == nil {
+		return
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, apiKeyKey(req.ID))
+	pipe.SRem(ctx, botAPIKeysKey(stored.Username), req.ID)
+	pipe.HDel(ctx, "apikeys:last_used", req.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error revoking API key")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "API key revoked",
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAPIKey stores an API key for a bot and returns its token
+func testAPIKey(t *testing.T, bot string, scopes ...string) string {
+	t.Helper()
+
+	id, secret := "k"+bot+scopes[0], "secret"
+	keyJSON, err := json.Marshal(storedAPIKey{
+		APIKey:     APIKey{ID: id, Name: "test", Username: bot, Scopes: scopes, CreatedAt: time.Now()},
+		SecretHash: hashSecret(secret),
+	})
+	if err != nil {
+		t.Fatalf("encoding API key: %v", err)
+	}
+	if err := rdb.Set(ctx, apiKeyKey(id), keyJSON, 0).Err(); err != nil {
+		t.Fatalf("storing API key: %v", err)
+	}
+	return "key_" + id + "_" + secret
+}
+
+func TestRequiredScope(t *testing.T) {
+	cases := []struct {
+		method, path string
+		want         string
+	}{
+		{http.MethodGet, "/ws", scopeChat},
+		{http.MethodGet, "/api/chatrooms/events", scopeChat},
+		{http.MethodPost, "/api/chatrooms/messages", scopeChat},
+		{http.MethodGet, "/api/chatrooms", scopeRead},
+		{http.MethodHead, "/api/chatrooms/history", scopeRead},
+		{http.MethodPost, "/api/chatrooms", scopeWrite},
+		{http.MethodPost, "/admin/api/users/action", scopeAdmin},
+		{http.MethodPost, "/api/users/me/password", ""},
+		{http.MethodPost, "/api/bots/keys", ""},
+		{http.MethodGet, "/auth/oidc/login", ""},
+		{http.MethodPost, "/hooks/abc", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if got := requiredScope(r); got != tc.want {
+				t.Errorf("requiredScope = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	useTestRedis(t)
+	readKey := testAPIKey(t, "readbot", scopeRead)
+	chatKey := testAPIKey(t, "chatbot", scopeChat)
+
+	// The handler authenticates the same way the real ones do
+	handler := apiKeyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if extractUsernameFromToken(requestToken(r)) == "" {
+			writeError(w, http.StatusUnauthorized, errCodeAuthRequired, "Authorization required")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		name          string
+		method, path  string
+		header, query string
+		want          int
+	}{
+		{"read key reads", http.MethodGet, "/api/chatrooms", readKey, "", http.StatusOK},
+		{"read key writes", http.MethodPost, "/api/chatrooms", readKey, "", http.StatusForbidden},
+		{"read key chats", http.MethodGet, "/ws", "", readKey, http.StatusForbidden},
+		{"read key chats behind a bogus header", http.MethodGet, "/ws", "x", readKey, http.StatusUnauthorized},
+		{"chat key chats", http.MethodGet, "/ws", "", chatKey, http.StatusOK},
+		{"query token outside real-time paths", http.MethodGet, "/api/chatrooms", "", readKey, http.StatusUnauthorized},
+		{"session only path", http.MethodPost, "/api/users/me/password", chatKey, "", http.StatusForbidden},
+		{"unknown key", http.MethodGet, "/api/chatrooms", "key_nope_secret", "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			target := tc.path
+			if tc.query != "" {
+				target += "?token=" + url.QueryEscape(tc.query)
+			}
+			r := httptest.NewRequest(tc.method, target, nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestSendMessageWithQueryToken(t *testing.T) {
+	useTestRedis(t)
+	chatKey := testAPIKey(t, "chatbot", scopeChat)
+	room := testRoom(t, "alice")
+
+	// The key the middleware checked is the one the handler posts as
+	handler := apiKeyMiddleware(http.HandlerFunc(sendMessageHandler))
+	body := fmt.Sprintf(`{"roomId":%q,"content":"beep"}`, room.ID)
+	r := httptest.NewRequest(http.MethodPost, "/api/chatrooms/messages?token="+url.QueryEscape(chatKey), strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	var msg map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &msg)
+	if msg["author"] != "chatbot" {
+		t.Errorf("author = %v, want chatbot", msg["author"])
+	}
+}
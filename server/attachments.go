@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Attachment is the metadata of an uploaded file
+type Attachment struct {
+	ID           string    `json:"id"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"contentType"`
+	Size         int64     `json:"size"`
+	UploaderID   string    `json:"uploaderId"`
+	RoomID       string    `json:"roomId,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	HasThumbnail bool      `json:"hasThumbnail"`
+	URL          string    `json:"url,omitempty"`
+	ThumbnailURL string    `json:"thumbnailUrl,omitempty"`
+}
+
+// blobs is the storage backend for attachment contents
+var blobs BlobStore
+
+// maxAttachmentSize limits the size of a single upload in bytes
+var maxAttachmentSize = envInt("ATTACHMENT_MAX_BYTES", 10<<20)
+
+// allowedAttachmentTypes lists the sniffed MIME types accepted for upload
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// thumbnailSize is the longest edge of generated image thumbnails in pixels
+const thumbnailSize = 256
+
+// maxThumbnailPixels limits the dimensions of images that get a thumbnail.
+// The header is checked before decoding, so a small file declaring a huge
+// canvas is never expanded in memory.
+var maxThumbnailPixels = envInt("ATTACHMENT_MAX_PIXELS", 40_000_000)
+
+// maxAttachmentsPerMessage limits how many attachments a chat message may reference
+const maxAttachmentsPerMessage = 10
+
+func attachmentBlobKey(id string) string {
+	return "attachments/" + id
+}
+
+func thumbnailBlobKey(id string) string {
+	return "thumbnails/" + id + ".png"
+}
+
+// withURLs fills in the download URLs of an attachment
+func (a Attachment) withURLs() Attachment {
+	a.URL = "/api/attachments/" + a.ID
+	if a.HasThumbnail {
+		a.ThumbnailURL = "/api/attachments/" + a.ID + "/thumbnail"
+	}
+	return a
+}
+
+func getAttachment(id string) (*Attachment, error) {
+	attachmentJSON, err := rdb.Get(ctx, "attachment:"+id).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var attachment Attachment
+	if err := json.Unmarshal([]byte(attachmentJSON), &attachment); err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// resolveAttachments turns the attachment ids referenced by a chat message
+// into attachment metadata with download URLs. Unknown ids and attachments
+// uploaded to another room are dropped.
+func resolveAttachments(roomID string, refs []interface{}) []Attachment {
+	attachments := []Attachment{}
+	for _, ref := range refs {
+		if len(attachments) == maxAttachmentsPerMessage {
+			break
+		}
+
+		id, ok := ref.(string)
+		if !ok {
+			// Clients may echo back full attachment objects
+			if obj, isObj := ref.(map[string]interface{}); isObj {
+				id, ok = obj["id"].(string)
+			}
+		}
+		if !ok || id == "" {
+			continue
+		}
+
+		attachment, err := getAttachment(id)
+		if err != nil {
+			fmt.Printf("Error resolving attachment %s: %v\n", id, err)
+			continue
+		}
+		if attachment.RoomID != "" && attachment.RoomID != roomID {
+			continue
+		}
+		attachments = append(attachments, attachment.withURLs())
+	}
+	return attachments
+}
+
+// makeThumbnail scales an image down so its longest edge is thumbnailSize
+func makeThumbnail(src image.Image) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > thumbnailSize || h > thumbnailSize {
+		if w >= h {
+			h = h * thumbnailSize / w
+			w = thumbnailSize
+		} else {
+			w = w * thumbnailSize / h
+			h = thumbnailSize
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, max(w, 1), max(h, 1)))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+// thumbnailable reports whether an image header declares dimensions small
+// enough to decode
+func thumbnailable(data []byte) bool {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	return config.Width > 0 && config.Height > 0 &&
+		int64(config.Width)*int64(config.Height) <= maxThumbnailPixels
+}
+
+func uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	// Leave some room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, "File too large or invalid upload")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// Attachments belong to the room they are uploaded to and are only
+	// served to its readers
+	roomID := r.FormValue("roomId")
+	if roomID == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Room ID is required")
+		return
+	}
+	if readableRoom(w, roomID, username) == nil {
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "File is required")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxAttachmentSize {
+		writeError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, "File too large")
+		return
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Error reading file")
+		return
+	}
+
+	// Trust the content, not the client supplied Content-Type
+	contentType := http.DetectContentType(data)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	if !allowedAttachmentTypes[contentType] {
+		writeError(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "File type not allowed: "+contentType)
+		return
+	}
+
+	attachment := Attachment{
+		ID:          uuid.New().String(),
+		Filename:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		UploaderID:  username,
+		RoomID:      roomID,
+		CreatedAt:   time.Now(),
+	}
+
+	if err := blobs.Put(r.Context(), attachmentBlobKey(attachment.ID), bytes.NewReader(data), attachment.Size, contentType); err != nil {
+		fmt.Printf("Error storing attachment: %v\n", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing file")
+		return
+	}
+
+	// Generate a thumbnail for images, a failure here does not fail the upload
+	if strings.HasPrefix(contentType, "image/") && thumbnailable(data) {
+		if img, _, err := image.Decode(bytes.NewReader(data)); err == nil {
+			var thumb bytes.Buffer
+			if err := png.Encode(&thumb, makeThumbnail(img)); err == nil {
+				err = blobs.Put(r.Context(), thumbnailBlobKey(attachment.ID), bytes.NewReader(thumb.Bytes()), int64(thumb.Len()), "image/png")
+				attachment.HasThumbnail = err == nil
+			}
+			if err != nil {
+				fmt.Printf("Error creating thumbnail: %v\n", err)
+			}
+		}
+	}
+
+	attachmentJSON, err := json.Marshal(attachment)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing file")
+		return
+	}
+
+	if err := rdb.Set(ctx, "attachment:"+attachment.ID, attachmentJSON, 0).Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing attachment data")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment.withURLs())
+}
+
+// attachmentHandler serves /api/attachments/<id> and /api/attachments/<id>/thumbnail
+func attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/attachments/")
+	id, variant, _ := strings.Cut(path, "/")
+	if id == "" || (variant != "" && variant != "thumbnail") {
+		writeError(w, http.StatusNotFound, errCodeAttachmentNotFound, "Attachment not found")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	attachment, err := getAttachment(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeAttachmentNotFound, "Attachment not found")
+		return
+	}
+
+	// Attachments uploaded before they were tied to a room only need a session
+	if attachment.RoomID != "" && readableRoom(w, attachment.RoomID, username) == nil {
+		return
+	}
+
+	key, contentType := attachmentBlobKey(id), attachment.ContentType
+	if variant == "thumbnail" {
+		if !attachment.HasThumbnail {
+			writeError(w, http.StatusNotFound, errCodeAttachmentNotFound, "Attachment has no thumbnail")
+			return
+		}
+		key, contentType = thumbnailBlobKey(id), "image/png"
+	}
+
+	blob, err := blobs.Get(r.Context(), key)
+	if err != nil {
+		if err == errBlobNotFound {
+			writeError(w, http.StatusNotFound, errCodeAttachmentNotFound, "Attachment not found")
+		} else {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error reading attachment")
+		}
+		return
+	}
+	defer blob.Close()
+
+	// Only images are rendered inline, everything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, attachment.Filename))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	io.Copy(w, blob)
+}
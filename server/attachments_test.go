@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory stand-in for an S3 compatible server. It speaks just
+// enough of the API for the client used by s3BlobStore and ignores signatures.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := r.URL.Query()["location"]; ok {
+		io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	objects, exists := s.buckets[bucket]
+	if key == "" {
+		switch {
+		case r.Method == http.MethodPut:
+			s.buckets[bucket] = map[string][]byte{}
+		case !exists:
+			s3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		}
+		return
+	}
+	if !exists {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body = decodeAWSChunked(body)
+		}
+		objects[key] = body
+		w.Header().Set("ETag", `"fake"`)
+
+	case http.MethodGet, http.MethodHead:
+		data, ok := objects[key]
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"fake"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>`+code+`</Code></Error>`)
+	}
+}
+
+// decodeAWSChunked strips the chunk framing of a streaming signed upload
+func decodeAWSChunked(body []byte) []byte {
+	var data []byte
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return data
+		}
+		sizeHex, _, _ := bytes.Cut(header, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil || size == 0 || int64(len(rest)) < size {
+			return data
+		}
+		data = append(data, rest[:size]...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+}
+
+func TestBlobStores(t *testing.T) {
+	local, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("local store: %v", err)
+	}
+
+	standIn := httptest.NewServer(&fakeS3{buckets: map[string]map[string][]byte{}})
+	defer standIn.Close()
+	s3, err := newS3BlobStore(strings.TrimPrefix(standIn.URL, "http://"), "chat-attachments", "key", "secret", false)
+	if err != nil {
+		t.Fatalf("s3 store: %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		store BlobStore
+	}{
+		{"local", local},
+		{"s3", s3},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			content := []byte("hello attachments")
+
+			if err := tc.store.Put(ctx, "attachments/a", bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			blob, err := tc.store.Get(ctx, "attachments/a")
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			got, err := io.ReadAll(blob)
+			blob.Close()
+			if err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("Get returned %q, %v; want %q", got, err, content)
+			}
+
+			if err := tc.store.Delete(ctx, "attachments/a"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := tc.store.Get(ctx, "attachments/a"); err != errBlobNotFound {
+				t.Fatalf("Get after Delete returned %v, want errBlobNotFound", err)
+			}
+		})
+	}
+}
+
+// testPNG encodes a 1x1 image and then rewrites the dimensions in its header,
+// so it can declare a canvas far larger than its content
+func testPNG(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("encoding png: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Signature (8), IHDR length (4) and type (4) precede width and height
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestThumbnailable(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"small image", testPNG(t, 1, 1), true},
+		{"declared huge canvas", testPNG(t, 100000, 100000), false},
+		{"zero width", testPNG(t, 0, 1), false},
+		{"not an image", []byte("plain text"), false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := thumbnailable(tc.data); got != tc.want {
+				t.Errorf("thumbnailable() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// uploadRequest builds a multipart upload of data to a room
+func uploadRequest(t *testing.T, token, roomID string, data []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("roomId", roomID)
+	part, _ := form.CreateFormFile("file", "image.png")
+	part.Write(data)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/attachments", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+	return r
+}
+
+func TestAttachmentAccess(t *testing.T) {
+	useTestRedis(t)
+
+	previous := blobs
+	store, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("local store: %v", err)
+	}
+	blobs = store
+	t.Cleanup(func() { blobs = previous })
+
+	alice, bob := testSession(t, "alice"), testSession(t, "bob")
+	room := testRoom(t, "alice")
+	if err := restrictUser(roomBansKey(room.ID), "bob", "alice", "", 0); err != nil {
+		t.Fatalf("banning bob: %v", err)
+	}
+
+	uploads := []struct {
+		name          string
+		token         string
+		roomID        string
+		data          []byte
+		wantStatus    int
+		wantThumbnail bool
+	}{
+		{"member", alice, room.ID, testPNG(t, 1, 1), http.StatusCreated, true},
+		{"declared huge canvas", alice, room.ID, testPNG(t, 100000, 100000), http.StatusCreated, false},
+		{"banned user", bob, room.ID, testPNG(t, 1, 1), http.StatusForbidden, false},
+		{"unknown room", alice, "missing", testPNG(t, 1, 1), http.StatusNotFound, false},
+		{"no session", "", room.ID, testPNG(t, 1, 1), http.StatusUnauthorized, false},
+	}
+
+	var uploaded Attachment
+	for _, tc := range uploads {
+		t.Run("upload "+tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			uploadAttachmentHandler(w, uploadRequest(t, tc.token, tc.roomID, tc.data))
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusCreated {
+				return
+			}
+
+			var attachment Attachment
+			if err := json.NewDecoder(w.Body).Decode(&attachment); err != nil {
+				t.Fatalf("decoding attachment: %v", err)
+			}
+			if attachment.HasThumbnail != tc.wantThumbnail {
+				t.Errorf("HasThumbnail = %v, want %v", attachment.HasThumbnail, tc.wantThumbnail)
+			}
+			if attachment.HasThumbnail {
+				uploaded = attachment
+			}
+		})
+	}
+	if uploaded.ID == "" {
+		t.Fatal("no attachment was uploaded")
+	}
+
+	downloads := []struct {
+		name       string
+		token      string
+		path       string
+		wantStatus int
+	}{
+		{"member", alice, uploaded.URL, http.StatusOK},
+		{"member thumbnail", alice, uploaded.ThumbnailURL, http.StatusOK},
+		{"banned user", bob, uploaded.URL, http.StatusForbidden},
+		{"no session", "", uploaded.URL, http.StatusUnauthorized},
+		{"unknown attachment", alice, "/api/attachments/missing", http.StatusNotFound},
+	}
+
+	for _, tc := range downloads {
+		t.Run("download "+tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", tc.token)
+			}
+			w := httptest.NewRecorder()
+			attachmentHandler(w, r)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestHistoryAccess(t *testing.T) {
+	useTestRedis(t)
+
+	alice, bob := testSession(t, "alice"), testSession(t, "bob")
+	room := testRoom(t, "alice")
+	if err := restrictUser(roomBansKey(room.ID), "bob", "alice", "", 0); err != nil {
+		t.Fatalf("banning bob: %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		token      string
+		roomID     string
+		wantStatus int
+	}{
+		{"member", alice, room.ID, http.StatusOK},
+		{"banned user", bob, room.ID, http.StatusForbidden},
+		{"no session", "", room.ID, http.StatusUnauthorized},
+		{"unknown room", alice, "missing", http.StatusNotFound},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/history?roomId="+tc.roomID, nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", tc.token)
+			}
+			w := httptest.NewRecorder()
+			historyHandler(w, r)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+		})
+	}
+}
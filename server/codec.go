@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Frame encodings negotiated through Sec-WebSocket-Protocol. Clients that do
+// not ask for a subprotocol get the JSON envelope as text frames.
+const (
+	encodingJSON    = "chat.json"
+	encodingMsgpack = "chat.msgpack"
+)
+
+var supportedSubprotocols = []string{encodingJSON, encodingMsgpack}
+
+// Compression settings for permessage-deflate. Frames smaller than the
+// threshold are sent uncompressed as deflate would not pay off.
+var (
+	compressionEnabled   = envOr("WS_COMPRESSION", "true") == "true"
+	compressionLevel     = int(envInt("WS_COMPRESSION_LEVEL", 1))
+	compressionThreshold = int(envInt("WS_COMPRESSION_THRESHOLD", 512))
+)
+
+// clientEncoding returns the frame encoding negotiated for a connection
+func clientEncoding(conn *websocket.Conn) string {
+	if conn.Subprotocol() == encodingMsgpack {
+		return encodingMsgpack
+	}
+	return encodingJSON
+}
+
+// decodeFrame converts an incoming frame to the JSON envelope used internally
+func decodeFrame(encoding string, messageType int, data []byte) ([]byte, error) {
+	if encoding != encodingMsgpack || messageType != websocket.BinaryMessage {
+		return data, nil
+	}
+
+	var msg map[string]interface{}
+	if err := msgpack.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("decoding msgpack frame: %w", err)
+	}
+	return json.Marshal(msg)
+}
+
+// encodeFrame converts a JSON envelope to the frame type and payload for an encoding
+func encodeFrame(encoding string, message []byte) (int, []byte, error) {
+	if encoding != encodingMsgpack {
+		return websocket.TextMessage, message, nil
+	}
+
+	var msg interface{}
+	if err := json.Unmarshal(message, &msg); err != nil {
+		// Not a JSON envelope, pass it through untouched
+		return websocket.TextMessage, message, nil
+	}
+
+	payload, err := msgpack.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, payload, nil
+}
+
+// frameCache prepares a broadcast once per encoding instead of once per client.
+// A prepared message also caches its framed (and compressed) form, so large
+// rooms do not pay for framing and deflate on every recipient.
+type frameCache struct {
+	message []byte
+	frames  map[string]preparedFrame
+}
+
+type preparedFrame struct {
+	prepared *websocket.PreparedMessage
+	size     int
+	err      error
+}
+
+func newFrameCache(message []byte) *frameCache {
+	return &frameCache{message: message, frames: make(map[string]preparedFrame)}
+}
+
+// prepare returns the prepared message for an encoding and its payload size
+func (c *frameCache) prepare(encoding string) (*websocket.PreparedMessage, int, error) {
+	frame, ok := c.frames[encoding]
+	if !ok {
+		messageType, payload, err := encodeFrame(encoding, c.message)
+		if err == nil {
+			frame.prepared, err = websocket.NewPreparedMessage(messageType, payload)
+			frame.size = len(payload)
+		}
+		frame.err = err
+		c.frames[encoding] = frame
+	}
+	return frame.prepared, frame.size, frame.err
+}
+
+// writeFrame writes a prepared frame, compressing it only above the threshold
+func writeFrame(conn *websocket.Conn, prepared *websocket.PreparedMessage, size int) error {
+	conn.EnableWriteCompression(compressionEnabled && size >= compressionThreshold)
+	return conn.WritePreparedMessage(prepared)
+}
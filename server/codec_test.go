@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestEncodeDecodeFrame(t *testing.T) {
+	envelope := []byte(`{"content":"hi","id":7,"type":"chat"}`)
+
+	messageType, payload, err := encodeFrame(encodingMsgpack, envelope)
+	if err != nil || messageType != websocket.BinaryMessage {
+		t.Fatalf("encodeFrame(msgpack) = %d, %v, want a binary frame", messageType, err)
+	}
+	decoded, err := decodeFrame(encodingMsgpack, websocket.BinaryMessage, payload)
+	if err != nil || string(decoded) != string(envelope) {
+		t.Errorf("decodeFrame(encodeFrame()) = %s, %v, want %s", decoded, err, envelope)
+	}
+
+	cases := []struct {
+		name        string
+		encoding    string
+		messageType int
+		data        []byte
+		want        string
+		wantErr     bool
+	}{
+		{"json client", encodingJSON, websocket.TextMessage, envelope, string(envelope), false},
+		{"text frame from a msgpack client", encodingMsgpack, websocket.TextMessage, envelope, string(envelope), false},
+		{"invalid msgpack", encodingMsgpack, websocket.BinaryMessage, []byte{0xc1}, "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeFrame(tc.encoding, tc.messageType, tc.data)
+			if (err != nil) != tc.wantErr || string(got) != tc.want {
+				t.Errorf("decodeFrame() = %q, %v, want %q, error %v", got, err, tc.want, tc.wantErr)
+			}
+		})
+	}
+
+	// Anything that is not a JSON envelope is passed through as text
+	if messageType, payload, _ := encodeFrame(encodingMsgpack, []byte("plain")); messageType != websocket.TextMessage || string(payload) != "plain" {
+		t.Errorf("encodeFrame(plain) = %d, %q, want the text untouched", messageType, payload)
+	}
+}
+
+// recordingConn keeps a copy of everything read from a connection
+type recordingConn struct {
+	net.Conn
+	mu   sync.Mutex
+	read bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.read.Write(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// rawFrame is a frame as it went over the wire
+type rawFrame struct {
+	compressed bool
+	opcode     byte
+	payload    []byte // inflated when compressed
+}
+
+// frames parses the server frames read so far, after the handshake response
+func (c *recordingConn) frames(t *testing.T) []rawFrame {
+	t.Helper()
+
+	c.mu.Lock()
+	data := append([]byte{}, c.read.Bytes()...)
+	c.mu.Unlock()
+
+	_, data, _ = bytes.Cut(data, []byte("\r\n\r\n"))
+	var frames []rawFrame
+	for len(data) >= 2 {
+		frame := rawFrame{compressed: data[0]&0x40 != 0, opcode: data[0] & 0x0f}
+		size, header := uint64(data[1]&0x7f), 2
+		switch size {
+		case 126:
+			size, header = uint64(binary.BigEndian.Uint16(data[2:])), 4
+		case 127:
+			size, header = binary.BigEndian.Uint64(data[2:]), 10
+		}
+		if uint64(len(data)-header) < size {
+			break
+		}
+		frame.payload, data = data[header:header+int(size)], data[header+int(size):]
+
+		if frame.compressed {
+			tail := []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+			inflated, err := io.ReadAll(flate.NewReader(io.MultiReader(bytes.NewReader(frame.payload), bytes.NewReader(tail))))
+			if err != nil {
+				t.Fatalf("inflating a frame: %v", err)
+			}
+			frame.payload = inflated
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// dialEncoding connects to a room asking for the given subprotocols
+func dialEncoding(t *testing.T, srv *httptest.Server, roomID, token string, subprotocols ...string) (*websocket.Conn, *recordingConn) {
+	t.Helper()
+
+	var recorder *recordingConn
+	dialer := websocket.Dialer{
+		Subprotocols:      subprotocols,
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			recorder = &recordingConn{Conn: conn}
+			return recorder, nil
+		},
+	}
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?roomId=" + url.QueryEscape(roomID) + "&token=" + url.QueryEscape(token)
+	conn, _, err := dialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("dialing with %v: %v", subprotocols, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, recorder
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	useTestRedis(t)
+	room := testRoom(t, "alice")
+	token := testSession(t, "alice")
+
+	srv := httptest.NewServer(http.HandlerFunc(serveWs))
+	defer srv.Close()
+
+	cases := []struct {
+		name         string
+		subprotocols []string
+		want         string
+		wantType     int
+	}{
+		{"none", nil, "", websocket.TextMessage},
+		{"json", []string{encodingJSON}, encodingJSON, websocket.TextMessage},
+		{"msgpack", []string{encodingMsgpack}, encodingMsgpack, websocket.BinaryMessage},
+		{"unknown", []string{"chat.xml"}, "", websocket.TextMessage},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, _ := dialEncoding(t, srv, room.ID, token, tc.subprotocols...)
+			if got := conn.Subprotocol(); got != tc.want {
+				t.Errorf("negotiated %q, want %q", got, tc.want)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			messageType, _, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("reading the join notice: %v", err)
+			}
+			if messageType != tc.wantType {
+				t.Errorf("frame type %d, want %d", messageType, tc.wantType)
+			}
+		})
+	}
+}
+
+func TestMsgpackCompressionRoundTrip(t *testing.T) {
+	if !compressionEnabled {
+		t.Skip("WS_COMPRESSION is disabled")
+	}
+	useTestRedis(t)
+	room := testRoom(t, "alice")
+
+	srv := httptest.NewServer(http.HandlerFunc(serveWs))
+	defer srv.Close()
+
+	conn, recorder := dialEncoding(t, srv, room.ID, testSession(t, "alice"), encodingMsgpack)
+
+	short := "short message"
+	long := strings.TrimSpace(strings.Repeat("a long message compresses well ", 1+compressionThreshold/30))
+	for _, content := range []string{short, long} {
+		frame, _ := msgpack.Marshal(map[string]interface{}{"type": frameChat, "content": content})
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			t.Fatalf("sending: %v", err)
+		}
+	}
+
+	// Both messages come back decoded from msgpack, compression is invisible
+	// to the client
+	var received []string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(received) < 2 {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		var msg map[string]interface{}
+		if messageType != websocket.BinaryMessage || msgpack.Unmarshal(data, &msg) != nil {
+			t.Fatalf("got a frame of type %d that is not msgpack", messageType)
+		}
+		if msg["type"] == frameChat {
+			received = append(received, msg["content"].(string))
+		}
+	}
+	if received[0] != short || received[1] != long {
+		t.Errorf("received %q, want the short then the long message", received)
+	}
+
+	// Only the frame over the threshold was deflated on the wire
+	compressed := map[string]bool{}
+	for _, frame := range recorder.frames(t) {
+		var msg map[string]interface{}
+		if frame.opcode == websocket.BinaryMessage && msgpack.Unmarshal(frame.payload, &msg) == nil && msg["type"] == frameChat {
+			compressed[msg["content"].(string)] = frame.compressed
+		}
+	}
+	if got, ok := compressed[short]; !ok || got {
+		t.Errorf("short frame seen %v, compressed %v, want sent uncompressed", ok, got)
+	}
+	if got, ok := compressed[long]; !ok || !got {
+		t.Errorf("long frame seen %v, compressed %v, want sent compressed", ok, got)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// frameCommandResult is the private reply to a slash command
+const frameCommandResult = "commandResult"
+
+// maxPendingInvites is the number of room invites kept per user
+const maxPendingInvites = 50
+
+// inviteRateLimit bounds how many invites one user can send, so /invite
+// cannot be used to flood someone with notices
+var inviteRateLimit = loadRatePolicy("invite", 20, time.Hour)
+
+// Command is a slash command run from a chat message starting with "/"
+type Command struct {
+	Name        string
+	Usage       string // argument synopsis shown by /help, e.g. "<user> [reason]"
+	Description string
+	MinRole     string // lowest room role that may run the command
+	MinArgs     int
+	// Anonymous commands can also be run by connections without a session
+	Anonymous bool
+	Run       func(cmd *CommandContext) error
+}
+
+// CommandContext is passed to a command's Run function
+type CommandContext struct {
+	Hub     *Hub
+	Client  *Client
+	Room    *Chatroom
+	Role    string
+	Args    []string
+	RawArgs string // everything after the command name, untouched
+	Message map[string]interface{}
+}
+
+// commandError is an error whose message is meant for the invoker
+type commandError struct {
+	text string
+}
+
+func (e *commandError) Error() string {
+	return e.text
+}
+
+func commandErrorf(format string, args ...interface{}) error {
+	return &commandError{text: fmt.Sprintf(format, args...)}
+}
+
+// Invite is a pending invitation of a user to a room
+type Invite struct {
+	RoomID    string    `json:"roomId"`
+	RoomName  string    `json:"roomName"`
+	From      string    `json:"from"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// userNotice is a frame for every connection of a user in a hub
+type userNotice struct {
+	username string
+	message  []byte
+}
+
+var commands = map[string]*Command{}
+
+// registerCommand makes a slash command available in every room. Commands
+// registered later replace earlier ones of the same name.
+func registerCommand(cmd *Command) {
+	if cmd.MinRole == "" {
+		cmd.MinRole = roleMember
+	}
+	commands[strings.ToLower(cmd.Name)] = cmd
+}
+
+func init() {
+	registerCommand(&Command{Name: "help", Usage: "[command]", Description: "List commands or show how to use one", Anonymous: true, Run: helpCommand})
+	registerCommand(&Command{Name: "me", Usage: "<action>", Description: "Describe what you are doing", MinArgs: 1, Run: meCommand})
+	registerCommand(&Command{Name: "topic", Usage: "[new topic]", Description: "Show the room topic, or change it as a moderator", Anonymous: true, Run: topicCommand})
+	registerCommand(&Command{Name: "kick", Usage: "<user> [reason]", Description: "Remove a user from the room", MinRole: roleModerator, MinArgs: 1, Run: kickCommand})
+	registerCommand(&Command{Name: "invite", Usage: "<user>", Description: "Invite a user to this room", MinArgs: 1, Run: inviteCommand})
+}
+
+// isCommand reports whether a chat message is a slash command. A leading "//"
+// escapes the slash so messages can still start with one, it is unescaped here.
+func isCommand(msg map[string]interface{}) bool {
+	content, _ := msg["content"].(string)
+	if strings.HasPrefix(content, "//") {
+		msg["content"] = content[1:]
+		return false
+	}
+	return strings.HasPrefix(content, "/")
+}
+
+// parseCommandArgs splits arguments on whitespace, keeping "quoted strings" together
+func parseCommandArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inQuotes, hasArg := false, false
+
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case !inQuotes && (r == ' ' || r == '\t' || r == '\n'):
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		default:
+			current.WriteRune(r)
+			hasArg = true
+		}
+	}
+	if inQuotes {
+		return nil, commandErrorf("Unterminated quote in arguments")
+	}
+	if hasArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// runCommand parses and dispatches a slash command. Replies and errors are
+// sent privately to the invoker.
+func runCommand(hub *Hub, client *Client, msg map[string]interface{}) {
+	content, _ := msg["content"].(string)
+	name, rawArgs, _ := strings.Cut(strings.TrimPrefix(content, "/"), " ")
+	name = strings.ToLower(strings.TrimSpace(name))
+	rawArgs = strings.TrimSpace(rawArgs)
+
+	cmd, ok := commands[name]
+	if !ok {
+		replyError(hub, client, "unknown_command", fmt.Sprintf("Unknown command /%s, try /help", name))
+		return
+	}
+
+	if client.username == "" && !cmd.Anonymous {
+		replyError(hub, client, errCodeAuthRequired, fmt.Sprintf("Log in to use /%s", cmd.Name))
+		return
+	}
+
+	room, err := getChatroom(hub.roomID)
+	if err != nil {
+		replyError(hub, client, errCodeRoomNotFound, "Chatroom not found")
+		return
+	}
+
+	role := roomRole(room, client.username)
+	if roleRank(role) < roleRank(cmd.MinRole) {
+		replyError(hub, client, errCodeForbidden, fmt.Sprintf("/%s requires the %s role", cmd.Name, cmd.MinRole))
+		return
+	}
+
+	args, err := parseCommandArgs(rawArgs)
+	if err == nil && len(args) < cmd.MinArgs {
+		err = commandErrorf("Usage: /%s %s", cmd.Name, cmd.Usage)
+	}
+	if err == nil {
+		err = cmd.Run(&CommandContext{
+			Hub:     hub,
+			Client:  client,
+			Room:    room,
+			Role:    role,
+			Args:    args,
+			RawArgs: rawArgs,
+			Message: msg,
+		})
+	}
+
+	if err != nil {
+		var userErr *commandError
+		var rejection *messageRejection
+		switch {
+		case errors.As(err, &userErr):
+			replyError(hub, client, "command_failed", userErr.text)
+		case errors.As(err, &rejection):
+			replyError(hub, client, rejection.Code, rejection.Message)
+		default:
+			fmt.Printf("Error running /%s: %v\n", cmd.Name, err)
+			replyError(hub, client, errCodeInternal, fmt.Sprintf("/%s failed, please try again", cmd.Name))
+		}
+	}
+}
+
+func replyError(hub *Hub, client *Client, code, text string) {
+	hubSend(hub, hub.direct, directMessage{conn: client.conn, message: errorFrame(code, text)})
+}
+
+// Reply sends a private response to the user who ran the command
+func (c *CommandContext) Reply(text string) {
+	frame, _ := json.Marshal(map[string]interface{}{
+		"type":      frameCommandResult,
+		"content":   text,
+		"sender":    "system",
+		"timestamp": time.Now(),
+	})
+	hubSend(c.Hub, c.Hub.direct, directMessage{conn: c.Client.conn, message: frame})
+}
+
+func helpCommand(c *CommandContext) error {
+	if len(c.Args) > 0 {
+		cmd, ok := commands[strings.ToLower(strings.TrimPrefix(c.Args[0], "/"))]
+		if !ok {
+			return commandErrorf("Unknown command /%s", c.Args[0])
+		}
+		c.Reply(fmt.Sprintf("/%s %s - %s", cmd.Name, cmd.Usage, cmd.Description))
+		return nil
+	}
+
+	var lines []string
+	for _, cmd := range commands {
+		if roleRank(c.Role) < roleRank(cmd.MinRole) || (c.Client.username == "" && !cmd.Anonymous) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("/%s %s - %s", cmd.Name, cmd.Usage, cmd.Description))
+	}
+	sort.Strings(lines)
+	c.Reply("Available commands:\n" + strings.Join(lines, "\n"))
+	return nil
+}
+
+// meCommand posts an action message, it goes through the same validation
+// and filters as any other chat message
+func meCommand(c *CommandContext) error {
+	c.Message["content"] = c.RawArgs
+	c.Message["action"] = true
+	_, err := submitChatMessage(c.Room.ID, c.Client.username, c.Message)
+	return err
+}
+
+func topicCommand(c *CommandContext) error {
+	if c.RawArgs == "" {
+		if c.Room.Topic == "" {
+			c.Reply("No topic is set")
+		} else {
+			c.Reply("Topic: " + c.Room.Topic)
+		}
+		return nil
+	}
+
+	if roleRank(c.Role) < roleRank(roleModerator) {
+		return commandErrorf("Only moderators can change the topic")
+	}
+
+	topic := normalizeText(c.RawArgs, false)
+	if utf8.RuneCountInString(topic) > rules.roomDescMax {
+		return commandErrorf("Topic must be at most %d characters", rules.roomDescMax)
+	}
+
+	return setRoomTopic(c.Room, topic, c.Client.username)
+}
+
+// setRoomTopic stores a room's new topic and announces it to the room. room
+// is refreshed with the stored chatroom.
+func setRoomTopic(room *Chatroom, topic, by string) error {
+	updated, err := updateChatroom(room.ID, func(stored *Chatroom) { stored.Topic = topic })
+	if err != nil {
+		return err
+	}
+	*room = *updated
+
+	if hub := lookupHub(room.ID); hub != nil {
+		frame, _ := json.Marshal(map[string]interface{}{
+			"type":      "topicChanged",
+			"content":   fmt.Sprintf("%s changed the topic to: %s", by, topic),
+			"topic":     topic,
+			"sender":    "system",
+			"changedBy": by,
+			"timestamp": time.Now(),
+		})
+		hubSend(hub, hub.broadcast, frame)
+	}
+	emitRoomUpdated(room)
+	return nil
+}
+
+func kickCommand(c *CommandContext) error {
+	target := c.Args[0]
+	if roleRank(roomRole(c.Room, target)) >= roleRank(c.Role) {
+		return commandErrorf("Cannot moderate a user with an equal or higher role")
+	}
+
+	reason := strings.Join(c.Args[1:], " ")
+	kickUser(c.Room.ID, target, reason)
+	logModeration(c.Room.ID, ModerationEntry{
+		Action:    actionKick,
+		Username:  target,
+		By:        c.Client.username,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+
+	c.Reply(fmt.Sprintf("Kicked %s", target))
+	return nil
+}
+
+// inviteCommand records an invite and shows it to the user right away in
+// any room they are connected to
+func inviteCommand(c *CommandContext) error {
+	target := c.Args[0]
+	isUser, err := rdb.SIsMember(ctx, "users", target).Result()
+	if err != nil {
+		return err
+	}
+	if !isUser {
+		return commandErrorf("No user named %s", target)
+	}
+	if isBanned(c.Room.ID, target) {
+		return commandErrorf("%s is banned from this room", target)
+	}
+	if ok, retryAfter := allow(inviteRateLimit, c.Client.username); !ok {
+		return commandErrorf("You are sending invites too quickly, try again in %s", retryAfter.Round(time.Second))
+	}
+
+	invite := Invite{RoomID: c.Room.ID, RoomName: c.Room.Name, From: c.Client.username, CreatedAt: time.Now()}
+	inviteJSON, err := json.Marshal(invite)
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.LPush(ctx, userInvitesKey(target), inviteJSON)
+	pipe.LTrim(ctx, userInvitesKey(target), 0, maxPendingInvites-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	frame, _ := json.Marshal(map[string]interface{}{
+		"type":      "invite",
+		"content":   fmt.Sprintf("%s invited you to %s", c.Client.username, c.Room.Name),
+		"invite":    invite,
+		"sender":    "system",
+		"timestamp": time.Now(),
+	})
+	for _, hub := range runningHubs() {
+		hubSend(hub, hub.notify, userNotice{username: target, message: frame})
+	}
+
+	c.Reply(fmt.Sprintf("Invited %s", target))
+	return nil
+}
+
+func userInvitesKey(username string) string {
+	return "user:" + username + ":invites"
+}
+
+// sendToUser writes a frame to every connection of a user in the hub
+func (h *Hub) sendToUser(notice userNotice) {
+	frames := newFrameCache(notice.message)
+	for _, client := range h.clients {
+		if client.username == notice.username {
+			h.writeTo(client, frames)
+		}
+	}
+	for sub := range h.subscribers {
+		if sub.username == notice.username {
+			h.deliver(sub, notice.message)
+		}
+	}
+}
+
+// invitesHandler returns the caller's pending room invites, newest first
+func invitesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	stored, err := rdb.LRange(ctx, userInvitesKey(username), 0, -1).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching invites")
+		return
+	}
+
+	invites := []Invite{}
+	for _, inviteJSON := range stored {
+		var invite Invite
+		if err := json.Unmarshal([]byte(inviteJSON), &invite); err == nil {
+			invites = append(invites, invite)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCommandArgs(t *testing.T) {
+	cases := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"single", "bob", []string{"bob"}, false},
+		{"whitespace", "  bob \t spam\n", []string{"bob", "spam"}, false},
+		{"quoted", `bob "being rude"`, []string{"bob", "being rude"}, false},
+		{"quotes inside a word", `ab"c d"e`, []string{"abc de"}, false},
+		{"empty quotes", `"" x`, []string{"", "x"}, false},
+		{"unterminated", `bob "rude`, nil, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseCommandArgs(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("args = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	useTestRedis(t)
+	room := testRoom(t, "owner")
+	rdb.SAdd(ctx, "users", "owner", "alice", "bob")
+
+	limit := inviteRateLimit
+	inviteRateLimit = ratePolicy{name: "invite", limit: 1, per: time.Hour}
+	t.Cleanup(func() { inviteRateLimit = limit })
+
+	// The hub is never run, replies are read straight off its direct channel
+	hub := &Hub{roomID: room.ID, direct: make(chan directMessage, 1), done: make(chan struct{})}
+
+	cases := []struct {
+		name     string
+		username string
+		content  string
+		wantType string
+		wantCode string
+	}{
+		{"unknown command", "alice", "/dance", "error", "unknown_command"},
+		{"anonymous", "", "/invite bob", "error", errCodeAuthRequired},
+		{"anonymous help", "", "/help", frameCommandResult, ""},
+		{"role too low", "alice", "/kick bob", "error", errCodeForbidden},
+		{"missing arguments", "alice", "/invite", "error", "command_failed"},
+		{"bad quoting", "alice", `/invite "bob`, "error", "command_failed"},
+		{"unknown user", "alice", "/invite nobody", "error", "command_failed"},
+		{"case insensitive", "alice", "/INVITE bob", frameCommandResult, ""},
+		{"invite rate limited", "alice", "/invite owner", "error", "command_failed"},
+		{"other inviter", "bob", "/invite alice", frameCommandResult, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			runCommand(hub, &Client{username: tc.username}, map[string]interface{}{"content": tc.content})
+
+			var reply map[string]interface{}
+			select {
+			case direct := <-hub.direct:
+				json.Unmarshal(direct.message, &reply)
+			default:
+				t.Fatalf("no reply to %s", tc.content)
+			}
+			if reply["type"] != tc.wantType || (tc.wantCode != "" && reply["code"] != tc.wantCode) {
+				t.Errorf("reply = %v, want a %s frame with code %q", reply, tc.wantType, tc.wantCode)
+			}
+		})
+	}
+
+	if n, _ := rdb.LLen(ctx, userInvitesKey("bob")).Result(); n != 1 {
+		t.Errorf("bob has %d invites, want 1", n)
+	}
+	if n, _ := rdb.LLen(ctx, userInvitesKey("owner")).Result(); n != 0 {
+		t.Errorf("owner has %d invites, want 0 after the rate limit", n)
+	}
+}
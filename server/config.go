@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// envOr returns the value of an environment variable or a default when unset
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt returns an integer environment variable or a default when unset or invalid
+func envInt(key string, def int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Ephemeral frame types are fanned out to the other members of a room but are
+// never stored and never count towards the limits applied to chat messages.
+const (
+	frameTypingStarted = "typingStarted"
+	frameTypingStopped = "typingStopped"
+	frameViewing       = "viewing"
+)
+
+// typingTTL is how long a typing indicator stays active without being refreshed
+const typingTTL = 6 * time.Second
+
+// ephemeralSignal is a transient frame received from a client
+type ephemeralSignal struct {
+	conn    *websocket.Conn
+	kind    string
+	sender  string
+	payload []byte
+}
+
+// typingState tracks an active typing indicator for a connection
+type typingState struct {
+	sender  string
+	expires time.Time
+}
+
+func isEphemeralFrame(msgType string) bool {
+	switch msgType {
+	case frameTypingStarted, frameTypingStopped, frameViewing:
+		return true
+	}
+	return false
+}
+
+// handleEphemeral updates the typing state and relays the signal to the rest of the room
+func (h *Hub) handleEphemeral(sig ephemeralSignal) {
+	switch sig.kind {
+	case frameTypingStarted:
+		_, alreadyTyping := h.typing[sig.conn]
+		h.typing[sig.conn] = typingState{sender: sig.sender, expires: time.Now().Add(typingTTL)}
+		if alreadyTyping {
+			// Clients refresh the indicator while typing, only the expiry moves
+			return
+		}
+
+	case frameTypingStopped:
+		if _, ok := h.typing[sig.conn]; !ok {
+			return
+		}
+		delete(h.typing, sig.conn)
+	}
+
+	h.fanOut(sig.payload, sig.conn)
+}
+
+// expireTyping clears typing indicators that have not been refreshed in time,
+// so a client that crashed mid-sentence does not appear to type forever
+func (h *Hub) expireTyping(now time.Time) {
+	for conn, state := range h.typing {
+		if now.After(state.expires) {
+			h.clearTyping(conn)
+		}
+	}
+}
+
+// clearTyping removes the typing indicator of a connection and tells the room it stopped
+func (h *Hub) clearTyping(conn *websocket.Conn) {
+	state, ok := h.typing[conn]
+	if !ok {
+		return
+	}
+	delete(h.typing, conn)
+
+	msg := map[string]interface{}{
+		"type":      frameTypingStopped,
+		"sender":    state.sender,
+		"timestamp": time.Now(),
+	}
+
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Printf("Error marshalling typing message: %v\n", err)
+		return
+	}
+	h.fanOut(msgJSON, conn)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEphemeralSignals(t *testing.T) {
+	useTestRedis(t)
+	room := testRoom(t, "alice")
+
+	srv := httptest.NewServer(http.HandlerFunc(serveWs))
+	defer srv.Close()
+
+	alice, _, err := dialRoom(t, srv, room.ID, testSession(t, "alice"))
+	if err != nil {
+		t.Fatalf("connecting alice: %v", err)
+	}
+	defer alice.Close()
+	bob, _, err := dialRoom(t, srv, room.ID, testSession(t, "bob"))
+	if err != nil {
+		t.Fatalf("connecting bob: %v", err)
+	}
+	defer bob.Close()
+	// The user list bob gets on joining is sent once both are registered
+	readFrame(t, bob, "userList")
+
+	send := func(frame map[string]interface{}) {
+		t.Helper()
+		if err := alice.WriteJSON(frame); err != nil {
+			t.Fatalf("sending %v: %v", frame["type"], err)
+		}
+	}
+
+	send(map[string]interface{}{"type": frameViewing, "messageId": 1})
+	if got := readFrame(t, bob, frameViewing); got["sender"] != "alice" {
+		t.Errorf("viewing frame sender = %v, want alice", got["sender"])
+	}
+
+	// More signals than the chat message limit allows leave it untouched
+	for i := 0; i < 2*wsMessageRateLimit.limit; i++ {
+		if i%2 == 0 {
+			send(map[string]interface{}{"type": frameTypingStarted})
+		} else {
+			send(map[string]interface{}{"type": frameTypingStopped})
+		}
+	}
+	send(map[string]interface{}{"type": frameChat, "content": "hello"})
+	if got := readFrame(t, bob, frameChat); got["content"] != "hello" {
+		t.Errorf("chat content = %v, want hello", got["content"])
+	}
+
+	stored, err := rdb.LRange(ctx, roomMessagesKey(room.ID), 0, -1).Result()
+	if err != nil {
+		t.Fatalf("reading history: %v", err)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("history holds %d messages, want only the chat message", len(stored))
+	}
+	var msg map[string]interface{}
+	json.Unmarshal([]byte(stored[0]), &msg)
+	if msg["type"] != frameChat {
+		t.Errorf("stored a %v frame, want %s", msg["type"], frameChat)
+	}
+
+	// A client that disconnects mid-sentence stops typing for everyone
+	send(map[string]interface{}{"type": frameTypingStarted})
+	readFrame(t, bob, frameTypingStarted)
+	alice.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	alice.Close()
+	if got := readFrame(t, bob, frameTypingStopped); got["sender"] != "alice" {
+		t.Errorf("typingStopped sender = %v, want alice", got["sender"])
+	}
+}
+
+func TestTypingExpires(t *testing.T) {
+	h := newHub("room")
+	sub := &subscriber{frames: make(chan []byte, 8)}
+	h.subscribers[sub] = true
+
+	frameType := func() interface{} {
+		t.Helper()
+		select {
+		case message := <-sub.frames:
+			var frame map[string]interface{}
+			json.Unmarshal(message, &frame)
+			return frame["type"]
+		default:
+			return nil
+		}
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"type": frameTypingStarted, "sender": "alice"})
+	started := time.Now()
+	h.handleEphemeral(ephemeralSignal{kind: frameTypingStarted, sender: "alice", payload: payload})
+	if got := frameType(); got != frameTypingStarted {
+		t.Fatalf("relayed %v, want %s", got, frameTypingStarted)
+	}
+
+	// Refreshes only move the expiry
+	h.handleEphemeral(ephemeralSignal{kind: frameTypingStarted, sender: "alice", payload: payload})
+	if got := frameType(); got != nil {
+		t.Errorf("refresh relayed %v, want nothing", got)
+	}
+
+	h.expireTyping(started.Add(typingTTL / 2))
+	if got := frameType(); got != nil || len(h.typing) != 1 {
+		t.Errorf("before the TTL: relayed %v with %d typing, want nothing and 1", got, len(h.typing))
+	}
+
+	h.expireTyping(time.Now().Add(typingTTL + time.Second))
+	if got := frameType(); got != frameTypingStopped || len(h.typing) != 0 {
+		t.Errorf("after the TTL: relayed %v with %d typing, want %s and 0", got, len(h.typing), frameTypingStopped)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Stable, machine readable error codes returned in the "code" field of every
+// error response. Clients should branch on these, never on the message text.
+const (
+	errCodeInvalidRequest       = "invalid_request"
+	errCodeValidationFailed     = "validation_failed"
+	errCodeMethodNotAllowed     = "method_not_allowed"
+	errCodeAuthRequired         = "auth_required"
+	errCodeInvalidToken         = "invalid_token"
+	errCodeInvalidCredentials   = "invalid_credentials"
+	errCodeAccountLocked        = "account_locked"
+	errCodeAccountDisabled      = "account_disabled"
+	errCodeForbidden            = "forbidden"
+	errCodeBanned               = "banned"
+	errCodeMuted                = "muted"
+	errCodeMessageRejected      = "rejected"
+	errCodeMessageQuarantined   = "quarantined"
+	errCodeNotFound             = "not_found"
+	errCodeRoomNotFound         = "room_not_found"
+	errCodeRoomArchived         = "room_archived"
+	errCodeAttachmentNotFound   = "attachment_not_found"
+	errCodeUsernameTaken        = "username_taken"
+	errCodeConflict             = "conflict"
+	errCodePayloadTooLarge      = "payload_too_large"
+	errCodeUnsupportedMediaType = "unsupported_media_type"
+	errCodeRateLimited          = "rate_limited"
+	errCodeIdentityProvider     = "identity_provider_error"
+	errCodeUpgradeFailed        = "upgrade_failed"
+	errCodeInternal             = "internal_error"
+)
+
+// ErrorResponse is the body of every error returned by the HTTP API
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId"`
+}
+
+// writeError answers a request with the JSON error envelope
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+// writeErrorDetails answers a request with the JSON error envelope and extra details
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: w.Header().Get("X-Request-ID"),
+	})
+}
+
+// requestIDMiddleware tags every request with an ID, reusing the caller's
+// X-Request-ID when present, and echoes it back in the response headers
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		next.ServeHTTP(w, r)
+	})
+}
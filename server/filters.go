@@ -0,0 +1,636 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// filterVerdict is the outcome of running a message through a filter
+type filterVerdict int
+
+const (
+	verdictAllow filterVerdict = iota
+	verdictReject
+	verdictQuarantine
+)
+
+// Actions a filter takes when it matches. Not every filter supports masking.
+const (
+	filterActionMask       = "mask"
+	filterActionReject     = "reject"
+	filterActionQuarantine = "quarantine"
+)
+
+// filterMessage is the message a filter inspects. Filters that modify the
+// message (masking) rewrite content in place.
+type filterMessage struct {
+	roomID  string
+	sender  string
+	content string
+}
+
+// MessageFilter inspects a chat message. It returns verdictAllow to pass the
+// (possibly modified) message on, or a reject/quarantine verdict with a reason.
+// A room's chain is built once and shared, so Apply must be safe for
+// concurrent use.
+type MessageFilter interface {
+	Apply(msg *filterMessage) (filterVerdict, string)
+}
+
+// FilterSpec configures one filter of a room's chain. Which fields apply
+// depends on Type.
+type FilterSpec struct {
+	Type          string   `json:"type"`
+	Action        string   `json:"action,omitempty"`
+	Words         []string `json:"words,omitempty"`
+	AllowDomains  []string `json:"allowDomains,omitempty"`
+	DenyDomains   []string `json:"denyDomains,omitempty"`
+	WindowSeconds int      `json:"windowSeconds,omitempty"`
+	MaxMessages   int      `json:"maxMessages,omitempty"`
+	MaxMentions   int      `json:"maxMentions,omitempty"`
+}
+
+// filterTypes maps FilterSpec.Type to a constructor. Use registerFilterType
+// to add custom filters.
+var filterTypes = map[string]func(FilterSpec) (MessageFilter, error){
+	"wordlist":  newWordListFilter,
+	"links":     newLinkFilter,
+	"duplicate": newDuplicateFilter,
+	"flood":     newFloodFilter,
+	"mentions":  newMentionFilter,
+}
+
+// registerFilterType makes a custom filter available to room filter chains
+func registerFilterType(name string, build func(FilterSpec) (MessageFilter, error)) {
+	filterTypes[name] = build
+}
+
+// defaultFilterSpecs is the chain used by rooms without their own configuration
+var defaultFilterSpecs = []FilterSpec{
+	{Type: "duplicate"},
+	{Type: "flood"},
+}
+
+func roomFiltersKey(roomID string) string {
+	return "chatroom:" + roomID + ":filters"
+}
+
+// filterAction validates a spec's action, falling back to def when unset
+func filterAction(spec FilterSpec, def string, allowMask bool) (string, error) {
+	switch spec.Action {
+	case "":
+		return def, nil
+	case filterActionReject, filterActionQuarantine:
+		return spec.Action, nil
+	case filterActionMask:
+		if allowMask {
+			return spec.Action, nil
+		}
+	}
+	return "", fmt.Errorf("%s filter does not support action %q", spec.Type, spec.Action)
+}
+
+// verdictFor turns a non-masking action into a verdict
+func verdictFor(action, reason string) (filterVerdict, string) {
+	if action == filterActionQuarantine {
+		return verdictQuarantine, reason
+	}
+	return verdictReject, reason
+}
+
+// wordListFilter matches whole words case-insensitively
+type wordListFilter struct {
+	pattern *regexp.Regexp
+	action  string
+}
+
+func newWordListFilter(spec FilterSpec) (MessageFilter, error) {
+	action, err := filterAction(spec, filterActionMask, true)
+	if err != nil {
+		return nil, err
+	}
+
+	words := make([]string, 0, len(spec.Words))
+	for _, word := range spec.Words {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("wordlist filter needs at least one word")
+	}
+
+	pattern, err := regexp.Compile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	if err != nil {
+		return nil, err
+	}
+	return &wordListFilter{pattern: pattern, action: action}, nil
+}
+
+func (f *wordListFilter) Apply(msg *filterMessage) (filterVerdict, string) {
+	if !f.pattern.MatchString(msg.content) {
+		return verdictAllow, ""
+	}
+	if f.action != filterActionMask {
+		return verdictFor(f.action, "Message contains a blocked word")
+	}
+
+	msg.content = f.pattern.ReplaceAllStringFunc(msg.content, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+	return verdictAllow, ""
+}
+
+// linkFilter checks the domains of links against allow and deny lists. With
+// an allow list only the listed domains (and their subdomains) may be linked.
+type linkFilter struct {
+	allow  []string
+	deny   []string
+	action string
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+func newLinkFilter(spec FilterSpec) (MessageFilter, error) {
+	action, err := filterAction(spec, filterActionReject, true)
+	if err != nil {
+		return nil, err
+	}
+	return &linkFilter{allow: lowerAll(spec.AllowDomains), deny: lowerAll(spec.DenyDomains), action: action}, nil
+}
+
+func (f *linkFilter) blocked(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return true
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if matchesDomain(f.deny, host) {
+		return true
+	}
+	return len(f.allow) > 0 && !matchesDomain(f.allow, host)
+}
+
+func (f *linkFilter) Apply(msg *filterMessage) (filterVerdict, string) {
+	hit := false
+	masked := linkPattern.ReplaceAllStringFunc(msg.content, func(link string) string {
+		if !f.blocked(link) {
+			return link
+		}
+		hit = true
+		return "[link removed]"
+	})
+	if !hit {
+		return verdictAllow, ""
+	}
+	if f.action != filterActionMask {
+		return verdictFor(f.action, "Message links to a domain that is not allowed")
+	}
+
+	msg.content = masked
+	return verdictAllow, ""
+}
+
+func matchesDomain(domains []string, host string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			lowered = append(lowered, v)
+		}
+	}
+	return lowered
+}
+
+// duplicateFilter catches a sender repeating their previous message
+type duplicateFilter struct {
+	window time.Duration
+	action string
+}
+
+func newDuplicateFilter(spec FilterSpec) (MessageFilter, error) {
+	action, err := filterAction(spec, filterActionReject, false)
+	if err != nil {
+		return nil, err
+	}
+	window := 30 * time.Second
+	if spec.WindowSeconds > 0 {
+		window = time.Duration(spec.WindowSeconds) * time.Second
+	}
+	return &duplicateFilter{window: window, action: action}, nil
+}
+
+func (f *duplicateFilter) Apply(msg *filterMessage) (filterVerdict, string) {
+	if msg.content == "" {
+		return verdictAllow, ""
+	}
+
+	sum := sha256.Sum256([]byte(strings.ToLower(msg.content)))
+	hash := hex.EncodeToString(sum[:])
+
+	key := "filter:duplicate:" + msg.roomID + ":" + msg.sender
+	previous, err := rdb.SetArgs(ctx, key, hash, redis.SetArgs{Get: true, TTL: f.window}).Result()
+	if err != nil && err != redis.Nil {
+		fmt.Printf("Error checking duplicate message: %v\n", err)
+		return verdictAllow, ""
+	}
+	if previous != hash {
+		return verdictAllow, ""
+	}
+	return verdictFor(f.action, "Duplicate message")
+}
+
+// floodFilter limits how many messages a sender posts to a room within a
+// window, across all of their connections
+type floodFilter struct {
+	window time.Duration
+	max    int64
+	action string
+}
+
+func newFloodFilter(spec FilterSpec) (MessageFilter, error) {
+	action, err := filterAction(spec, filterActionReject, false)
+	if err != nil {
+		return nil, err
+	}
+	f := &floodFilter{window: 10 * time.Second, max: 15, action: action}
+	if spec.WindowSeconds > 0 {
+		f.window = time.Duration(spec.WindowSeconds) * time.Second
+	}
+	if spec.MaxMessages > 0 {
+		f.max = int64(spec.MaxMessages)
+	}
+	return f, nil
+}
+
+func (f *floodFilter) Apply(msg *filterMessage) (filterVerdict, string) {
+	key := "filter:flood:" + msg.roomID + ":" + msg.sender
+
+	// The window starts with the first message. Creating the counter with
+	// its expiry in the same transaction means it can never outlive it.
+	pipe := rdb.TxPipeline()
+	pipe.SetNX(ctx, key, 0, f.window)
+	count := pipe.Incr(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		fmt.Printf("Error checking message flood: %v\n", err)
+		return verdictAllow, ""
+	}
+
+	if count.Val() <= f.max {
+		return verdictAllow, ""
+	}
+	return verdictFor(f.action, "You are sending messages too quickly")
+}
+
+// mentionFilter limits the number of @mentions in a single message
+type mentionFilter struct {
+	max    int
+	action string
+}
+
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@[A-Za-z0-9][A-Za-z0-9.-]*`)
+
+func newMentionFilter(spec FilterSpec) (MessageFilter, error) {
+	action, err := filterAction(spec, filterActionReject, false)
+	if err != nil {
+		return nil, err
+	}
+	limit := 5
+	if spec.MaxMentions > 0 {
+		limit = spec.MaxMentions
+	}
+	return &mentionFilter{max: limit, action: action}, nil
+}
+
+func (f *mentionFilter) Apply(msg *filterMessage) (filterVerdict, string) {
+	if len(mentionPattern.FindAllString(msg.content, -1)) <= f.max {
+		return verdictAllow, ""
+	}
+	return verdictFor(f.action, fmt.Sprintf("Messages may mention at most %d users", f.max))
+}
+
+// buildFilterChain constructs the filters described by specs, in order
+func buildFilterChain(specs []FilterSpec) ([]MessageFilter, error) {
+	chain := make([]MessageFilter, 0, len(specs))
+	for i, spec := range specs {
+		build, ok := filterTypes[spec.Type]
+		if !ok {
+			return nil, fmt.Errorf("filter %d: unknown type %q", i, spec.Type)
+		}
+		filter, err := build(spec)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i, err)
+		}
+		chain = append(chain, filter)
+	}
+	return chain, nil
+}
+
+// roomFilterSpecs returns the filter configuration of a room
+func roomFilterSpecs(roomID string) []FilterSpec {
+	specsJSON, err := rdb.Get(ctx, roomFiltersKey(roomID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			fmt.Printf("Error loading room filters: %v\n", err)
+		}
+		return defaultFilterSpecs
+	}
+
+	var specs []FilterSpec
+	if err := json.Unmarshal([]byte(specsJSON), &specs); err != nil {
+		fmt.Printf("Error unmarshalling room filters: %v\n", err)
+		return defaultFilterSpecs
+	}
+	return specs
+}
+
+// filterChainTTL bounds how long a compiled chain is reused, so changes
+// made through another server process are picked up
+const filterChainTTL = 30 * time.Second
+
+// compiledFilterChain is a room's filter chain together with its specs
+type compiledFilterChain struct {
+	specs   []FilterSpec
+	filters []MessageFilter
+	expires time.Time
+}
+
+var filterChains = make(map[string]*compiledFilterChain)
+var filterChainsMutex = &sync.Mutex{}
+
+// roomFilterChain returns the compiled filter chain of a room, building it
+// on first use and again once it expired
+func roomFilterChain(roomID string) (*compiledFilterChain, error) {
+	filterChainsMutex.Lock()
+	chain, ok := filterChains[roomID]
+	filterChainsMutex.Unlock()
+	if ok && time.Now().Before(chain.expires) {
+		return chain, nil
+	}
+
+	specs := roomFilterSpecs(roomID)
+	filters, err := buildFilterChain(specs)
+	if err != nil {
+		return nil, err
+	}
+	chain = &compiledFilterChain{specs: specs, filters: filters, expires: time.Now().Add(filterChainTTL)}
+
+	filterChainsMutex.Lock()
+	filterChains[roomID] = chain
+	filterChainsMutex.Unlock()
+	return chain, nil
+}
+
+// invalidateFilterChain drops the compiled chain of a room after its
+// configuration changed
+func invalidateFilterChain(roomID string) {
+	filterChainsMutex.Lock()
+	delete(filterChains, roomID)
+	filterChainsMutex.Unlock()
+}
+
+// filterResult is the outcome of running a message through a room's chain
+type filterResult struct {
+	verdict filterVerdict
+	reason  string
+	filter  string
+	content string
+}
+
+// runFilters runs content through a room's filter chain. The chain stops at
+// the first filter that rejects or quarantines the message.
+func runFilters(roomID, sender, content string) filterResult {
+	chain, err := roomFilterChain(roomID)
+	if err != nil {
+		fmt.Printf("Error building filters for room %s: %v\n", roomID, err)
+		return filterResult{verdict: verdictAllow, content: content}
+	}
+
+	msg := &filterMessage{roomID: roomID, sender: sender, content: content}
+	for i, filter := range chain.filters {
+		verdict, reason := filter.Apply(msg)
+		if verdict != verdictAllow {
+			return filterResult{verdict: verdict, reason: reason, filter: chain.specs[i].Type, content: msg.content}
+		}
+	}
+	return filterResult{verdict: verdictAllow, content: msg.content}
+}
+
+// QuarantinedMessage is a chat message held back by a filter for review
+type QuarantinedMessage struct {
+	ID        string          `json:"id"`
+	RoomID    string          `json:"roomId"`
+	Sender    string          `json:"sender"`
+	Username  string          `json:"username,omitempty"` // the authenticated sender, empty for integrations
+	Filter    string          `json:"filter"`
+	Reason    string          `json:"reason"`
+	Message   json.RawMessage `json:"message"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+func roomQuarantineKey(roomID string) string {
+	return "chatroom:" + roomID + ":quarantine"
+}
+
+// quarantineMessage stores a message for moderators to approve or discard
+func quarantineMessage(roomID, username, sender string, result filterResult, msg map[string]interface{}) error {
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	quarantined := QuarantinedMessage{
+		ID:        uuid.New().String(),
+		RoomID:    roomID,
+		Sender:    sender,
+		Username:  username,
+		Filter:    result.filter,
+		Reason:    result.reason,
+		Message:   message,
+		CreatedAt: time.Now(),
+	}
+
+	quarantinedJSON, err := json.Marshal(quarantined)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, roomQuarantineKey(roomID), quarantined.ID, quarantinedJSON).Err()
+}
+
+// roomFiltersHandler serves GET (current chain) and PUT (replace chain) on
+// /api/chatrooms/filters for room moderators
+func roomFiltersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var req struct {
+		RoomID  string       `json:"roomId"`
+		Filters []FilterSpec `json:"filters"`
+	}
+
+	if r.Method == http.MethodGet {
+		req.RoomID = r.URL.Query().Get("roomId")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	room, username := moderatorRoom(w, r, req.RoomID)
+	if room == nil {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		if req.Filters == nil {
+			req.Filters = []FilterSpec{}
+		}
+		if _, err := buildFilterChain(req.Filters); err != nil {
+			writeErrorDetails(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid filter configuration", err.Error())
+			return
+		}
+
+		specsJSON, err := json.Marshal(req.Filters)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing filters")
+			return
+		}
+		invalidateFilterChain(room.ID)
+		if err := rdb.Set(ctx, roomFiltersKey(room.ID), specsJSON, 0).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing filters")
+			return
+		}
+
+		logModeration(room.ID, ModerationEntry{Action: "updateFilters", By: username, Timestamp: time.Now()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roomId":  room.ID,
+		"filters": roomFilterSpecs(room.ID),
+	})
+}
+
+// quarantineHandler serves GET (list held messages) and POST (approve or
+// discard one) on /api/chatrooms/quarantine for room moderators
+func quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var req struct {
+		RoomID string `json:"roomId"`
+		ID     string `json:"id"`
+		Action string `json:"action"` // approve or discard
+	}
+
+	if r.Method == http.MethodGet {
+		req.RoomID = r.URL.Query().Get("roomId")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	room, username := moderatorRoom(w, r, req.RoomID)
+	if room == nil {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		stored, err := rdb.HGetAll(ctx, roomQuarantineKey(room.ID)).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching quarantined messages")
+			return
+		}
+
+		messages := []QuarantinedMessage{}
+		for _, quarantinedJSON := range stored {
+			var quarantined QuarantinedMessage
+			if err := json.Unmarshal([]byte(quarantinedJSON), &quarantined); err != nil {
+				continue // Skip entries that cannot be parsed
+			}
+			messages = append(messages, quarantined)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"messages": messages,
+		})
+		return
+	}
+
+	if req.Action != "approve" && req.Action != "discard" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Action must be approve or discard")
+		return
+	}
+
+	quarantinedJSON, err := rdb.HGet(ctx, roomQuarantineKey(room.ID), req.ID).Result()
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Quarantined message not found")
+		return
+	}
+
+	// Remove first so two moderators cannot both approve the same message
+	removed, err := rdb.HDel(ctx, roomQuarantineKey(room.ID), req.ID).Result()
+	if err != nil || removed == 0 {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Quarantined message not found")
+		return
+	}
+
+	var quarantined QuarantinedMessage
+	if err := json.Unmarshal([]byte(quarantinedJSON), &quarantined); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error reading quarantined message")
+		return
+	}
+
+	if req.Action == "approve" {
+		var msg map[string]interface{}
+		if err := json.Unmarshal(quarantined.Message, &msg); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error reading quarantined message")
+			return
+		}
+		if _, err := publishChatMessage(room.ID, quarantined.Username, msg); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error publishing message")
+			return
+		}
+	}
+
+	logModeration(room.ID, ModerationEntry{
+		Action:    req.Action + "Quarantined",
+		Username:  quarantined.Sender,
+		By:        username,
+		Reason:    quarantined.Reason,
+		Timestamp: time.Now(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildFilterChain(t *testing.T) {
+	cases := []struct {
+		name    string
+		specs   []FilterSpec
+		wantErr string
+	}{
+		{"defaults", defaultFilterSpecs, ""},
+		{"empty", []FilterSpec{}, ""},
+		{"unknown type", []FilterSpec{{Type: "nope"}}, `unknown type "nope"`},
+		{"wordlist without words", []FilterSpec{{Type: "wordlist", Words: []string{" "}}}, "at least one word"},
+		{"mask on duplicate", []FilterSpec{{Type: "duplicate", Action: filterActionMask}}, "does not support action"},
+		{"unknown action", []FilterSpec{{Type: "links", Action: "delete"}}, "does not support action"},
+		{"error names the filter", []FilterSpec{{Type: "flood"}, {Type: "nope"}}, "filter 1:"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := buildFilterChain(tc.specs)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("buildFilterChain() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("buildFilterChain() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilters(t *testing.T) {
+	type post struct {
+		content     string
+		wantVerdict filterVerdict
+		wantContent string
+	}
+
+	cases := []struct {
+		name  string
+		spec  FilterSpec
+		posts []post
+	}{
+		{"wordlist masks whole words", FilterSpec{Type: "wordlist", Words: []string{"darn"}}, []post{
+			{"Darn it", verdictAllow, "**** it"},
+			{"darnedest", verdictAllow, "darnedest"},
+		}},
+		{"wordlist rejects", FilterSpec{Type: "wordlist", Words: []string{"darn"}, Action: filterActionReject}, []post{
+			{"oh darn", verdictReject, "oh darn"},
+		}},
+		{"wordlist quarantines", FilterSpec{Type: "wordlist", Words: []string{"darn"}, Action: filterActionQuarantine}, []post{
+			{"oh darn", verdictQuarantine, "oh darn"},
+		}},
+		{"links deny list", FilterSpec{Type: "links", DenyDomains: []string{"spam.example"}}, []post{
+			{"see https://www.spam.example/x", verdictReject, "see https://www.spam.example/x"},
+			{"see https://ok.example/x", verdictAllow, "see https://ok.example/x"},
+		}},
+		{"links allow list masks", FilterSpec{Type: "links", AllowDomains: []string{"ok.example"}, Action: filterActionMask}, []post{
+			{"a www.other.example b", verdictAllow, "a [link removed] b"},
+			{"a https://docs.ok.example b", verdictAllow, "a https://docs.ok.example b"},
+		}},
+		{"duplicate", FilterSpec{Type: "duplicate"}, []post{
+			{"hello", verdictAllow, "hello"},
+			{"HELLO", verdictReject, "HELLO"},
+			{"something else", verdictAllow, "something else"},
+		}},
+		{"flood", FilterSpec{Type: "flood", MaxMessages: 2}, []post{
+			{"one", verdictAllow, "one"},
+			{"two", verdictAllow, "two"},
+			{"three", verdictReject, "three"},
+		}},
+		{"mentions", FilterSpec{Type: "mentions", MaxMentions: 2}, []post{
+			{"@a @b hi", verdictAllow, "@a @b hi"},
+			{"@a @b @c hi", verdictReject, "@a @b @c hi"},
+			{"mail a@b.example", verdictAllow, "mail a@b.example"},
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestRedis(t)
+
+			chain, err := buildFilterChain([]FilterSpec{tc.spec})
+			if err != nil {
+				t.Fatalf("buildFilterChain: %v", err)
+			}
+
+			for _, p := range tc.posts {
+				msg := &filterMessage{roomID: "room", sender: "alice", content: p.content}
+				verdict, _ := chain[0].Apply(msg)
+				if verdict != p.wantVerdict || msg.content != p.wantContent {
+					t.Errorf("Apply(%q) = %v, %q, want %v, %q", p.content, verdict, msg.content, p.wantVerdict, p.wantContent)
+				}
+			}
+		})
+	}
+}
+
+func TestFloodFilterExpires(t *testing.T) {
+	mr := useTestRedis(t)
+
+	chain, err := buildFilterChain([]FilterSpec{{Type: "flood", WindowSeconds: 5}})
+	if err != nil {
+		t.Fatalf("buildFilterChain: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		chain[0].Apply(&filterMessage{roomID: "room", sender: "alice", content: "hi"})
+	}
+
+	// Later messages must not extend the window
+	if ttl := mr.TTL("filter:flood:room:alice"); ttl <= 0 || ttl > 5*time.Second {
+		t.Errorf("flood counter TTL = %v, want up to 5s", ttl)
+	}
+}
+
+func TestRoomFilterChainCache(t *testing.T) {
+	useTestRedis(t)
+
+	setSpecs := func(specs []FilterSpec) {
+		specsJSON, _ := json.Marshal(specs)
+		if err := rdb.Set(ctx, roomFiltersKey("room"), specsJSON, 0).Err(); err != nil {
+			t.Fatalf("storing filters: %v", err)
+		}
+	}
+	t.Cleanup(func() { invalidateFilterChain("room") })
+
+	setSpecs([]FilterSpec{{Type: "wordlist", Words: []string{"darn"}}})
+	if got := runFilters("room", "alice", "darn").content; got != "****" {
+		t.Fatalf("runFilters() = %q, want masked", got)
+	}
+
+	// The compiled chain is reused until it is invalidated
+	setSpecs([]FilterSpec{})
+	if got := runFilters("room", "alice", "darn").content; got != "****" {
+		t.Errorf("runFilters() = %q, want the cached chain to mask", got)
+	}
+
+	invalidateFilterChain("room")
+	if got := runFilters("room", "alice", "darn").content; got != "darn" {
+		t.Errorf("runFilters() = %q, want the new empty chain", got)
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/neo7337/go-websocket-demo/server/chatpb"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// gRPC API for backend services, see chatpb/chat.proto. It shares hubs,
+// authentication and storage with the HTTP handlers: the Chat stream
+// subscribes to a room's hub like SSE does and posts through
+// submitChatMessage, and the unary calls use the same room helpers.
+
+var (
+	// grpcAddr is where the gRPC API listens. It is off unless set, as it
+	// serves plaintext and should sit behind a TLS terminating proxy.
+	grpcAddr       = envOr("GRPC_ADDR", "")
+	grpcReflection = envOr("GRPC_REFLECTION", "false") == "true"
+)
+
+// grpcScopes maps each method to the scope an API key needs to call it
+var grpcScopes = map[string]string{
+	chatpb.ChatService_ListRooms_FullMethodName:  scopeRead,
+	chatpb.ChatService_GetRoom_FullMethodName:    scopeRead,
+	chatpb.ChatService_GetHistory_FullMethodName: scopeRead,
+	chatpb.ChatService_CreateRoom_FullMethodName: scopeWrite,
+	chatpb.ChatService_UpdateRoom_FullMethodName: scopeWrite,
+	chatpb.ChatService_DeleteRoom_FullMethodName: scopeWrite,
+	chatpb.ChatService_Chat_FullMethodName:       scopeChat,
+}
+
+// serveGRPC starts the gRPC API in the background
+func serveGRPC() error {
+	if grpcAddr == "" {
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		return err
+	}
+
+	srv := newGRPCServer()
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			fmt.Println("Error serving gRPC:", err)
+		}
+	}()
+	return nil
+}
+
+// newGRPCServer builds the gRPC server with its authentication interceptors
+func newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+	)
+	chatpb.RegisterChatServiceServer(srv, &chatService{})
+	if grpcReflection {
+		reflection.Register(srv)
+	}
+	return srv
+}
+
+type grpcUserKey struct{}
+
+// grpcUser returns the authenticated caller of a gRPC request
+func grpcUser(ctx context.Context) string {
+	username, _ := ctx.Value(grpcUserKey{}).(string)
+	return username
+}
+
+// grpcAuthenticate resolves the session token or API key in the
+// authorization metadata. API keys are checked for the method's scope and
+// their rate limit, as apiKeyMiddleware does for HTTP.
+func grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if values := md.Get("authorization"); len(values) > 0 {
+		token = strings.TrimPrefix(values[0], "Bearer ")
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "Authorization required")
+	}
+
+	if isAPIKeyToken(token) {
+		key := lookupAPIKey(token)
+		if key == nil {
+			return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+		}
+		scope := grpcScopes[method]
+		if scope == "" || !key.hasScope(scope) {
+			return nil, status.Errorf(codes.PermissionDenied, "API key is missing the %s scope", scope)
+		}
+		if ok, retryAfter := allow(key.ratePolicy(), key.ID); !ok {
+			return nil, rateLimitStatus(retryAfter)
+		}
+		touchAPIKey(key.ID)
+	}
+
+	username := extractUsernameFromToken(token)
+	if username == "" {
+		return nil, status.Error(codes.Unauthenticated, "Invalid session token")
+	}
+	return context.WithValue(ctx, grpcUserKey{}, username), nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedStream carries the caller in its context
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// rateLimitStatus is the gRPC counterpart of a 429 answer
+func rateLimitStatus(retryAfter time.Duration) error {
+	st, err := status.New(codes.ResourceExhausted, "Too many requests").WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(retryAfter),
+	})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, "Too many requests")
+	}
+	return st.Err()
+}
+
+// validationStatus is the gRPC counterpart of writeValidationErrors
+func validationStatus(errs ValidationErrors) error {
+	violations := make([]*errdetails.BadRequest_FieldViolation, len(errs))
+	for i, fe := range errs {
+		violations[i] = &errdetails.BadRequest_FieldViolation{Field: fe.Field, Description: fe.Message}
+	}
+	st, err := status.New(codes.InvalidArgument, "Validation failed").WithDetails(&errdetails.BadRequest{
+		FieldViolations: violations,
+	})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, errs.Error())
+	}
+	return st.Err()
+}
+
+// loadRoom fetches a chatroom for a gRPC call
+func loadRoom(roomID string) (*Chatroom, error) {
+	if roomID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Room ID is required")
+	}
+	room, err := getChatroom(roomID)
+	if err == redis.Nil {
+		return nil, status.Error(codes.NotFound, "Chatroom not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error fetching chatroom")
+	}
+	return room, nil
+}
+
+func roomToProto(room *Chatroom) *chatpb.Room {
+	return &chatpb.Room{
+		Id:          room.ID,
+		Name:        room.Name,
+		Description: room.Description,
+		CreatorId:   room.CreatorID,
+		CreatedAt:   timestamppb.New(room.CreatedAt),
+		UserCount:   int32(room.UserCount),
+		Topic:       room.Topic,
+		Archived:    room.Archived,
+	}
+}
+
+// chatService implements chatpb.ChatServiceServer
+type chatService struct {
+	chatpb.UnimplementedChatServiceServer
+}
+
+func (s *chatService) ListRooms(ctx context.Context, req *chatpb.ListRoomsRequest) (*chatpb.ListRoomsResponse, error) {
+	index := "chatrooms"
+	if req.GetMine() {
+		index = "user:" + grpcUser(ctx) + ":chatrooms"
+	}
+
+	ids, err := rdb.SMembers(ctx, index).Result()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error fetching chatrooms")
+	}
+
+	resp := &chatpb.ListRoomsResponse{}
+	for _, id := range ids {
+		room, err := getChatroom(id)
+		if err != nil {
+			continue // Skip this chatroom if there was an error
+		}
+		resp.Rooms = append(resp.Rooms, roomToProto(room))
+	}
+	return resp, nil
+}
+
+func (s *chatService) GetRoom(ctx context.Context, req *chatpb.GetRoomRequest) (*chatpb.Room, error) {
+	room, err := loadRoom(req.GetRoomId())
+	if err != nil {
+		return nil, err
+	}
+	return roomToProto(room), nil
+}
+
+func (s *chatService) CreateRoom(ctx context.Context, req *chatpb.CreateRoomRequest) (*chatpb.Room, error) {
+	username := grpcUser(ctx)
+	if ok, retryAfter := allow(roomCreateRateLimit, username); !ok {
+		return nil, rateLimitStatus(retryAfter)
+	}
+
+	name, description, errs := validateChatroom(req.GetName(), req.GetDescription())
+	if len(errs) > 0 {
+		return nil, validationStatus(errs)
+	}
+
+	room, err := createChatroom(username, name, description)
+	if err != nil {
+		fmt.Printf("Error creating chatroom: %v\n", err)
+		return nil, status.Error(codes.Internal, "Error creating chatroom")
+	}
+	return roomToProto(room), nil
+}
+
+// UpdateRoom changes the fields set in the request. The name and
+// description are the owner's to change, the topic any moderator's.
+func (s *chatService) UpdateRoom(ctx context.Context, req *chatpb.UpdateRoomRequest) (*chatpb.Room, error) {
+	username := grpcUser(ctx)
+	room, err := loadRoom(req.GetRoomId())
+	if err != nil {
+		return nil, err
+	}
+	if room.Archived {
+		return nil, status.Error(codes.FailedPrecondition, "Chatroom is archived")
+	}
+
+	rank := roleRank(roomRole(room, username))
+	if (req.Name != nil || req.Description != nil) && rank < roleRank(roleOwner) {
+		return nil, status.Error(codes.PermissionDenied, "Only the room's owner can rename it")
+	}
+	if req.Topic != nil && rank < roleRank(roleModerator) {
+		return nil, status.Error(codes.PermissionDenied, "Only moderators can change the topic")
+	}
+
+	name, description := room.Name, room.Description
+	if req.Name != nil {
+		name = req.GetName()
+	}
+	if req.Description != nil {
+		description = req.GetDescription()
+	}
+	name, description, errs := validateChatroom(name, description)
+
+	var topic string
+	if req.Topic != nil {
+		topic = normalizeText(req.GetTopic(), false)
+		if utf8.RuneCountInString(topic) > rules.roomDescMax {
+			errs.add("topic", "too_long", "Topic must be at most %d characters", rules.roomDescMax)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, validationStatus(errs)
+	}
+
+	if req.Name != nil || req.Description != nil {
+		room, err = updateChatroom(room.ID, func(stored *Chatroom) {
+			stored.Name, stored.Description = name, description
+		})
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Error updating chatroom")
+		}
+		if req.Topic == nil {
+			emitRoomUpdated(room)
+		}
+	}
+	if req.Topic != nil {
+		if err := setRoomTopic(room, topic, username); err != nil {
+			return nil, status.Error(codes.Internal, "Error updating chatroom")
+		}
+	}
+	return roomToProto(room), nil
+}
+
+// DeleteRoom deletes a room and disconnects everyone in it. Only the
+// room's owner and admins may delete it.
+func (s *chatService) DeleteRoom(ctx context.Context, req *chatpb.DeleteRoomRequest) (*chatpb.DeleteRoomResponse, error) {
+	username := grpcUser(ctx)
+	room, err := loadRoom(req.GetRoomId())
+	if err != nil {
+		return nil, err
+	}
+	if roleRank(roomRole(room, username)) < roleRank(roleOwner) {
+		return nil, status.Error(codes.PermissionDenied, "Only the room's owner can delete it")
+	}
+
+	reason := req.GetReason()
+	if reason == "" {
+		reason = "room deleted by its owner"
+	}
+	if err := deleteChatroom(room, reason); err != nil {
+		return nil, status.Error(codes.Internal, "Error deleting chatroom")
+	}
+
+	fmt.Printf("User %s deleted room %s: %s\n", username, room.ID, reason)
+	return &chatpb.DeleteRoomResponse{}, nil
+}
+
+func (s *chatService) GetHistory(ctx context.Context, req *chatpb.GetHistoryRequest) (*chatpb.GetHistoryResponse, error) {
+	room, err := loadRoom(req.GetRoomId())
+	if err != nil {
+		return nil, err
+	}
+	if isBanned(room.ID, grpcUser(ctx)) {
+		return nil, status.Error(codes.PermissionDenied, "You are banned from this chatroom")
+	}
+
+	limit := int(req.GetLimit())
+	if limit == 0 {
+		limit = 50
+	}
+	if limit < 1 || limit > maxRoomHistory {
+		return nil, status.Error(codes.InvalidArgument, "Invalid limit")
+	}
+
+	messages, err := roomHistory(room.ID, req.GetBefore(), limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error fetching history")
+	}
+
+	resp := &chatpb.GetHistoryResponse{}
+	for _, message := range messages {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(message, &fields); err != nil {
+			continue
+		}
+		if envelope, err := structpb.NewStruct(fields); err == nil {
+			resp.Messages = append(resp.Messages, envelope)
+		}
+	}
+	return resp, nil
+}
+
+// Chat joins the room named by the first client frame and relays frames in
+// both directions until either side closes the stream. Client frames are
+// handled like WebSocket frames; the room cannot change mid-stream.
+func (s *chatService) Chat(stream grpc.BidiStreamingServer[chatpb.ClientFrame, chatpb.ServerFrame]) error {
+	streamCtx := stream.Context()
+	username := grpcUser(streamCtx)
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	room, err := joinRoomGRPC(streamCtx, first.GetRoomId(), username)
+	if err != nil {
+		return err
+	}
+
+	hub := hubFor(room.ID)
+	sub := newSubscriber(username)
+	hubSend(hub, hub.subscribe, sub)
+	defer func() {
+		hubSend(hub, hub.unsubscribe, sub)
+	}()
+
+	// Replies meant for this stream only, sent from the loop below because
+	// a stream must not be written from two goroutines
+	private := make(chan []byte, 16)
+	done := make(chan error, 1)
+	reply := func(frame []byte) {
+		select {
+		case private <- frame:
+		case <-streamCtx.Done():
+		}
+	}
+	go func() {
+		done <- readChatFrames(stream, hub, sub, first, reply)
+	}()
+
+	for {
+		select {
+		case <-streamCtx.Done():
+			return streamCtx.Err()
+
+		case err := <-done:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+
+		case frame := <-private:
+			if err := stream.Send(serverFrame(frame)); err != nil {
+				return err
+			}
+
+		case frame, ok := <-sub.frames:
+			if !ok {
+				// Dropped by the hub: kicked, room closed or too slow
+				return status.Error(codes.Aborted, "Disconnected from the chatroom")
+			}
+			if err := stream.Send(serverFrame(frame)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// joinRoomGRPC runs the checks of joinRoom for a Chat stream
+func joinRoomGRPC(ctx context.Context, roomID, username string) (*Chatroom, error) {
+	addr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+	}
+	if ok, retryAfter := allow(wsConnectRateLimit, addr); !ok {
+		return nil, rateLimitStatus(retryAfter)
+	}
+
+	room, err := loadRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.Archived {
+		return nil, status.Error(codes.FailedPrecondition, "Chatroom is archived")
+	}
+	if isBanned(room.ID, username) {
+		return nil, status.Error(codes.PermissionDenied, "You are banned from this chatroom")
+	}
+	return room, nil
+}
+
+// readChatFrames handles the client frames of a Chat stream, starting with
+// the one that joined the room
+func readChatFrames(stream grpc.BidiStreamingServer[chatpb.ClientFrame, chatpb.ServerFrame], hub *Hub, sub *subscriber, frame *chatpb.ClientFrame, reply func([]byte)) error {
+	messageLimit := newLocalBucket(wsMessageRateLimit)
+
+	for {
+		if frame.GetRoomId() != "" && frame.GetRoomId() != hub.roomID {
+			return status.Error(codes.InvalidArgument, "A stream stays in the chatroom it joined")
+		}
+
+		// A frame without a type only joins the room
+		if frame.GetType() != "" {
+			msg := frame.GetFields().AsMap()
+			msg["type"] = frame.GetType()
+			if frame.GetContent() != "" {
+				msg["content"] = frame.GetContent()
+			}
+			msg["timestamp"] = time.Now()
+			msg["sender"] = sub.username
+
+			if err := handleChatFrame(hub, sub, msg, messageLimit, reply); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if frame, err = stream.Recv(); err != nil {
+			return err
+		}
+	}
+}
+
+// handleChatFrame applies the rules of the WebSocket read loop to one frame
+func handleChatFrame(hub *Hub, sub *subscriber, msg map[string]interface{}, messageLimit *localBucket, reply func([]byte)) error {
+	msgType, _ := msg["type"].(string)
+
+	if !messageLimit.allow() {
+		return status.Error(codes.ResourceExhausted, "Too many messages")
+	}
+
+	// Muted users are read-only, they may only mark messages as read and
+	// ask who is online
+	readOnly := msgType == frameMarkRead || msgType == frameRefreshUserList
+	if !readOnly && isMuted(hub.roomID, sub.username) {
+		if msgType == frameChat {
+			reply(errorFrame(errCodeMuted, "You are muted in this chatroom"))
+		}
+		return nil
+	}
+
+	switch {
+	case isEphemeralFrame(msgType):
+		// Typing state is tracked per WebSocket connection
+		reply(errorFrame(errCodeInvalidRequest, "Ephemeral signals are only available over WebSocket"))
+		return nil
+
+	case msgType == frameRefreshUserList:
+		hubSend(hub, hub.presence, presenceRequest{sub: sub})
+		return nil
+
+	case msgType == frameMarkRead:
+		handleMarkRead(hub, sub.username, msg)
+		return nil
+	}
+
+	if msgType == frameChat {
+		// Command handlers reply through the WebSocket connection
+		if isCommand(msg) {
+			reply(errorFrame(errCodeInvalidRequest, "Slash commands are only available over WebSocket"))
+			return nil
+		}
+		if _, err := submitChatMessage(hub.roomID, sub.username, msg); err != nil {
+			var rejection *messageRejection
+			if errors.As(err, &rejection) {
+				reply(errorFrame(rejection.Code, rejection.Message))
+			} else {
+				fmt.Printf("Error publishing message: %v\n", err)
+			}
+		}
+		return nil
+	}
+
+	// Every other frame type is sent by the server only
+	reply(errorFrame(errCodeInvalidRequest, fmt.Sprintf("Unsupported frame type %q", msgType)))
+	return nil
+}
+
+// serverFrame converts a hub frame for a Chat stream. The common fields are
+// lifted out of the JSON envelope, which is passed along in full.
+func serverFrame(message []byte) *chatpb.ServerFrame {
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return &chatpb.ServerFrame{Type: "raw", Content: string(message)}
+	}
+
+	frame := &chatpb.ServerFrame{}
+	frame.Type, _ = envelope["type"].(string)
+	frame.Sender, _ = envelope["sender"].(string)
+	frame.Content, _ = envelope["content"].(string)
+	if id, ok := envelope["id"].(float64); ok {
+		frame.Id = int64(id)
+	}
+	if fields, err := structpb.NewStruct(envelope); err == nil {
+		frame.Envelope = fields
+	}
+	return frame
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/neo7337/go-websocket-demo/server/chatpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// testGRPCClient serves the gRPC API over an in-memory listener
+func testGRPCClient(t *testing.T) chatpb.ChatServiceClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := newGRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dialing the gRPC server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return chatpb.NewChatServiceClient(conn)
+}
+
+// grpcContext authenticates calls with token
+func grpcContext(t *testing.T, token string) context.Context {
+	t.Helper()
+
+	callCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	if token == "" {
+		return callCtx
+	}
+	return metadata.AppendToOutgoingContext(callCtx, "authorization", "Bearer "+token)
+}
+
+// joinChat opens a Chat stream in a room and waits until the hub has
+// subscribed it
+func joinChat(t *testing.T, client chatpb.ChatServiceClient, token, roomID string) chatpb.ChatService_ChatClient {
+	t.Helper()
+
+	stream, err := client.Chat(grpcContext(t, token))
+	if err != nil {
+		t.Fatalf("opening a chat stream: %v", err)
+	}
+	if err := stream.Send(&chatpb.ClientFrame{RoomId: roomID}); err != nil {
+		t.Fatalf("joining %s: %v", roomID, err)
+	}
+	recvFrame(t, stream, "userList")
+	return stream
+}
+
+// recvFrame reads server frames until one of the given type arrives
+func recvFrame(t *testing.T, stream chatpb.ChatService_ChatClient, frameType string) *chatpb.ServerFrame {
+	t.Helper()
+
+	for {
+		frame, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("waiting for a %s frame: %v", frameType, err)
+		}
+		if frame.GetType() == frameType {
+			return frame
+		}
+	}
+}
+
+func TestGRPCScopes(t *testing.T) {
+	useTestRedis(t)
+	client := testGRPCClient(t)
+	room := testRoom(t, "alice")
+
+	readKey := testAPIKey(t, "bot", scopeRead)
+	writeKey := testAPIKey(t, "bot", scopeWrite)
+
+	cases := []struct {
+		name  string
+		token string
+		call  func(context.Context) error
+		want  codes.Code
+	}{
+		{"no token", "", func(c context.Context) error {
+			_, err := client.ListRooms(c, &chatpb.ListRoomsRequest{})
+			return err
+		}, codes.Unauthenticated},
+		{"unknown session", "nosuchtoken", func(c context.Context) error {
+			_, err := client.ListRooms(c, &chatpb.ListRoomsRequest{})
+			return err
+		}, codes.Unauthenticated},
+		{"unknown key", "key_missing_secret", func(c context.Context) error {
+			_, err := client.ListRooms(c, &chatpb.ListRoomsRequest{})
+			return err
+		}, codes.Unauthenticated},
+		{"session", testSession(t, "alice"), func(c context.Context) error {
+			_, err := client.CreateRoom(c, &chatpb.CreateRoomRequest{Name: "by session"})
+			return err
+		}, codes.OK},
+		{"read key reads", readKey, func(c context.Context) error {
+			_, err := client.GetHistory(c, &chatpb.GetHistoryRequest{RoomId: room.ID})
+			return err
+		}, codes.OK},
+		{"read key writes", readKey, func(c context.Context) error {
+			_, err := client.CreateRoom(c, &chatpb.CreateRoomRequest{Name: "by reader"})
+			return err
+		}, codes.PermissionDenied},
+		{"write key writes", writeKey, func(c context.Context) error {
+			_, err := client.CreateRoom(c, &chatpb.CreateRoomRequest{Name: "by writer"})
+			return err
+		}, codes.OK},
+		{"write key reads", writeKey, func(c context.Context) error {
+			_, err := client.GetRoom(c, &chatpb.GetRoomRequest{RoomId: room.ID})
+			return err
+		}, codes.PermissionDenied},
+		{"read key chats", readKey, func(c context.Context) error {
+			stream, err := client.Chat(c)
+			if err != nil {
+				return err
+			}
+			stream.Send(&chatpb.ClientFrame{RoomId: room.ID})
+			_, err = stream.Recv()
+			return err
+		}, codes.PermissionDenied},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := status.Code(tc.call(grpcContext(t, tc.token))); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGRPCBannedUser(t *testing.T) {
+	useTestRedis(t)
+	client := testGRPCClient(t)
+	room := testRoom(t, "alice")
+	if _, err := submitChatMessage(room.ID, "alice", map[string]interface{}{"type": frameChat, "content": "hello"}); err != nil {
+		t.Fatalf("posting: %v", err)
+	}
+	if err := restrictUser(roomBansKey(room.ID), "bob", "alice", "", 0); err != nil {
+		t.Fatalf("banning bob: %v", err)
+	}
+	token := testSession(t, "bob")
+
+	_, err := client.GetHistory(grpcContext(t, token), &chatpb.GetHistoryRequest{RoomId: room.ID})
+	if got := status.Code(err); got != codes.PermissionDenied {
+		t.Errorf("GetHistory: got %v, want %v", got, codes.PermissionDenied)
+	}
+
+	stream, err := client.Chat(grpcContext(t, token))
+	if err != nil {
+		t.Fatalf("opening a chat stream: %v", err)
+	}
+	if err := stream.Send(&chatpb.ClientFrame{RoomId: room.ID}); err != nil {
+		t.Fatalf("joining: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Chat: got %v, want %v", err, codes.PermissionDenied)
+	}
+}
+
+func TestGRPCChatRoundTrip(t *testing.T) {
+	useTestRedis(t)
+	client := testGRPCClient(t)
+	room := testRoom(t, "alice")
+
+	alice := joinChat(t, client, testSession(t, "alice"), room.ID)
+	bob := joinChat(t, client, testSession(t, "bob"), room.ID)
+
+	// Timestamps sent by the client are replaced with the server's
+	before := time.Now()
+	fields, _ := structpb.NewStruct(map[string]interface{}{"timestamp": before.AddDate(-5, 0, 0).Format(time.RFC3339)})
+	if err := alice.Send(&chatpb.ClientFrame{Type: frameChat, Content: "hello bob", Fields: fields}); err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+
+	got := recvFrame(t, bob, frameChat)
+	if got.GetSender() != "alice" || got.GetContent() != "hello bob" || got.GetId() == 0 {
+		t.Errorf("bob received %v from %s with id %d, want hello bob from alice", got.GetContent(), got.GetSender(), got.GetId())
+	}
+	echo := recvFrame(t, alice, frameChat)
+	if echo.GetId() != got.GetId() {
+		t.Errorf("alice's echo has id %d, want %d", echo.GetId(), got.GetId())
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, got.GetEnvelope().GetFields()["timestamp"].GetStringValue())
+	if err != nil || timestamp.Before(before.Truncate(time.Second)) {
+		t.Errorf("timestamp %v, %v, want the time the message was sent", timestamp, err)
+	}
+
+	history, err := client.GetHistory(grpcContext(t, testSession(t, "bob")), &chatpb.GetHistoryRequest{RoomId: room.ID})
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(history.GetMessages()) != 1 {
+		t.Fatalf("history holds %d messages, want 1", len(history.GetMessages()))
+	}
+	stored, _ := json.Marshal(history.GetMessages()[0].AsMap())
+	var msg struct {
+		ID      int64  `json:"id"`
+		Content string `json:"content"`
+	}
+	json.Unmarshal(stored, &msg)
+	if msg.ID != got.GetId() || msg.Content != "hello bob" {
+		t.Errorf("history holds %s, want message %d", stored, got.GetId())
+	}
+
+	// Frames meant for the sender only come back on its own stream
+	if err := alice.Send(&chatpb.ClientFrame{Type: frameTypingStarted}); err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+	if got := recvFrame(t, alice, "error"); got.GetEnvelope().GetFields()["code"].GetStringValue() != errCodeInvalidRequest {
+		t.Errorf("error frame %v, want %s", got.GetEnvelope().AsMap(), errCodeInvalidRequest)
+	}
+}
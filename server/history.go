@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxRoomHistory is the number of chat messages kept per room
+const maxRoomHistory = 500
+
+func roomMessagesKey(roomID string) string {
+	return "chatroom:" + roomID + ":messages"
+}
+
+// appendHistory stores a chat message and trims the room history to
+// maxRoomHistory, along with the ids unread counts are taken from
+func appendHistory(roomID string, messageID int64, message []byte) error {
+	pipe := rdb.TxPipeline()
+	pipe.RPush(ctx, roomMessagesKey(roomID), message)
+	pipe.LTrim(ctx, roomMessagesKey(roomID), -maxRoomHistory, -1)
+	pipe.ZAdd(ctx, roomPublishedKey(roomID), redis.Z{Score: float64(messageID), Member: messageID})
+	pipe.ZRemRangeByRank(ctx, roomPublishedKey(roomID), 0, -maxRoomHistory-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	if err := messageIndex.add(roomID, message); err != nil {
+		fmt.Printf("Error indexing message: %v\n", err)
+	}
+	return nil
+}
+
+// historyHandler returns stored chat messages of a room, oldest first.
+// Query parameters: roomId (required), before (message id) and limit.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	roomID := r.URL.Query().Get("roomId")
+	if roomID == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Room ID is required")
+		return
+	}
+
+	if readableRoom(w, roomID, username) == nil {
+		return
+	}
+
+	var err error
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxRoomHistory {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid limit")
+			return
+		}
+	}
+
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		before, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid before")
+			return
+		}
+	}
+
+	messages, err := roomHistory(roomID, before, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching history")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": messages,
+	})
+}
+
+// roomHistory returns up to limit stored chat messages of a room with an id
+// below before (0 for the newest), oldest first
+func roomHistory(roomID string, before int64, limit int) ([]json.RawMessage, error) {
+	stored, err := rdb.LRange(ctx, roomMessagesKey(roomID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk backwards from the newest message collecting up to limit messages
+	messages := []json.RawMessage{}
+	for i := len(stored) - 1; i >= 0 && len(messages) < limit; i-- {
+		var header struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(stored[i]), &header); err != nil {
+			continue // Skip messages that cannot be parsed
+		}
+		if before > 0 && header.ID >= before {
+			continue
+		}
+		messages = append(messages, json.RawMessage(stored[i]))
+	}
+
+	// Return oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// messagesAfter returns the stored chat messages of a room with an id
+// greater than after, oldest first
+func messagesAfter(roomID string, after int64) ([]json.RawMessage, error) {
+	stored, err := rdb.LRange(ctx, roomMessagesKey(roomID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []json.RawMessage{}
+	for _, message := range stored {
+		var header struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(message), &header); err == nil && header.ID > after {
+			messages = append(messages, json.RawMessage(message))
+		}
+	}
+	return messages, nil
+}
+
+// findMessage returns a stored chat message of a room by id, as stored
+func findMessage(roomID string, messageID int64) (string, error) {
+	stored, err := rdb.LRange(ctx, roomMessagesKey(roomID), 0, -1).Result()
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(stored) - 1; i >= 0; i-- {
+		var header struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(stored[i]), &header); err == nil && header.ID == messageID {
+			return stored[i], nil
+		}
+	}
+	return "", redis.Nil
+}
+
+// deleteMessage removes a chat message from the room history and tells
+// connected clients to drop it
+func deleteMessage(roomID string, messageID int64) error {
+	stored, err := findMessage(roomID, messageID)
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.LRem(ctx, roomMessagesKey(roomID), 1, stored)
+	pipe.ZRem(ctx, roomPublishedKey(roomID), messageID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if err := messageIndex.remove(roomID, messageID); err != nil {
+		fmt.Printf("Error removing message from search index: %v\n", err)
+	}
+
+	if hub := lookupHub(roomID); hub != nil {
+		msg := map[string]interface{}{
+			"type":      "messageDeleted",
+			"messageId": messageID,
+			"sender":    "system",
+			"timestamp": time.Now(),
+		}
+		if msgJSON, err := json.Marshal(msg); err == nil {
+			hubSend(hub, hub.broadcast, msgJSON)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pipeListener hands out in-memory connections so a benchmark can open
+// thousands of WebSockets without running out of ports or file descriptors
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (l *pipeListener) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// newBenchHub builds a hub with n connected clients that drain every frame
+// they receive. The hub is not running, benchmarks call fanOut directly.
+func newBenchHub(b *testing.B, n int, subprotocol string, compress bool) *Hub {
+	b.Helper()
+
+	listener := newPipeListener()
+	accepted := make(chan *websocket.Conn)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Errorf("upgrade: %v", err)
+			return
+		}
+		accepted <- conn
+	})}
+	go srv.Serve(listener)
+
+	dialer := websocket.Dialer{
+		NetDialContext:    listener.dial,
+		EnableCompression: compress,
+		HandshakeTimeout:  5 * time.Second,
+	}
+	if subprotocol != "" {
+		dialer.Subprotocols = []string{subprotocol}
+	}
+
+	hub := newHub("bench")
+	for i := 0; i < n; i++ {
+		go func() {
+			conn, _, err := dialer.Dial("ws://bench/ws", nil)
+			if err != nil {
+				b.Errorf("dial: %v", err)
+				return
+			}
+			for {
+				_, r, err := conn.NextReader()
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, r)
+			}
+		}()
+
+		conn := <-accepted
+		hub.clients[conn] = &Client{conn: conn, id: fmt.Sprintf("bench_%d", i), encoding: clientEncoding(conn)}
+	}
+
+	b.Cleanup(func() {
+		for conn := range hub.clients {
+			conn.Close()
+		}
+		srv.Close()
+	})
+	return hub
+}
+
+func benchMessage() []byte {
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":      frameChat,
+		"id":        42,
+		"sender":    "alice",
+		"content":   strings.Repeat("The quick brown fox jumps over the lazy dog. ", 24),
+		"timestamp": time.Now(),
+	})
+	return msg
+}
+
+// BenchmarkHubFanOut measures broadcasting one chat message to every client in a room
+func BenchmarkHubFanOut(b *testing.B) {
+	message := benchMessage()
+	cases := []struct {
+		name        string
+		subprotocol string
+		compress    bool
+	}{
+		{"json", "", false},
+		{"json-deflate", "", true},
+		{"msgpack", encodingMsgpack, false},
+		{"msgpack-deflate", encodingMsgpack, true},
+	}
+
+	for _, conns := range []int{1000, 10000} {
+		for _, c := range cases {
+			b.Run(fmt.Sprintf("conns=%d/%s", conns, c.name), func(b *testing.B) {
+				hub := newBenchHub(b, conns, c.subprotocol, c.compress)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					hub.fanOut(message, nil)
+				}
+				b.StopTimer()
+
+				if len(hub.clients) != conns {
+					b.Fatalf("lost clients during fan-out: %d of %d left", len(hub.clients), conns)
+				}
+				b.ReportMetric(float64(conns*b.N)/b.Elapsed().Seconds(), "deliveries/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Message formats incoming webhooks may declare. Clients render markdown,
+// the server only passes the hint along.
+var incomingFormats = map[string]bool{"plain": true, "markdown": true}
+
+var incomingWebhookRateLimit = loadRatePolicy("incoming_webhook", 30, time.Minute)
+
+// IncomingWebhook lets an external system post into a room through a secret URL
+type IncomingWebhook struct {
+	ID        string    `json:"id"`
+	RoomID    string    `json:"roomId"`
+	Name      string    `json:"name"`
+	AvatarURL string    `json:"avatarUrl,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	URL       string    `json:"url,omitempty"` // only returned when the webhook is created
+}
+
+type storedIncomingWebhook struct {
+	IncomingWebhook
+	SecretHash string `json:"secretHash"`
+}
+
+func incomingWebhookKey(id string) string {
+	return "incoming_webhook:" + id
+}
+
+func roomIncomingWebhooksKey(roomID string) string {
+	return "chatroom:" + roomID + ":incoming_webhooks"
+}
+
+func getIncomingWebhook(id string) (*storedIncomingWebhook, error) {
+	hookJSON, err := rdb.Get(ctx, incomingWebhookKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var hook storedIncomingWebhook
+	if err := json.Unmarshal([]byte(hookJSON), &hook); err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+// validateSenderName checks a webhook name or username override. Reserved
+// names such as "system" and names of existing accounts are refused so a
+// webhook cannot pose as the server or a person. Accounts are looked up by
+// their record as well, which also covers bots and users missing from the
+// users set.
+func validateSenderName(errs *ValidationErrors, field, name string) {
+	n := utf8.RuneCountInString(name)
+	switch {
+	case n == 0:
+		errs.add(field, "required", "Name is required")
+	case n > rules.usernameMax:
+		errs.add(field, "too_long", "Name must be at most %d characters", rules.usernameMax)
+	case rules.reservedNames[strings.ToLower(name)]:
+		errs.add(field, "reserved", "Name is reserved")
+	default:
+		pipe := rdb.Pipeline()
+		member := pipe.SIsMember(ctx, "users", name)
+		record := pipe.Exists(ctx, name)
+		if _, err := pipe.Exec(ctx); err != nil {
+			// Refuse rather than risk letting an account's name through
+			fmt.Printf("Error checking sender name: %v\n", err)
+			errs.add(field, "taken", "Name could not be checked, try again")
+			return
+		}
+		if member.Val() || record.Val() > 0 {
+			errs.add(field, "taken", "Name belongs to a registered user")
+		}
+	}
+}
+
+// incomingWebhooksHandler lists (GET ?roomId=) or creates (POST) a room's
+// incoming webhooks. They are managed by the room owner.
+func incomingWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		room, _ := roomWithRole(w, r, r.URL.Query().Get("roomId"), roleOwner)
+		if room == nil {
+			return
+		}
+
+		ids, err := rdb.SMembers(ctx, roomIncomingWebhooksKey(room.ID)).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching webhooks")
+			return
+		}
+
+		hooks := []IncomingWebhook{}
+		for _, id := range ids {
+			if hook, err := getIncomingWebhook(id); err == nil {
+				hooks = append(hooks, hook.IncomingWebhook)
+			}
+		}
+		sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hooks)
+
+	case http.MethodPost:
+		createIncomingWebhook(w, r)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+	}
+}
+
+func createIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID    string `json:"roomId"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatarUrl"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	room, username := roomWithRole(w, r, req.RoomID, roleOwner)
+	if room == nil {
+		return
+	}
+
+	var errs ValidationErrors
+	req.Name = normalizeText(req.Name, false)
+	validateSenderName(&errs, "name", req.Name)
+	if req.AvatarURL != "" {
+		validateAvatarURL(&errs, "avatarUrl", req.AvatarURL)
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	id, err := randomToken(8)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating webhook")
+		return
+	}
+	secret, err := randomToken(24)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating webhook")
+		return
+	}
+
+	hook := storedIncomingWebhook{
+		IncomingWebhook: IncomingWebhook{
+			ID:        id,
+			RoomID:    room.ID,
+			Name:      req.Name,
+			AvatarURL: req.AvatarURL,
+			CreatedBy: username,
+			CreatedAt: time.Now(),
+		},
+		SecretHash: hashSecret(secret),
+	}
+	hookJSON, err := json.Marshal(hook)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating webhook")
+		return
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, incomingWebhookKey(id), hookJSON, 0)
+	pipe.SAdd(ctx, roomIncomingWebhooksKey(room.ID), id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing webhook")
+		return
+	}
+
+	// The URL carries the secret and is only shown once
+	hook.URL = "/hooks/" + id + "/" + secret
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook.IncomingWebhook)
+}
+
+// deleteIncomingWebhookHandler revokes an incoming webhook URL
+func deleteIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var req struct {
+		RoomID string `json:"roomId"`
+		ID     string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	room, _ := roomWithRole(w, r, req.RoomID, roleOwner)
+	if room == nil {
+		return
+	}
+
+	hook, err := getIncomingWebhook(req.ID)
+	if err != nil || hook.RoomID != room.ID {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Webhook not found")
+		return
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, incomingWebhookKey(hook.ID))
+	pipe.SRem(ctx, roomIncomingWebhooksKey(room.ID), hook.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error deleting webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Webhook deleted",
+	})
+}
+
+// incomingWebhookPostHandler accepts a message on /hooks/<id>/<secret> and
+// posts it to the room like any chat message: through validation and the
+// room's filters, into history and out to connected clients.
+func incomingWebhookPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	id, secret, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/hooks/"), "/")
+	hook, err := getIncomingWebhook(id)
+	if err == redis.Nil || (err == nil && subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(hook.SecretHash)) != 1) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching webhook")
+		return
+	}
+
+	if rateLimited(w, incomingWebhookRateLimit, hook.ID) {
+		return
+	}
+
+	room, err := getChatroom(hook.RoomID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+		return
+	}
+	if room.Archived {
+		writeError(w, http.StatusGone, errCodeRoomArchived, "Chatroom is archived")
+		return
+	}
+
+	var req struct {
+		Text      string `json:"text"`
+		Username  string `json:"username"`
+		AvatarURL string `json:"avatarUrl"`
+		Format    string `json:"format"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	sender := hook.Name
+	avatarURL := hook.AvatarURL
+	var errs ValidationErrors
+	if req.Username != "" {
+		sender = normalizeText(req.Username, false)
+		validateSenderName(&errs, "username", sender)
+	}
+	if req.AvatarURL != "" {
+		avatarURL = req.AvatarURL
+		validateAvatarURL(&errs, "avatarUrl", avatarURL)
+	}
+	if req.Format == "" {
+		req.Format = "plain"
+	}
+	if !incomingFormats[req.Format] {
+		errs.add("format", "invalid", "Format must be plain or markdown")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	msg := map[string]interface{}{
+		"type":      frameChat,
+		"content":   req.Text,
+		"sender":    sender,
+		"format":    req.Format,
+		"webhookId": hook.ID,
+		"timestamp": time.Now(),
+		"senderProfile": ProfileSnippet{
+			Username:    sender,
+			DisplayName: sender,
+			AvatarURL:   avatarURL,
+			Bot:         true,
+		},
+	}
+
+	if _, err := submitChatMessage(room.ID, "", msg); err != nil {
+		var rejection *messageRejection
+		if errors.As(err, &rejection) {
+			writeError(w, http.StatusUnprocessableEntity, rejection.Code, rejection.Message)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error posting message")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"messageId": msg["id"],
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSenderName(t *testing.T) {
+	useTestRedis(t)
+	rdb.SAdd(ctx, "users", "alice")
+	// Registered before the users set was kept, only the record exists
+	rdb.Set(ctx, "legacy", legacyHash("pw"), 0)
+	rdb.Set(ctx, "helperbot", unusablePasswordHash, 0)
+
+	cases := []struct {
+		name   string
+		sender string
+		want   []string
+	}{
+		{"free", "CI Bot", nil},
+		{"missing", "", []string{"name:required"}},
+		{"too long", strings.Repeat("a", rules.usernameMax+1), []string{"name:too_long"}},
+		{"system", "system", []string{"name:reserved"}},
+		{"reserved any case", "Admin", []string{"name:reserved"}},
+		{"global key", "chatrooms", []string{"name:reserved"}},
+		{"registered user", "alice", []string{"name:taken"}},
+		{"user missing from the index", "legacy", []string{"name:taken"}},
+		{"bot", "helperbot", []string{"name:taken"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var errs ValidationErrors
+			validateSenderName(&errs, "name", tc.sender)
+			got := fieldCodes(errs)
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("validateSenderName(%q) = %v, want %v", tc.sender, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,982 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// IRC gateway. Every chatroom is a channel named after its id, e.g.
+// #chatroom_1700000000. Clients log in with PASS and NICK: the nick is the
+// username and PASS its password, a session token or an API key with the
+// chat scope. Each joined channel subscribes to the room's hub like SSE
+// does, so JOIN, PART and NAMES follow the room's presence and PRIVMSG posts
+// through submitChatMessage.
+
+var (
+	// ircAddr is where the IRC gateway listens. It is off unless set, as
+	// passwords travel in the clear: expose it through a TLS terminating proxy.
+	ircAddr       = envOr("IRC_ADDR", "")
+	ircServerName = envOr("IRC_SERVER_NAME", "chat.local")
+)
+
+const (
+	ircPingInterval = 90 * time.Second
+	ircWriteTimeout = 10 * time.Second
+	// ircMaxLine is the longest line read from a client, message tags included
+	ircMaxLine = 8192
+	// ircMaxText is how many bytes of a message go into one PRIVMSG, leaving
+	// room for the prefix within the 512 byte line limit
+	ircMaxText = 400
+)
+
+var ircStarted = time.Now()
+
+// ircSessions are the logged in IRC sessions, so an account's sessions can
+// be closed when it is disabled or its sessions are revoked
+var (
+	ircSessionsMu sync.Mutex
+	ircSessions   = make(map[*ircSession]bool)
+)
+
+// closeIRCSessions drops every IRC session logged in as username
+func closeIRCSessions(username, reason string) {
+	ircSessionsMu.Lock()
+	var sessions []*ircSession
+	for s := range ircSessions {
+		if s.username == username {
+			sessions = append(sessions, s)
+		}
+	}
+	ircSessionsMu.Unlock()
+
+	// The read loop ends on the closed connection and leaves the channels
+	for _, s := range sessions {
+		s.send(ircLine("", "ERROR", "Closing link: "+reason))
+		s.conn.Close()
+	}
+}
+
+// serveIRC starts the IRC gateway in the background
+func serveIRC() error {
+	if ircAddr == "" {
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", ircAddr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				fmt.Println("Error accepting IRC connection:", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			go newIRCSession(conn).serve()
+		}
+	}()
+	return nil
+}
+
+// ircSession is one IRC client connection
+type ircSession struct {
+	conn    net.Conn
+	ip      string
+	writeMu sync.Mutex
+	done    chan struct{}
+
+	// Registration state, nick and username do not change once registered
+	pass     string
+	nick     string
+	gotUser  bool
+	username string
+
+	mu       sync.Mutex
+	channels map[string]*ircChannel // by room id
+
+	// postMu is held while posting so channel pumps can recognise the
+	// session's own messages, which IRC clients do not expect echoed back
+	postMu sync.Mutex
+	posted map[int64]bool
+
+	messageLimit *localBucket
+}
+
+// ircChannel is a room joined by an IRC session
+type ircChannel struct {
+	name   string
+	roomID string
+	hub    *Hub
+	sub    *subscriber
+
+	mu      sync.Mutex
+	members map[string]bool // nil until the hub sent the first user list
+	parted  bool
+}
+
+func newIRCSession(conn net.Conn) *ircSession {
+	ip := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return &ircSession{
+		conn:         conn,
+		ip:           ip,
+		done:         make(chan struct{}),
+		channels:     make(map[string]*ircChannel),
+		posted:       make(map[int64]bool),
+		messageLimit: newLocalBucket(wsMessageRateLimit),
+	}
+}
+
+// serve reads commands until the client quits or the connection drops
+func (s *ircSession) serve() {
+	defer s.close()
+	go s.keepAlive()
+
+	reader := bufio.NewReaderSize(s.conn, ircMaxLine)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(2 * ircPingInterval))
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			s.send(ircLine("", "ERROR", "Closing link: line too long"))
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		command, params := parseIRCLine(strings.TrimRight(string(line), "\r\n"))
+		if command != "" && !s.handle(command, params) {
+			return
+		}
+	}
+}
+
+// keepAlive pings the client so dead connections hit the read deadline
+func (s *ircSession) keepAlive() {
+	ticker := time.NewTicker(ircPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.send(ircLine("", "PING", ircServerName))
+		}
+	}
+}
+
+// close leaves every joined room and drops the connection
+func (s *ircSession) close() {
+	ircSessionsMu.Lock()
+	delete(ircSessions, s)
+	ircSessionsMu.Unlock()
+
+	close(s.done)
+	for _, ch := range s.joined() {
+		s.leave(ch)
+	}
+	s.conn.Close()
+}
+
+// parseIRCLine splits a line into its command and parameters, dropping
+// message tags and the prefix
+func parseIRCLine(line string) (string, []string) {
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var params []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if line[0] == ':' && len(params) > 0 {
+			params = append(params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		params = append(params, param)
+	}
+
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// ircLine formats a message, the last parameter becomes the trailing one
+func ircLine(prefix, command string, params ...string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+	for i, param := range params {
+		b.WriteByte(' ')
+		if i == len(params)-1 {
+			b.WriteByte(':')
+		}
+		b.WriteString(param)
+	}
+	return b.String()
+}
+
+var ircLineBreaks = strings.NewReplacer("\r", " ", "\n", " ", "\x00", "")
+
+// send writes a line, dropping the connection if the client cannot keep up
+func (s *ircSession) send(line string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	if _, err := s.conn.Write([]byte(ircLineBreaks.Replace(line) + "\r\n")); err != nil {
+		s.conn.Close()
+	}
+}
+
+// numeric sends a numeric reply addressed to the client
+func (s *ircSession) numeric(code string, params ...string) {
+	nick := s.nick
+	if nick == "" {
+		nick = "*"
+	}
+	s.send(ircLine(ircServerName, code, append([]string{nick}, params...)...))
+}
+
+// ircNick makes a chat name usable as an IRC nick
+func ircNick(name string) string {
+	if name == "" {
+		return "anonymous"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || strings.ContainsRune(",*?!@:#", r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func ircUserPrefix(name string) string {
+	nick := ircNick(name)
+	return nick + "!" + nick + "@" + ircServerName
+}
+
+// handle runs one command, returning false when the connection should close
+func (s *ircSession) handle(command string, params []string) bool {
+	switch command {
+	case "CAP":
+		// No capabilities are offered
+		if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+			s.send(ircLine(ircServerName, "CAP", "*", "LS", ""))
+		} else if len(params) > 1 && strings.ToUpper(params[0]) == "REQ" {
+			s.send(ircLine(ircServerName, "CAP", "*", "NAK", params[1]))
+		}
+		return true
+
+	case "PING":
+		token := ircServerName
+		if len(params) > 0 {
+			token = params[0]
+		}
+		s.send(ircLine(ircServerName, "PONG", ircServerName, token))
+		return true
+
+	case "PONG":
+		return true
+
+	case "QUIT":
+		s.send(ircLine("", "ERROR", "Closing link"))
+		return false
+	}
+
+	if s.username == "" {
+		return s.register(command, params)
+	}
+
+	switch command {
+	case "JOIN":
+		if len(params) < 1 {
+			s.numeric("461", command, "Not enough parameters")
+			return true
+		}
+		if params[0] == "0" {
+			for _, ch := range s.joined() {
+				s.part(ch.name, "")
+			}
+			return true
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			s.join(name)
+		}
+
+	case "PART":
+		if len(params) < 1 {
+			s.numeric("461", command, "Not enough parameters")
+			return true
+		}
+		reason := ""
+		if len(params) > 1 {
+			reason = params[1]
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			s.part(name, reason)
+		}
+
+	case "PRIVMSG":
+		if len(params) < 1 {
+			s.numeric("411", "No recipient given (PRIVMSG)")
+			return true
+		}
+		if len(params) < 2 || params[1] == "" {
+			s.numeric("412", "No text to send")
+			return true
+		}
+		for _, target := range strings.Split(params[0], ",") {
+			if !s.privmsg(target, params[1]) {
+				return false
+			}
+		}
+
+	case "NOTICE":
+		// Notices are meant for bots talking to each other and must never be
+		// answered automatically, they are not posted to rooms
+
+	case "NAMES":
+		if len(params) < 1 {
+			s.numeric("366", "*", "End of /NAMES list")
+			return true
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			if ch := s.channel(name); ch != nil {
+				s.sendNames(ch)
+			} else {
+				s.numeric("366", name, "End of /NAMES list")
+			}
+		}
+
+	case "TOPIC":
+		if len(params) < 1 {
+			s.numeric("461", command, "Not enough parameters")
+			return true
+		}
+		s.topic(params)
+
+	case "LIST":
+		s.list()
+
+	case "WHO":
+		if len(params) < 1 {
+			s.numeric("315", "*", "End of /WHO list")
+			return true
+		}
+		if ch := s.channel(params[0]); ch != nil {
+			for _, name := range ch.memberNames() {
+				nick := ircNick(name)
+				s.numeric("352", ch.name, nick, ircServerName, ircServerName, nick, "H", "0 "+name)
+			}
+		}
+		s.numeric("315", params[0], "End of /WHO list")
+
+	case "MODE":
+		if len(params) < 1 {
+			s.numeric("461", command, "Not enough parameters")
+			return true
+		}
+		switch {
+		case !strings.HasPrefix(params[0], "#"):
+			s.numeric("221", "+")
+		case len(params) == 1:
+			s.numeric("324", params[0], "+")
+		case params[1] == "b":
+			s.numeric("368", params[0], "End of channel ban list")
+		default:
+			s.numeric("482", params[0], "Channel modes are managed in the chat")
+		}
+
+	case "NICK":
+		s.send(ircLine(ircServerName, "NOTICE", s.nick, "Your nick is your username and cannot be changed"))
+
+	case "PASS", "USER":
+		s.numeric("462", "You may not reregister")
+
+	default:
+		s.numeric("421", command, "Unknown command")
+	}
+	return true
+}
+
+// register collects PASS, NICK and USER and logs the client in once it
+// has all of them
+func (s *ircSession) register(command string, params []string) bool {
+	switch command {
+	case "PASS":
+		if len(params) < 1 {
+			s.numeric("461", command, "Not enough parameters")
+			return true
+		}
+		s.pass = params[0]
+
+	case "NICK":
+		if len(params) < 1 {
+			s.numeric("431", "No nickname given")
+			return true
+		}
+		s.nick = params[0]
+
+	case "USER":
+		if len(params) < 4 {
+			s.numeric("461", command, "Not enough parameters")
+			return true
+		}
+		s.gotUser = true
+
+	default:
+		s.numeric("451", "You have not registered")
+		return true
+	}
+
+	if s.nick == "" || !s.gotUser {
+		return true
+	}
+
+	username, reason := s.authenticate()
+	if username == "" {
+		s.numeric("464", reason)
+		s.send(ircLine("", "ERROR", "Closing link: "+reason))
+		return false
+	}
+	s.username = username
+	s.pass = ""
+
+	ircSessionsMu.Lock()
+	ircSessions[s] = true
+	ircSessionsMu.Unlock()
+
+	s.numeric("001", "Welcome to the chat, "+ircUserPrefix(username))
+	s.numeric("002", "Your host is "+ircServerName)
+	s.numeric("003", "This server was created "+ircStarted.Format(time.RFC1123))
+	s.numeric("004", ircServerName, "chat", "i", "nt")
+	s.numeric("005", "CHANTYPES=#", "CASEMAPPING=ascii", "NETWORK="+ircServerName, "are supported by this server")
+	s.numeric("422", "MOTD File is missing")
+	return true
+}
+
+// authenticate checks PASS for the nick: a session token or API key of that
+// user, or their password. It returns the username, or why the login failed.
+func (s *ircSession) authenticate() (string, string) {
+	if s.pass == "" {
+		return "", "Password required"
+	}
+
+	if isAPIKeyToken(s.pass) {
+		key := lookupAPIKey(s.pass)
+		if key == nil || key.Username != s.nick {
+			return "", "Invalid API key"
+		}
+		if !key.hasScope(scopeChat) {
+			return "", "API key is missing the chat scope"
+		}
+		if ok, _ := allow(key.ratePolicy(), key.ID); !ok {
+			return "", "Too many requests"
+		}
+		touchAPIKey(key.ID)
+		return key.Username, ""
+	}
+
+	if lookupSession(s.pass) == s.nick {
+		return s.nick, ""
+	}
+
+	// Otherwise it is a password login, limited like POST /login
+	if ok, _ := allow(loginIPRateLimit, s.ip); !ok {
+		return "", "Too many login attempts"
+	}
+	if ok, _ := allow(loginUserRateLimit, s.nick); !ok {
+		return "", "Too many login attempts"
+	}
+
+	if lockedOutFor(s.nick) > 0 {
+		s.audit(false, "locked")
+		return "", "Too many failed login attempts, try again later"
+	}
+
+	ok, err := checkPassword(s.nick, s.pass)
+	if err != nil {
+		fmt.Printf("Error checking password: %v\n", err)
+		return "", "Internal error"
+	}
+	if !ok {
+		s.audit(false, "invalid_password")
+		time.Sleep(recordLoginFailure(s.nick))
+		return "", "Invalid username or password"
+	}
+
+	clearLoginFailures(s.nick)
+	if isDisabled(s.nick) {
+		s.audit(false, "disabled")
+		return "", "Account is disabled"
+	}
+
+	s.audit(true, "")
+	return s.nick, ""
+}
+
+func (s *ircSession) audit(success bool, reason string) {
+	recordLoginAttempt(LoginAttempt{
+		Username:  s.nick,
+		Success:   success,
+		Reason:    reason,
+		IP:        s.ip,
+		UserAgent: "irc",
+		Timestamp: time.Now(),
+	})
+}
+
+// channel returns a joined channel by name, or nil
+func (s *ircSession) channel(name string) *ircChannel {
+	roomID, ok := strings.CutPrefix(name, "#")
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.channels[roomID]
+}
+
+// joined returns a snapshot of the joined channels
+func (s *ircSession) joined() []*ircChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]*ircChannel, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// join runs the checks of joinRoom and subscribes to the room's hub
+func (s *ircSession) join(name string) {
+	roomID, ok := strings.CutPrefix(name, "#")
+	if !ok || roomID == "" {
+		s.numeric("403", name, "No such channel")
+		return
+	}
+	if s.channel(name) != nil {
+		return
+	}
+
+	if ok, _ := allow(wsConnectRateLimit, s.ip); !ok {
+		s.numeric("263", "JOIN", "Please wait a while and try again")
+		return
+	}
+
+	room, err := getChatroom(roomID)
+	if err != nil {
+		s.numeric("403", name, "No such channel")
+		return
+	}
+	if room.Archived {
+		s.numeric("403", name, "Chatroom is archived")
+		return
+	}
+	if isBanned(room.ID, s.username) {
+		s.numeric("474", name, "You are banned from this chatroom")
+		return
+	}
+
+	ch := &ircChannel{
+		name:   "#" + room.ID,
+		roomID: room.ID,
+		hub:    hubFor(room.ID),
+		sub:    newSubscriber(s.username),
+	}
+	s.mu.Lock()
+	s.channels[room.ID] = ch
+	s.mu.Unlock()
+
+	s.send(ircLine(ircUserPrefix(s.username), "JOIN", ch.name))
+	s.sendTopic(ch.name, room)
+
+	// The hub answers with the user list, which the pump sends on as NAMES
+	hubSend(ch.hub, ch.hub.subscribe, ch.sub)
+	go s.pump(ch)
+}
+
+// part leaves a channel on the client's request
+func (s *ircSession) part(name, reason string) {
+	ch := s.channel(name)
+	if ch == nil {
+		s.numeric("442", name, "You're not on that channel")
+		return
+	}
+	s.leave(ch)
+
+	if reason == "" {
+		s.send(ircLine(ircUserPrefix(s.username), "PART", ch.name))
+	} else {
+		s.send(ircLine(ircUserPrefix(s.username), "PART", ch.name, reason))
+	}
+}
+
+// leave unsubscribes from a channel's room
+func (s *ircSession) leave(ch *ircChannel) {
+	ch.mu.Lock()
+	ch.parted = true
+	ch.mu.Unlock()
+
+	s.mu.Lock()
+	delete(s.channels, ch.roomID)
+	s.mu.Unlock()
+
+	hubSend(ch.hub, ch.hub.unsubscribe, ch.sub)
+}
+
+func (ch *ircChannel) isParted() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.parted
+}
+
+// memberNames returns the usernames in a channel, sorted
+func (ch *ircChannel) memberNames() []string {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	names := make([]string, 0, len(ch.members))
+	for name := range ch.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pump relays a channel's hub frames to the client until the channel is
+// parted or the hub drops the subscriber
+func (s *ircSession) pump(ch *ircChannel) {
+	kickReason := ""
+	for frame := range ch.sub.frames {
+		if ch.isParted() {
+			continue
+		}
+
+		var msg map[string]interface{}
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			continue
+		}
+		msgType, _ := msg["type"].(string)
+		sender, _ := msg["sender"].(string)
+		content, _ := msg["content"].(string)
+
+		switch msgType {
+		case frameChat:
+			s.relayChat(ch, msg, sender, content)
+
+		case "userList":
+			s.updateMembers(ch, content)
+
+		case "topicChanged":
+			topic, _ := msg["topic"].(string)
+			by, _ := msg["changedBy"].(string)
+			s.send(ircLine(ircUserPrefix(by), "TOPIC", ch.name, topic))
+
+		case "kicked":
+			kickReason = content
+
+		case "system":
+			// The announcement does not say who it was. The hub sends every
+			// subscriber a fresh user list along with it, JOIN and PART
+			// come from that, so nothing is asked of the hub here.
+			if content == noticeUserJoined || content == noticeUserLeft {
+				continue
+			}
+			s.send(ircLine(ircServerName, "NOTICE", ch.name, content))
+
+		default:
+			// Errors, announcements and the like
+			if sender == "system" && content != "" {
+				s.send(ircLine(ircServerName, "NOTICE", ch.name, content))
+			}
+		}
+	}
+
+	if ch.isParted() {
+		return
+	}
+
+	// Dropped by the hub: kicked, room closed or too slow
+	s.mu.Lock()
+	if s.channels[ch.roomID] == ch {
+		delete(s.channels, ch.roomID)
+	}
+	s.mu.Unlock()
+
+	if kickReason == "" {
+		kickReason = "Disconnected from the chatroom"
+	}
+	s.send(ircLine(ircServerName, "KICK", ch.name, ircNick(s.username), kickReason))
+}
+
+// relayChat sends a chat message as PRIVMSG lines
+func (s *ircSession) relayChat(ch *ircChannel, msg map[string]interface{}, sender, content string) {
+	// Messages the session posted itself are not echoed, the client already
+	// shows them. Ones the same user sent from elsewhere are.
+	if sender == s.username {
+		id, _ := msg["id"].(float64)
+		s.postMu.Lock()
+		own := s.posted[int64(id)]
+		delete(s.posted, int64(id))
+		s.postMu.Unlock()
+		if own {
+			return
+		}
+	}
+
+	lines := strings.Split(content, "\n")
+	if attachments, ok := msg["attachments"].([]interface{}); ok {
+		for _, a := range attachments {
+			attachment, _ := a.(map[string]interface{})
+			filename, _ := attachment["filename"].(string)
+			url, _ := attachment["url"].(string)
+			lines = append(lines, fmt.Sprintf("[%s] %s", filename, url))
+		}
+	}
+
+	action, _ := msg["action"].(bool)
+	for _, line := range lines {
+		for _, text := range splitIRCText(strings.TrimRight(line, "\r"), ircMaxText) {
+			if action {
+				text = "\x01ACTION " + text + "\x01"
+			}
+			s.send(ircLine(ircUserPrefix(sender), "PRIVMSG", ch.name, text))
+		}
+	}
+}
+
+// splitIRCText cuts text into pieces of at most max bytes without splitting
+// characters
+func splitIRCText(text string, max int) []string {
+	var pieces []string
+	for len(text) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		pieces = append(pieces, text[:cut])
+		text = text[cut:]
+	}
+	if text != "" {
+		pieces = append(pieces, text)
+	}
+	return pieces
+}
+
+// updateMembers turns a user list into NAMES the first time and into JOIN
+// and PART lines for whoever came or went afterwards
+func (s *ircSession) updateMembers(ch *ircChannel, namesJSON string) {
+	var names []string
+	if err := json.Unmarshal([]byte(namesJSON), &names); err != nil {
+		return
+	}
+	current := make(map[string]bool, len(names))
+	for _, name := range names {
+		current[name] = true
+	}
+
+	ch.mu.Lock()
+	previous := ch.members
+	ch.members = current
+	ch.mu.Unlock()
+
+	if previous == nil {
+		s.sendNames(ch)
+		return
+	}
+	for name := range current {
+		if !previous[name] && name != s.username {
+			s.send(ircLine(ircUserPrefix(name), "JOIN", ch.name))
+		}
+	}
+	for name := range previous {
+		if !current[name] && name != s.username {
+			s.send(ircLine(ircUserPrefix(name), "PART", ch.name))
+		}
+	}
+}
+
+// sendNames lists a channel's members, several per line
+func (s *ircSession) sendNames(ch *ircChannel) {
+	var line []string
+	size := 0
+	for _, name := range ch.memberNames() {
+		nick := ircNick(name)
+		if size+len(nick) > ircMaxText && len(line) > 0 {
+			s.numeric("353", "=", ch.name, strings.Join(line, " "))
+			line, size = nil, 0
+		}
+		line = append(line, nick)
+		size += len(nick) + 1
+	}
+	if len(line) > 0 {
+		s.numeric("353", "=", ch.name, strings.Join(line, " "))
+	}
+	s.numeric("366", ch.name, "End of /NAMES list")
+}
+
+func (s *ircSession) sendTopic(name string, room *Chatroom) {
+	if room.Topic == "" {
+		s.numeric("331", name, "No topic is set")
+	} else {
+		s.numeric("332", name, room.Topic)
+	}
+}
+
+// privmsg posts a message to a joined channel. It returns false when the
+// client is flooding and gets disconnected.
+func (s *ircSession) privmsg(target, text string) bool {
+	ch := s.channel(target)
+	if ch == nil {
+		if strings.HasPrefix(target, "#") {
+			s.numeric("404", target, "Cannot send to channel, join it first")
+		} else {
+			s.numeric("401", target, "No such channel, only channels are supported")
+		}
+		return true
+	}
+
+	msg := map[string]interface{}{
+		"type":      frameChat,
+		"sender":    s.username,
+		"timestamp": time.Now(),
+	}
+
+	// CTCP ACTION is a /me, other CTCP requests are not answered
+	if strings.HasPrefix(text, "\x01") {
+		action, ok := strings.CutPrefix(strings.Trim(text, "\x01"), "ACTION ")
+		if !ok {
+			return true
+		}
+		text = action
+		msg["action"] = true
+	}
+	// IRC clients run slash commands themselves, so text starting with a
+	// slash is posted as is rather than dispatched
+	msg["content"] = text
+
+	if isMuted(ch.roomID, s.username) {
+		s.numeric("404", ch.name, "You are muted in this chatroom")
+		return true
+	}
+	if !s.messageLimit.allow() {
+		s.send(ircLine("", "ERROR", "Closing link: excess flood"))
+		return false
+	}
+
+	s.postMu.Lock()
+	message, err := submitChatMessage(ch.roomID, s.username, msg)
+	if err == nil {
+		var posted struct {
+			ID int64 `json:"id"`
+		}
+		if json.Unmarshal(message, &posted) == nil {
+			s.posted[posted.ID] = true
+		}
+	}
+	s.postMu.Unlock()
+
+	if err != nil {
+		var rejection *messageRejection
+		if errors.As(err, &rejection) {
+			s.numeric("404", ch.name, rejection.Message)
+		} else {
+			fmt.Printf("Error publishing message: %v\n", err)
+		}
+	}
+	return true
+}
+
+// topic shows a channel's topic or, for moderators, changes it
+func (s *ircSession) topic(params []string) {
+	ch := s.channel(params[0])
+	if ch == nil {
+		s.numeric("442", params[0], "You're not on that channel")
+		return
+	}
+
+	room, err := getChatroom(ch.roomID)
+	if err != nil {
+		s.numeric("403", ch.name, "No such channel")
+		return
+	}
+	if len(params) == 1 {
+		s.sendTopic(ch.name, room)
+		return
+	}
+
+	if roleRank(roomRole(room, s.username)) < roleRank(roleModerator) {
+		s.numeric("482", ch.name, "Only moderators can change the topic")
+		return
+	}
+	topic := normalizeText(params[1], false)
+	if utf8.RuneCountInString(topic) > rules.roomDescMax {
+		s.send(ircLine(ircServerName, "NOTICE", ch.name, fmt.Sprintf("Topic must be at most %d characters", rules.roomDescMax)))
+		return
+	}
+
+	// The hub announces the change, which comes back as TOPIC
+	if err := setRoomTopic(room, topic, s.username); err != nil {
+		fmt.Printf("Error setting topic: %v\n", err)
+	}
+}
+
+// list sends every room as a channel with its user count and name
+func (s *ircSession) list() {
+	ids, err := rdb.SMembers(ctx, "chatrooms").Result()
+	if err != nil {
+		fmt.Printf("Error fetching chatrooms: %v\n", err)
+	}
+
+	rooms := []*Chatroom{}
+	for _, id := range ids {
+		if room, err := getChatroom(id); err == nil {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+
+	s.numeric("321", "Channel", "Users  Name")
+	for _, room := range rooms {
+		summary := room.Name
+		if room.Topic != "" {
+			summary += " - " + room.Topic
+		}
+		s.numeric("322", "#"+room.ID, strconv.Itoa(room.UserCount), summary)
+	}
+	s.numeric("323", "End of /LIST")
+}
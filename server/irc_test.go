@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIRCPumpPresence(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	lines := make(chan string, 32)
+	go func() {
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	session := &ircSession{conn: server, nick: "alice", username: "alice", channels: map[string]*ircChannel{}}
+	hub := &Hub{presence: make(chan presenceRequest, 1), done: make(chan struct{})}
+	ch := &ircChannel{name: "#room", roomID: "room", hub: hub, sub: &subscriber{username: "alice", frames: make(chan []byte, 8)}}
+	session.channels[ch.roomID] = ch
+
+	frame := func(fields map[string]interface{}) []byte {
+		data, _ := json.Marshal(fields)
+		return data
+	}
+	ch.sub.frames <- frame(map[string]interface{}{"type": "userList", "content": `["alice","bob"]`})
+	ch.sub.frames <- frame(map[string]interface{}{"type": "system", "sender": "system", "content": noticeUserJoined})
+	ch.sub.frames <- frame(map[string]interface{}{"type": "userList", "content": `["alice","bob","carol"]`})
+	ch.sub.frames <- frame(map[string]interface{}{"type": "system", "sender": "system", "content": noticeUserLeft})
+	ch.sub.frames <- frame(map[string]interface{}{"type": "userList", "content": `["alice","carol"]`})
+	close(ch.sub.frames)
+
+	done := make(chan struct{})
+	go func() {
+		session.pump(ch)
+		server.Close()
+		close(done)
+	}()
+
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for collecting := true; collecting; {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				collecting = false
+				break
+			}
+			got = append(got, line)
+		case <-timeout:
+			t.Fatalf("pump did not finish, got %q", got)
+		}
+	}
+	<-done
+
+	// Join and leave notices never make the pump ask the hub for anything
+	select {
+	case req := <-hub.presence:
+		t.Errorf("pump sent a presence request %+v", req)
+	default:
+	}
+
+	want := []string{
+		":chat.local 353 alice = #room :alice bob",
+		":chat.local 366 alice #room :End of /NAMES list",
+		":carol!carol@chat.local JOIN :#room",
+		":bob!bob@chat.local PART :#room",
+		":chat.local KICK #room alice :Disconnected from the chatroom",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Lockout settings. Failures are counted per username, whether or not the
+// account exists, so lockouts do not reveal which usernames are registered.
+var (
+	loginFailureWindow = time.Duration(envInt("LOGIN_FAILURE_WINDOW_SECONDS", 900)) * time.Second
+	loginLockoutAfter  = envInt("LOGIN_LOCKOUT_AFTER", 10)
+	loginLockoutFor    = time.Duration(envInt("LOGIN_LOCKOUT_SECONDS", 900)) * time.Second
+)
+
+// Progressive delay applied to failed logins once loginDelayAfter failures
+// have been seen, doubling with every further failure up to loginMaxDelay
+const (
+	loginDelayAfter = 3
+	loginBaseDelay  = 500 * time.Millisecond
+	loginMaxDelay   = 8 * time.Second
+)
+
+// Number of audit entries kept in the global log and per user
+const (
+	maxLoginAudit     = 10000
+	maxUserLoginAudit = 100
+)
+
+// LoginAttempt is an entry in the login audit trail
+type LoginAttempt struct {
+	Username  string    `json:"username"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func loginFailuresKey(username string) string {
+	return "login:failures:" + username
+}
+
+func loginLockoutKey(username string) string {
+	return "login:lockout:" + username
+}
+
+// lockedOutFor returns how long a username remains locked out, zero if it is not
+func lockedOutFor(username string) time.Duration {
+	ttl, err := rdb.PTTL(ctx, loginLockoutKey(username)).Result()
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// recordLoginFailure counts a failure, locks the account when the threshold
+// is reached and returns the delay to apply before answering
+func recordLoginFailure(username string) time.Duration {
+	pipe := rdb.TxPipeline()
+	incr := pipe.Incr(ctx, loginFailuresKey(username))
+	pipe.Expire(ctx, loginFailuresKey(username), loginFailureWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		fmt.Printf("Error recording login failure: %v\n", err)
+		return 0
+	}
+
+	failures := incr.Val()
+	if loginLockoutAfter > 0 && failures >= loginLockoutAfter {
+		if err := rdb.Set(ctx, loginLockoutKey(username), 1, loginLockoutFor).Err(); err != nil {
+			fmt.Printf("Error locking account: %v\n", err)
+		}
+		rdb.Del(ctx, loginFailuresKey(username))
+	}
+
+	if failures < loginDelayAfter {
+		return 0
+	}
+	delay := loginBaseDelay << min(failures-loginDelayAfter, 8)
+	return min(delay, loginMaxDelay)
+}
+
+// clearLoginFailures resets the failure count after a successful login
+func clearLoginFailures(username string) {
+	if err := rdb.Del(ctx, loginFailuresKey(username)).Err(); err != nil {
+		fmt.Printf("Error clearing login failures: %v\n", err)
+	}
+}
+
+// auditLogin appends a login attempt to the global and per-user audit trails
+func auditLogin(r *http.Request, username string, success bool, reason string) {
+	recordLoginAttempt(LoginAttempt{
+		Username:  username,
+		Success:   success,
+		Reason:    reason,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Timestamp: time.Now(),
+	})
+}
+
+// recordLoginAttempt stores an attempt, also for logins made outside of HTTP
+func recordLoginAttempt(attempt LoginAttempt) {
+	attemptJSON, err := json.Marshal(attempt)
+	if err != nil {
+		fmt.Printf("Error marshalling login audit: %v\n", err)
+		return
+	}
+
+	// Only existing accounts get a trail of their own, otherwise every made
+	// up username would leave a list behind
+	isUser, err := rdb.SIsMember(ctx, "users", attempt.Username).Result()
+	if err != nil {
+		fmt.Printf("Error checking user: %v\n", err)
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.LPush(ctx, "audit:logins", attemptJSON)
+	pipe.LTrim(ctx, "audit:logins", 0, maxLoginAudit-1)
+	if isUser {
+		pipe.LPush(ctx, "audit:logins:"+attempt.Username, attemptJSON)
+		pipe.LTrim(ctx, "audit:logins:"+attempt.Username, 0, maxUserLoginAudit-1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		fmt.Printf("Error storing login audit: %v\n", err)
+	}
+}
+
+// loginAuditHandler lets admins query the login audit trail, newest first.
+// Query parameters: username, success (true/false) and limit.
+func loginAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLoginAudit {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	key := "audit:logins"
+	if username := r.URL.Query().Get("username"); username != "" {
+		key = "audit:logins:" + username
+	}
+
+	successFilter := r.URL.Query().Get("success")
+
+	stored, err := rdb.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching login audit")
+		return
+	}
+
+	attempts := []LoginAttempt{}
+	for _, entry := range stored {
+		if len(attempts) == limit {
+			break
+		}
+
+		var attempt LoginAttempt
+		if err := json.Unmarshal([]byte(entry), &attempt); err != nil {
+			continue // Skip entries that cannot be parsed
+		}
+		if successFilter != "" && strconv.FormatBool(attempt.Success) != successFilter {
+			continue
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"attempts": attempts,
+	})
+}
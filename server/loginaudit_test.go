@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordLoginAttempt(t *testing.T) {
+	useTestRedis(t)
+
+	if err := rdb.SAdd(ctx, "users", "alice").Err(); err != nil {
+		t.Fatalf("adding user: %v", err)
+	}
+
+	cases := []struct {
+		name      string
+		username  string
+		wantTrail int64
+	}{
+		{"existing user", "alice", 1},
+		{"unknown user", "mallory", 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			recordLoginAttempt(LoginAttempt{Username: tc.username, Reason: "invalid_password", Timestamp: time.Now()})
+
+			if n := rdb.LLen(ctx, "audit:logins:"+tc.username).Val(); n != tc.wantTrail {
+				t.Errorf("per-user trail has %d entries, want %d", n, tc.wantTrail)
+			}
+		})
+	}
+
+	if n := rdb.LLen(ctx, "audit:logins").Val(); n != int64(len(cases)) {
+		t.Errorf("global trail has %d entries, want %d", n, len(cases))
+	}
+}
+
+func TestRecordLoginFailure(t *testing.T) {
+	useTestRedis(t)
+
+	for i := int64(1); i < loginLockoutAfter; i++ {
+		recordLoginFailure("alice")
+		if lockedOutFor("alice") > 0 {
+			t.Fatalf("locked out after %d failures, want %d", i, loginLockoutAfter)
+		}
+	}
+
+	recordLoginFailure("alice")
+	if lockedOutFor("alice") == 0 {
+		t.Errorf("not locked out after %d failures", loginLockoutAfter)
+	}
+	if lockedOutFor("bob") > 0 {
+		t.Errorf("lockout leaked to another user")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// messageRejection explains why a chat message was not published. It is sent
+// back privately to the sender.
+type messageRejection struct {
+	Code    string
+	Message string
+}
+
+func (e *messageRejection) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// submitChatMessage runs a chat message through validation and the room's
+// filters and publishes it. username is the authenticated sender, empty for
+// integrations posting under a name set by the server. Rejected messages
+// return a *messageRejection.
+func submitChatMessage(roomID, username string, msg map[string]interface{}) ([]byte, error) {
+	content, _ := msg["content"].(string)
+	content, errs := validateMessageContent(content)
+	if len(errs) > 0 {
+		return nil, &messageRejection{Code: errs[0].Code, Message: errs[0].Message}
+	}
+
+	// Integrations are told apart by the sender name they were configured with
+	sender := username
+	if sender == "" {
+		sender, _ = msg["sender"].(string)
+	}
+
+	result := runFilters(roomID, sender, content)
+	switch result.verdict {
+	case verdictReject:
+		return nil, &messageRejection{Code: errCodeMessageRejected, Message: result.reason}
+
+	case verdictQuarantine:
+		msg["content"] = result.content
+		if err := quarantineMessage(roomID, username, sender, result, msg); err != nil {
+			return nil, err
+		}
+		return nil, &messageRejection{Code: errCodeMessageQuarantined, Message: "Your message is held for review by a moderator"}
+	}
+
+	msg["content"] = result.content
+	return publishChatMessage(roomID, username, msg)
+}
+
+// publishChatMessage assigns a message id, stores the message in the room
+// history and broadcasts it to the room's hub if anyone is connected
+func publishChatMessage(roomID, username string, msg map[string]interface{}) ([]byte, error) {
+	msg["type"] = frameChat
+
+	messageID, err := nextMessageID(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("assigning message id: %w", err)
+	}
+	msg["id"] = messageID
+
+	// Search filters and orders by timestamp, so clients must not be able to
+	// backdate a message or pin it to the top of results
+	msg["timestamp"] = time.Now()
+
+	// The account behind a message is recorded by the server, so moderation
+	// never acts on a name the client made up
+	delete(msg, "author")
+	if username != "" {
+		msg["author"] = username
+		msg["senderProfile"] = profileSnippet(username)
+
+		// Senders have obviously read their own message
+		if _, _, err := markRead(roomID, username, messageID); err != nil {
+			fmt.Printf("Error updating read marker: %v\n", err)
+		}
+	}
+
+	// Replace attachment ids with their metadata and download URLs
+	if refs, ok := msg["attachments"].([]interface{}); ok {
+		msg["attachments"] = resolveAttachments(roomID, refs)
+	}
+
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := appendHistory(roomID, messageID, message); err != nil {
+		fmt.Printf("Error storing message history: %v\n", err)
+	}
+
+	if hub := lookupHub(roomID); hub != nil {
+		hubSend(hub, hub.broadcast, message)
+	}
+	emitRoomEvent(roomID, eventMessagePosted, json.RawMessage(message))
+	bridgeToMQTT(roomID, message)
+	return message, nil
+}
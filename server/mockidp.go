@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The mock identity provider is a minimal OpenID Connect server mounted under
+// /mock-idp for local development and for testing the SSO login flow. It
+// signs in whoever types a name, so never enable it in production.
+var (
+	mockIDPEnabled      = envOr("OIDC_MOCK_IDP", "false") == "true"
+	mockIDPIssuer       = envOr("OIDC_MOCK_ISSUER", "http://localhost:8080/mock-idp")
+	mockIDPClientID     = envOr("OIDC_MOCK_CLIENT_ID", "chat-dev")
+	mockIDPClientSecret = envOr("OIDC_MOCK_CLIENT_SECRET", "chat-dev-secret")
+)
+
+const (
+	mockIDPName    = "mock"
+	mockIDPCodeTTL = time.Minute
+	mockIDPKeyID   = "mock-1"
+)
+
+type mockAuthCode struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	username    string
+	expiresAt   time.Time
+}
+
+type mockIDP struct {
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuthCode
+}
+
+var mockLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><body>
+<h1>Mock identity provider</h1>
+<form method="GET">
+{{range $name, $values := .}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<label>Username <input name="login_hint" autofocus></label>
+<button type="submit">Sign in</button>
+</form>
+</body></html>
+`))
+
+func newMockIDP() (*mockIDP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &mockIDP{key: key, codes: map[string]mockAuthCode{}}, nil
+}
+
+// registerMockIDP mounts the mock provider's endpoints on mux
+func registerMockIDP(mux *http.ServeMux) error {
+	idp, err := newMockIDP()
+	if err != nil {
+		return err
+	}
+
+	mux.HandleFunc("/mock-idp/.well-known/openid-configuration", idp.discoveryHandler)
+	mux.HandleFunc("/mock-idp/jwks", idp.jwksHandler)
+	mux.HandleFunc("/mock-idp/authorize", idp.authorizeHandler)
+	mux.HandleFunc("/mock-idp/token", idp.tokenHandler)
+	return nil
+}
+
+func (idp *mockIDP) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                mockIDPIssuer,
+		"authorization_endpoint":                mockIDPIssuer + "/authorize",
+		"token_endpoint":                        mockIDPIssuer + "/token",
+		"jwks_uri":                              mockIDPIssuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (idp *mockIDP) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	pub := idp.key.PublicKey
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": mockIDPKeyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// authorizeHandler shows a one field login form, or signs in straight away
+// when a login_hint is present so scripted tests can follow the redirects
+func (idp *mockIDP) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != mockIDPClientID || query.Get("response_type") != "code" {
+		http.Error(w, "unknown client or unsupported response type", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	username := query.Get("login_hint")
+	if username == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mockLoginPage.Execute(w, query)
+		return
+	}
+
+	code, err := randomToken(16)
+	if err != nil {
+		http.Error(w, "error generating code", http.StatusInternalServerError)
+		return
+	}
+
+	// Codes that were never redeemed are dropped here, so abandoned logins
+	// do not pile up
+	now := time.Now()
+	idp.mu.Lock()
+	for c, grant := range idp.codes {
+		if now.After(grant.expiresAt) {
+			delete(idp.codes, c)
+		}
+	}
+	idp.codes[code] = mockAuthCode{
+		clientID:    query.Get("client_id"),
+		redirectURI: query.Get("redirect_uri"),
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+		username:    username,
+		expiresAt:   now.Add(mockIDPCodeTTL),
+	}
+	idp.mu.Unlock()
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (idp *mockIDP) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	if r.FormValue("grant_type") != "authorization_code" {
+		tokenError("unsupported_grant_type")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if clientID != mockIDPClientID || clientSecret != mockIDPClientSecret {
+		tokenError("invalid_client")
+		return
+	}
+
+	// Codes are single use
+	idp.mu.Lock()
+	grant, found := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	idp.mu.Unlock()
+
+	if !found || time.Now().After(grant.expiresAt) || grant.clientID != clientID || grant.redirectURI != r.FormValue("redirect_uri") {
+		tokenError("invalid_grant")
+		return
+	}
+
+	if grant.challenge != "" {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			tokenError("invalid_grant")
+			return
+		}
+	}
+
+	now := time.Now()
+	idToken, err := idp.sign(map[string]interface{}{
+		"iss":                mockIDPIssuer,
+		"sub":                "mock|" + grant.username,
+		"aud":                clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              grant.nonce,
+		"email":              grant.username + "@mock-idp.local",
+		"email_verified":     true,
+		"preferred_username": grant.username,
+		"name":               grant.username,
+	})
+	if err != nil {
+		http.Error(w, "error signing token", http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, _ := randomToken(16)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// sign produces a compact RS256 JWT
+func (idp *mockIDP) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": mockIDPKeyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing id token: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// Room roles, from most to least privileged
+const (
+	roleAdmin     = "admin"
+	roleOwner     = "owner"
+	roleModerator = "moderator"
+	roleMember    = "member"
+)
+
+// Moderation actions accepted by moderationHandler
+const (
+	actionKick            = "kick"
+	actionBan             = "ban"
+	actionUnban           = "unban"
+	actionMute            = "mute"
+	actionUnmute          = "unmute"
+	actionAddModerator    = "addModerator"
+	actionRemoveModerator = "removeModerator"
+)
+
+// maxModerationLog is the number of moderation log entries kept per room
+const maxModerationLog = 1000
+
+// Restriction is an active ban or mute of a user in a room
+type Restriction struct {
+	Username  string     `json:"username"`
+	Reason    string     `json:"reason,omitempty"`
+	By        string     `json:"by"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // nil for permanent restrictions
+}
+
+// ModerationEntry is an entry in a room's moderation log
+type ModerationEntry struct {
+	Action          string    `json:"action"`
+	Username        string    `json:"username"`
+	By              string    `json:"by"`
+	Reason          string    `json:"reason,omitempty"`
+	DurationSeconds int64     `json:"durationSeconds,omitempty"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// kickRequest asks a hub to disconnect every connection of a user
+type kickRequest struct {
+	username string
+	reason   string
+}
+
+func roomModeratorsKey(roomID string) string {
+	return "chatroom:" + roomID + ":moderators"
+}
+
+func roomBansKey(roomID string) string {
+	return "chatroom:" + roomID + ":bans"
+}
+
+func roomMutesKey(roomID string) string {
+	return "chatroom:" + roomID + ":mutes"
+}
+
+func roomModLogKey(roomID string) string {
+	return "chatroom:" + roomID + ":modlog"
+}
+
+// roomRole returns the role of a user in a room
+func roomRole(room *Chatroom, username string) string {
+	switch {
+	case username == "":
+		return roleMember
+	case isAdmin(username):
+		return roleAdmin
+	case room.CreatorID == username:
+		return roleOwner
+	}
+
+	isMod, err := rdb.SIsMember(ctx, roomModeratorsKey(room.ID), username).Result()
+	if err != nil {
+		fmt.Printf("Error checking moderator role: %v\n", err)
+	}
+	if isMod {
+		return roleModerator
+	}
+	return roleMember
+}
+
+// roleRank orders roles so moderators cannot act on their peers or superiors
+func roleRank(role string) int {
+	switch role {
+	case roleAdmin:
+		return 3
+	case roleOwner:
+		return 2
+	case roleModerator:
+		return 1
+	}
+	return 0
+}
+
+// activeRestriction returns the ban or mute stored in key for a user, if it
+// has not expired yet. Expired restrictions are cleaned up on the way.
+func activeRestriction(key, username string) (*Restriction, error) {
+	if username == "" {
+		return nil, nil
+	}
+
+	restrictionJSON, err := rdb.HGet(ctx, key, username).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	restriction, err := parseRestriction(restrictionJSON)
+	if err != nil {
+		return nil, err
+	}
+	if restriction == nil {
+		rdb.HDel(ctx, key, username)
+	}
+	return restriction, nil
+}
+
+// parseRestriction decodes a stored restriction, returning nil once it has
+// expired
+func parseRestriction(restrictionJSON string) (*Restriction, error) {
+	var restriction Restriction
+	if err := json.Unmarshal([]byte(restrictionJSON), &restriction); err != nil {
+		return nil, err
+	}
+
+	if restriction.ExpiresAt != nil && time.Now().After(*restriction.ExpiresAt) {
+		return nil, nil
+	}
+	return &restriction, nil
+}
+
+// listRestrictions returns the active bans or mutes stored in key
+func listRestrictions(key string) []Restriction {
+	stored, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		fmt.Printf("Error listing restrictions: %v\n", err)
+	}
+
+	restrictions := []Restriction{}
+	for username := range stored {
+		restriction, err := activeRestriction(key, username)
+		if err != nil || restriction == nil {
+			continue
+		}
+		restrictions = append(restrictions, *restriction)
+	}
+	return restrictions
+}
+
+func isBanned(roomID, username string) bool {
+	ban, err := activeRestriction(roomBansKey(roomID), username)
+	if err != nil {
+		fmt.Printf("Error checking ban: %v\n", err)
+	}
+	return ban != nil
+}
+
+// readableRoom answers the request and returns nil unless the room exists and
+// the user is not banned from it
+func readableRoom(w http.ResponseWriter, roomID, username string) *Chatroom {
+	room, err := getChatroom(roomID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+		return nil
+	}
+	if isBanned(room.ID, username) {
+		writeError(w, http.StatusForbidden, errCodeBanned, "You are banned from this chatroom")
+		return nil
+	}
+	return room
+}
+
+func isMuted(roomID, username string) bool {
+	mute, err := activeRestriction(roomMutesKey(roomID), username)
+	if err != nil {
+		fmt.Printf("Error checking mute: %v\n", err)
+	}
+	return mute != nil
+}
+
+// restrictUser stores a ban or mute in key. A zero duration is permanent.
+func restrictUser(key, username, by, reason string, duration time.Duration) error {
+	now := time.Now()
+	restriction := Restriction{Username: username, Reason: reason, By: by, CreatedAt: now}
+	if duration > 0 {
+		expiresAt := now.Add(duration)
+		restriction.ExpiresAt = &expiresAt
+	}
+
+	restrictionJSON, err := json.Marshal(restriction)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, key, username, restrictionJSON).Err()
+}
+
+// banUser bans a user from a room and disconnects them
+func banUser(roomID, username, by, reason string, duration time.Duration) error {
+	if err := restrictUser(roomBansKey(roomID), username, by, reason, duration); err != nil {
+		return err
+	}
+	kickUser(roomID, username, reason)
+	return nil
+}
+
+// logModeration appends an entry to a room's moderation log
+func logModeration(roomID string, entry ModerationEntry) {
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("Error marshalling moderation entry: %v\n", err)
+		return
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.LPush(ctx, roomModLogKey(roomID), entryJSON)
+	pipe.LTrim(ctx, roomModLogKey(roomID), 0, maxModerationLog-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		fmt.Printf("Error storing moderation entry: %v\n", err)
+	}
+}
+
+// kickUser disconnects a user from a room if the room has a running hub
+func kickUser(roomID, username, reason string) {
+	if hub := lookupHub(roomID); hub != nil {
+		hubSend(hub, hub.kick, kickRequest{username: username, reason: reason})
+	}
+}
+
+// handleKick closes every connection a user has open in the hub
+func (h *Hub) handleKick(req kickRequest) {
+	frame := map[string]interface{}{
+		"type":      "kicked",
+		"content":   req.reason,
+		"sender":    "system",
+		"timestamp": time.Now(),
+	}
+	frameJSON, _ := json.Marshal(frame)
+
+	kicked := 0
+	for conn, client := range h.clients {
+		if client.username != req.username {
+			continue
+		}
+
+		h.writeTo(client, newFrameCache(frameJSON))
+		closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "removed by a moderator")
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		conn.Close()
+
+		delete(h.clients, conn)
+		h.clearTyping(conn)
+		h.emitPresenceEvent(eventUserLeft, client.username, client.id)
+		kicked++
+	}
+	for sub := range h.subscribers {
+		if sub.username != req.username {
+			continue
+		}
+
+		h.deliver(sub, frameJSON)
+		h.dropSubscriber(sub)
+		h.emitPresenceEvent(eventUserLeft, sub.username, sub.id)
+		kicked++
+	}
+
+	if kicked > 0 {
+		h.updateUserCount(-kicked)
+		h.sendSystemMessage(req.username + " was removed from the chat")
+		h.broadcastUserList()
+	}
+}
+
+// moderatorRoom authenticates the caller and loads a room they moderate.
+// It writes the error response and returns nil when that fails.
+func moderatorRoom(w http.ResponseWriter, r *http.Request, roomID string) (*Chatroom, string) {
+	return roomWithRole(w, r, roomID, roleModerator)
+}
+
+// roomWithRole authenticates the caller and loads a room in which they have
+// at least the given role
+func roomWithRole(w http.ResponseWriter, r *http.Request, roomID, minRole string) (*Chatroom, string) {
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return nil, ""
+	}
+
+	room, err := getChatroom(roomID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+		return nil, ""
+	}
+
+	if roleRank(roomRole(room, username)) < roleRank(minRole) {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "Room "+minRole+" access required")
+		return nil, ""
+	}
+	return room, username
+}
+
+// moderationHandler serves GET (moderators, bans and mutes of a room) and
+// POST (perform a moderation action) on /api/chatrooms/moderation
+func moderationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	var req struct {
+		RoomID          string `json:"roomId"`
+		Action          string `json:"action"`
+		Username        string `json:"username"`
+		Reason          string `json:"reason"`
+		DurationSeconds int64  `json:"durationSeconds"` // bans and mutes only, 0 is permanent
+	}
+
+	if r.Method == http.MethodGet {
+		req.RoomID = r.URL.Query().Get("roomId")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	room, err := getChatroom(req.RoomID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+		return
+	}
+
+	role := roomRole(room, username)
+	if roleRank(role) < roleRank(roleModerator) {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "Moderator access required")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		moderators, err := rdb.SMembers(ctx, roomModeratorsKey(room.ID)).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching moderators")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"owner":      room.CreatorID,
+			"moderators": moderators,
+			"bans":       listRestrictions(roomBansKey(room.ID)),
+			"mutes":      listRestrictions(roomMutesKey(room.ID)),
+		})
+		return
+	}
+
+	if req.Username == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Username is required")
+		return
+	}
+	if req.DurationSeconds < 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Duration must not be negative")
+		return
+	}
+
+	// Moderators cannot act on their peers or on the room owner
+	if roleRank(roomRole(room, req.Username)) >= roleRank(role) {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "Cannot moderate a user with an equal or higher role")
+		return
+	}
+
+	duration := time.Duration(req.DurationSeconds) * time.Second
+
+	switch req.Action {
+	case actionKick:
+		kickUser(room.ID, req.Username, req.Reason)
+
+	case actionBan:
+		err = banUser(room.ID, req.Username, username, req.Reason, duration)
+
+	case actionUnban:
+		err = rdb.HDel(ctx, roomBansKey(room.ID), req.Username).Err()
+
+	case actionMute:
+		err = restrictUser(roomMutesKey(room.ID), req.Username, username, req.Reason, duration)
+
+	case actionUnmute:
+		err = rdb.HDel(ctx, roomMutesKey(room.ID), req.Username).Err()
+
+	case actionAddModerator, actionRemoveModerator:
+		// Only the owner (or an admin) hands out moderator rights
+		if roleRank(role) < roleRank(roleOwner) {
+			writeError(w, http.StatusForbidden, errCodeForbidden, "Only the room owner can change moderators")
+			return
+		}
+		if req.Action == actionAddModerator {
+			err = rdb.SAdd(ctx, roomModeratorsKey(room.ID), req.Username).Err()
+		} else {
+			err = rdb.SRem(ctx, roomModeratorsKey(room.ID), req.Username).Err()
+		}
+
+	default:
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Unknown moderation action")
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error applying moderation action")
+		return
+	}
+
+	entry := ModerationEntry{
+		Action:    req.Action,
+		Username:  req.Username,
+		By:        username,
+		Reason:    req.Reason,
+		Timestamp: time.Now(),
+	}
+	if req.Action == actionBan || req.Action == actionMute {
+		entry.DurationSeconds = req.DurationSeconds
+	}
+	logModeration(room.ID, entry)
+	if req.Action == actionAddModerator || req.Action == actionRemoveModerator {
+		emitRoomUpdated(room)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"entry":   entry,
+	})
+}
+
+// moderationLogHandler returns a room's moderation log, newest first
+func moderationLogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	room, _ := moderatorRoom(w, r, r.URL.Query().Get("roomId"))
+	if room == nil {
+		return
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxModerationLog {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	stored, err := rdb.LRange(ctx, roomModLogKey(room.ID), 0, int64(limit-1)).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching moderation log")
+		return
+	}
+
+	entries := []ModerationEntry{}
+	for _, entryJSON := range stored {
+		var entry ModerationEntry
+		if err := json.Unmarshal([]byte(entryJSON), &entry); err != nil {
+			continue // Skip entries that cannot be parsed
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+	})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// MQTT bridge between device topics and chatrooms. Messages published on a
+// route's subscribe topic are posted to its room through submitChatMessage,
+// and chat messages posted to the room are published on its publish topic.
+// For local development an embedded broker can be started in-process.
+var (
+	mqttBrokerURL      = envOr("MQTT_BROKER_URL", "")
+	mqttClientID       = envOr("MQTT_CLIENT_ID", "chat-bridge")
+	mqttUsername       = envOr("MQTT_USERNAME", "")
+	mqttPassword       = envOr("MQTT_PASSWORD", "")
+	mqttEmbeddedBroker = envOr("MQTT_EMBEDDED_BROKER", "false") == "true"
+	mqttEmbeddedAddr   = envOr("MQTT_EMBEDDED_ADDR", "127.0.0.1:1883")
+)
+
+// mqttInboundRateLimit limits how fast each route may post into its room
+var mqttInboundRateLimit = loadRatePolicy("mqtt_inbound", 60, time.Minute)
+
+// mqttMaxPayload is the largest device message posted into a room. The whole
+// payload is kept with the message, so it bounds what a device adds to history.
+var mqttMaxPayload = int(envInt("MQTT_MAX_PAYLOAD_BYTES", 8<<10))
+
+// mqttRoute maps MQTT topics to a room. Either direction may be left out.
+type mqttRoute struct {
+	Name      string
+	RoomID    string
+	Subscribe string // topic filter posted into the room, wildcards allowed
+	Publish   string // topic the room's chat messages are published on
+	QoS       byte
+	Sender    string // sender name of posted messages, the topic when empty
+}
+
+// mqttBridge is the running bridge, nil when it is disabled
+type mqttBridge struct {
+	client   paho.Client
+	routes   []*mqttRoute
+	outbound map[string][]*mqttRoute // by room id
+	// published are the topics the bridge publishes on. Messages arriving on
+	// them are the bridge's own coming back through an overlapping filter.
+	published map[string]bool
+}
+
+var bridge *mqttBridge
+
+// loadMQTTRoutes reads routes from the environment:
+//
+//	MQTT_ROUTES=greenhouse
+//	MQTT_ROUTE_GREENHOUSE_ROOM=chatroom_1700000000
+//	MQTT_ROUTE_GREENHOUSE_SUBSCRIBE=sensors/greenhouse/+
+//	MQTT_ROUTE_GREENHOUSE_PUBLISH=chat/greenhouse
+//	MQTT_ROUTE_GREENHOUSE_QOS=1
+//	MQTT_ROUTE_GREENHOUSE_SENDER=greenhouse
+func loadMQTTRoutes() []*mqttRoute {
+	routes := []*mqttRoute{}
+	for name := range parseList(envOr("MQTT_ROUTES", "")) {
+		prefix := "MQTT_ROUTE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		route := &mqttRoute{
+			Name:      name,
+			RoomID:    envOr(prefix+"ROOM", ""),
+			Subscribe: envOr(prefix+"SUBSCRIBE", ""),
+			Publish:   envOr(prefix+"PUBLISH", ""),
+			Sender:    envOr(prefix+"SENDER", ""),
+		}
+
+		qos, err := strconv.Atoi(envOr(prefix+"QOS", "0"))
+		switch {
+		case route.RoomID == "":
+			fmt.Printf("Skipping MQTT route %s: a room is required\n", name)
+			continue
+		case route.Subscribe == "" && route.Publish == "":
+			fmt.Printf("Skipping MQTT route %s: a subscribe or publish topic is required\n", name)
+			continue
+		case strings.ContainsAny(route.Publish, "+#"):
+			fmt.Printf("Skipping MQTT route %s: the publish topic cannot contain wildcards\n", name)
+			continue
+		case err != nil || qos < 0 || qos > 2:
+			fmt.Printf("Skipping MQTT route %s: QoS must be 0, 1 or 2\n", name)
+			continue
+		}
+		route.QoS = byte(qos)
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// startMQTTBridge starts the embedded broker if enabled and connects the
+// bridge. The client keeps retrying in the background until the broker is
+// reachable and subscribes again after every reconnect.
+func startMQTTBridge() error {
+	if mqttEmbeddedBroker {
+		if _, err := startEmbeddedBroker(mqttEmbeddedAddr); err != nil {
+			return err
+		}
+		if mqttBrokerURL == "" {
+			mqttBrokerURL = "tcp://" + mqttEmbeddedAddr
+		}
+	}
+	if mqttBrokerURL == "" {
+		return nil
+	}
+
+	b := newMQTTBridge(loadMQTTRoutes())
+	for _, route := range b.routes {
+		if _, err := getChatroom(route.RoomID); err != nil {
+			fmt.Printf("MQTT route %s points at unknown room %s\n", route.Name, route.RoomID)
+		}
+	}
+	b.connect(mqttBrokerURL)
+
+	bridge = b
+	return nil
+}
+
+func newMQTTBridge(routes []*mqttRoute) *mqttBridge {
+	b := &mqttBridge{
+		routes:    routes,
+		outbound:  make(map[string][]*mqttRoute),
+		published: make(map[string]bool),
+	}
+	for _, route := range routes {
+		if route.Publish != "" {
+			b.outbound[route.RoomID] = append(b.outbound[route.RoomID], route)
+			b.published[route.Publish] = true
+		}
+	}
+	return b
+}
+
+// connect creates the bridge's client and starts connecting to the broker
+func (b *mqttBridge) connect(brokerURL string) paho.Token {
+	opts := paho.NewClientOptions().
+		AddBroker(brokerURL).
+		SetClientID(mqttClientID).
+		SetUsername(mqttUsername).
+		SetPassword(mqttPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			fmt.Printf("MQTT connection lost: %v\n", err)
+		})
+	b.client = paho.NewClient(opts)
+	return b.client.Connect()
+}
+
+// subscribe subscribes to the inbound topic of every route
+func (b *mqttBridge) subscribe(client paho.Client) {
+	fmt.Println("Connected to MQTT broker", mqttBrokerURL)
+	for _, route := range b.routes {
+		if route.Subscribe == "" {
+			continue
+		}
+		token := client.Subscribe(route.Subscribe, route.QoS, func(_ paho.Client, m paho.Message) {
+			b.handleInbound(route, m)
+		})
+		go func() {
+			if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+				fmt.Printf("Error subscribing MQTT route %s: %v\n", route.Name, token.Error())
+			}
+		}()
+	}
+}
+
+// handleInbound posts a device message to the route's room. JSON payloads
+// are attached as data, with their content field used as the text if set.
+func (b *mqttBridge) handleInbound(route *mqttRoute, m paho.Message) {
+	// The bridge's own messages come back on overlapping topics. Loops are
+	// recognised by topic, the payload is the device's to choose.
+	if b.published[m.Topic()] {
+		return
+	}
+
+	payload := m.Payload()
+	if len(payload) > mqttMaxPayload {
+		fmt.Printf("Dropping MQTT message on %s: payload is larger than %d bytes\n", m.Topic(), mqttMaxPayload)
+		return
+	}
+	if !utf8.Valid(payload) {
+		fmt.Printf("Dropping MQTT message on %s: payload is not UTF-8\n", m.Topic())
+		return
+	}
+
+	content := string(payload)
+	var data interface{}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		data = nil
+	}
+	if obj, ok := data.(map[string]interface{}); ok {
+		if text, ok := obj["content"].(string); ok {
+			content = text
+		}
+	}
+
+	if ok, _ := allow(mqttInboundRateLimit, route.Name); !ok {
+		fmt.Printf("Dropping MQTT message on %s: route %s is over its rate limit\n", m.Topic(), route.Name)
+		return
+	}
+
+	room, err := getChatroom(route.RoomID)
+	if err != nil || room.Archived {
+		fmt.Printf("Dropping MQTT message on %s: room %s is missing or archived\n", m.Topic(), route.RoomID)
+		return
+	}
+
+	sender := route.Sender
+	if sender == "" {
+		sender = m.Topic()
+	}
+	msg := map[string]interface{}{
+		"type":      frameChat,
+		"sender":    sender,
+		"content":   content,
+		"timestamp": time.Now(),
+		"mqtt": map[string]interface{}{
+			"route": route.Name,
+			"topic": m.Topic(),
+		},
+	}
+	if data != nil {
+		msg["data"] = data
+	}
+
+	if _, err := submitChatMessage(room.ID, "", msg); err != nil {
+		fmt.Printf("Error posting MQTT message on %s: %v\n", m.Topic(), err)
+	}
+}
+
+// bridgeToMQTT publishes a room's chat message on the topics routed out of
+// the room. Messages are not sent back out through the route they came in on.
+func bridgeToMQTT(roomID string, message []byte) {
+	if bridge == nil || len(bridge.outbound[roomID]) == 0 {
+		return
+	}
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return
+	}
+	origin, _ := msg["mqtt"].(map[string]interface{})
+	msg["roomId"] = roomID
+	msg["bridge"] = mqttClientID
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Printf("Error marshalling MQTT message: %v\n", err)
+		return
+	}
+
+	for _, route := range bridge.outbound[roomID] {
+		if origin != nil && origin["route"] == route.Name {
+			continue
+		}
+		// Publishing is asynchronous, paho queues while reconnecting
+		bridge.client.Publish(route.Publish, route.QoS, false, payload)
+	}
+}
+
+// startEmbeddedBroker runs an MQTT broker in-process that lets every client
+// connect and publish. It is meant for local development and tests only.
+func startEmbeddedBroker(addr string) (*mochi.Server, error) {
+	broker := mochi.New(nil)
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		return nil, err
+	}
+	if err := broker.AddListener(listeners.NewTCP(listeners.Config{ID: "embedded", Address: addr})); err != nil {
+		return nil, err
+	}
+	if err := broker.Serve(); err != nil {
+		return nil, err
+	}
+	fmt.Println("Embedded MQTT broker listening on", addr)
+	return broker, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// waitFor polls cond until it holds or a few seconds have passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	useTestRedis(t)
+	room := testRoom(t, "alice")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	broker, err := startEmbeddedBroker(addr)
+	if err != nil {
+		t.Fatalf("starting embedded broker: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	b := newMQTTBridge([]*mqttRoute{{Name: "devices", RoomID: room.ID, Subscribe: "devices/#", Publish: "devices/chat", QoS: 1}})
+	if token := b.connect("tcp://" + addr); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connecting the bridge: %v", token.Error())
+	}
+	previous := bridge
+	bridge = b
+	t.Cleanup(func() {
+		b.client.Disconnect(100)
+		bridge = previous
+	})
+	waitFor(t, "the bridge to subscribe", func() bool {
+		return len(broker.Topics.Subscribers("devices/probe").Subscriptions) > 0
+	})
+
+	device := paho.NewClient(paho.NewClientOptions().AddBroker("tcp://" + addr).SetClientID("device"))
+	if token := device.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connecting the device: %v", token.Error())
+	}
+	defer device.Disconnect(100)
+	publish := func(topic, payload string) {
+		t.Helper()
+		if token := device.Publish(topic, 1, false, payload); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			t.Fatalf("publishing on %s: %v", topic, token.Error())
+		}
+	}
+
+	// Oversized payloads are dropped
+	publish("devices/big", `{"content":"big","data":"`+strings.Repeat("x", mqttMaxPayload)+`"}`)
+
+	// A device cannot get its message dropped by claiming to be the bridge
+	publish("devices/sensor", `{"content":"from device","bridge":"`+mqttClientID+`"}`)
+
+	// Room messages are published once and not posted again when they come
+	// back through the devices/# subscription
+	echoed := make(chan struct{}, 1)
+	device.Subscribe("devices/chat", 1, func(paho.Client, paho.Message) { echoed <- struct{}{} }).Wait()
+	if _, err := submitChatMessage(room.ID, "alice", map[string]interface{}{"type": frameChat, "content": "hi devices"}); err != nil {
+		t.Fatalf("posting: %v", err)
+	}
+	select {
+	case <-echoed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("room message was not published")
+	}
+
+	// Messages from one publisher arrive in order, so once this one is in
+	// the history every earlier one has been handled
+	publish("devices/sensor", `{"content":"sentinel"}`)
+
+	var contents []string
+	waitFor(t, "the sentinel message", func() bool {
+		stored, _ := rdb.LRange(ctx, roomMessagesKey(room.ID), 0, -1).Result()
+		contents = contents[:0]
+		for _, messageJSON := range stored {
+			var msg map[string]interface{}
+			json.Unmarshal([]byte(messageJSON), &msg)
+			content, _ := msg["content"].(string)
+			contents = append(contents, content)
+		}
+		return len(contents) > 0 && contents[len(contents)-1] == "sentinel"
+	})
+
+	want := []string{"from device", "hi devices", "sentinel"}
+	if strings.Join(contents, "|") != strings.Join(want, "|") {
+		t.Errorf("history = %q, want %q", contents, want)
+	}
+}
@@ -0,0 +1,718 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// OIDCProvider is an OpenID Connect identity provider users can log in with.
+// Endpoints and signing keys are discovered from the issuer on first use.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the ID token claims the login flow relies on
+type oidcClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	Expiry            int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     bool         `json:"email_verified"`
+	PreferredUsername string       `json:"preferred_username"`
+	Name              string       `json:"name"`
+}
+
+// oidcAudience accepts both the single string and the array form of "aud"
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a oidcAudience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcState is kept in Redis between the redirect to the provider and the callback
+type oidcState struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	LinkUser string `json:"linkUser,omitempty"`
+}
+
+const oidcStateTTL = 10 * time.Minute
+
+// oidcStateCookie binds a login to the browser that started it. The callback
+// only accepts a state that matches the cookie, so a victim cannot be made to
+// complete a login or link that somebody else started.
+const oidcStateCookie = "oidc_state"
+
+// unusablePasswordHash marks accounts provisioned through SSO. It matches no
+// password, so local login is refused until the user
+// sets a password through the reset flow.
+const unusablePasswordHash = "!sso"
+
+var errIdentityLinked = errors.New("identity is linked to another user")
+
+var (
+	oidcProviders       = loadOIDCProviders()
+	oidcSuccessRedirect = envOr("OIDC_SUCCESS_REDIRECT", "")
+	oidcHTTPClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+// loadOIDCProviders reads providers from the environment:
+//
+//	OIDC_PROVIDERS=corp
+//	OIDC_CORP_ISSUER=https://sso.example.com
+//	OIDC_CORP_CLIENT_ID=chat
+//	OIDC_CORP_CLIENT_SECRET=...
+//	OIDC_CORP_REDIRECT_URL=https://chat.example.com/auth/oidc/callback
+//	OIDC_CORP_SCOPES=openid profile email
+func loadOIDCProviders() map[string]*OIDCProvider {
+	providers := map[string]*OIDCProvider{}
+	defaultRedirect := envOr("OIDC_REDIRECT_URL", "http://localhost:8080/auth/oidc/callback")
+
+	for name := range parseList(envOr("OIDC_PROVIDERS", "")) {
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := &OIDCProvider{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(envOr(prefix+"ISSUER", ""), "/"),
+			ClientID:     envOr(prefix+"CLIENT_ID", ""),
+			ClientSecret: envOr(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  envOr(prefix+"REDIRECT_URL", defaultRedirect),
+			Scopes:       strings.Fields(envOr(prefix+"SCOPES", "openid profile email")),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			fmt.Printf("Skipping OIDC provider %s: issuer and client id are required\n", name)
+			continue
+		}
+		providers[name] = provider
+	}
+
+	if mockIDPEnabled {
+		providers[mockIDPName] = &OIDCProvider{
+			Name:         mockIDPName,
+			Issuer:       mockIDPIssuer,
+			ClientID:     mockIDPClientID,
+			ClientSecret: mockIDPClientSecret,
+			RedirectURL:  defaultRedirect,
+			Scopes:       []string{"openid", "profile", "email"},
+		}
+	}
+	return providers
+}
+
+func oidcStateKey(state string) string {
+	return "oidc:state:" + state
+}
+
+// oidcIdentityKey maps a provider subject to the local username it is linked to
+func oidcIdentityKey(provider, subject string) string {
+	return "oidc:identity:" + provider + ":" + subject
+}
+
+// userIdentitiesKey is the set of "<provider>:<subject>" identities linked to a user
+func userIdentitiesKey(username string) string {
+	return "user:" + username + ":identities"
+}
+
+func base64URLDecode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	resp, err := oidcHTTPClient.Get(p.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", discovery.Issuer, p.Issuer)
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// publicKey returns the signing key with the given id, refetching the key set
+// once when the id is unknown so provider key rotation is picked up
+func (p *OIDCProvider) publicKey(kid string) (*rsa.PublicKey, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	resp, err := oidcHTTPClient.Get(discovery.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64URLDecode(k.N)
+		e, errE := base64URLDecode(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// authorizationURL builds the redirect to the provider's login page using the
+// authorization code flow with PKCE. The state is returned as well so the
+// caller can bind it to the browser.
+func (p *OIDCProvider) authorizationURL(linkUser, loginHint string) (string, string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	stateJSON, err := json.Marshal(oidcState{
+		Provider: p.Name,
+		Nonce:    nonce,
+		Verifier: verifier,
+		LinkUser: linkUser,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if err := rdb.Set(ctx, oidcStateKey(state), stateJSON, oidcStateTTL).Err(); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if loginHint != "" {
+		params.Set("login_hint", loginHint)
+	}
+	return discovery.AuthorizationEndpoint + "?" + params.Encode(), state, nil
+}
+
+// setStateCookie hands the state of a login to the browser. It is sent back
+// on the provider's top level redirect to the callback.
+func (p *OIDCProvider) setStateCookie(w http.ResponseWriter, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// exchange trades an authorization code for a verified set of ID token claims
+func (p *OIDCProvider) exchange(code string, state *oidcState) (*oidcClaims, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := oidcHTTPClient.PostForm(discovery.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {state.Verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	return p.verifyIDToken(tokens.IDToken, state.Nonce)
+}
+
+// verifyIDToken checks the signature and standard claims of an RS256 ID token
+func (p *OIDCProvider) verifyIDToken(raw, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	headerJSON, err := base64URLDecode(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed id token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed id token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id token algorithm %q", header.Alg)
+	}
+
+	key, err := p.publicKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64URLDecode(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed id token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid id token signature")
+	}
+
+	payload, err := base64URLDecode(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed id token payload")
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed id token payload")
+	}
+
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.Issuer:
+		return nil, errors.New("id token issuer mismatch")
+	case !claims.Audience.contains(p.ClientID):
+		return nil, errors.New("id token audience mismatch")
+	case time.Now().After(time.Unix(claims.Expiry, 0).Add(time.Minute)):
+		return nil, errors.New("id token expired")
+	case claims.Nonce != nonce:
+		return nil, errors.New("id token nonce mismatch")
+	case claims.Subject == "":
+		return nil, errors.New("id token has no subject")
+	}
+	return &claims, nil
+}
+
+// linkIdentity attaches a provider identity to a local user. Linking an
+// identity that already belongs to someone else is refused.
+func linkIdentity(provider, subject, username string) error {
+	ok, err := rdb.SetNX(ctx, oidcIdentityKey(provider, subject), username, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		owner, err := rdb.Get(ctx, oidcIdentityKey(provider, subject)).Result()
+		if err != nil {
+			return err
+		}
+		if owner != username {
+			return errIdentityLinked
+		}
+	}
+	return rdb.SAdd(ctx, userIdentitiesKey(username), provider+":"+subject).Err()
+}
+
+// usernameCandidate turns identity claims into something that passes
+// validateUsername, before any uniqueness suffix is added
+func usernameCandidate(provider string, claims *oidcClaims) string {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	if base == "" {
+		base = provider + "-user"
+	}
+
+	var b strings.Builder
+	for _, r := range base {
+		if r < 128 && (r == '.' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	candidate := strings.Trim(b.String(), ".-")
+
+	// Leave room for a "-NN" suffix
+	if limit := rules.usernameMax - 3; len(candidate) > limit {
+		candidate = candidate[:limit]
+	}
+	for len(candidate) < rules.usernameMin {
+		candidate += "user"
+	}
+	return candidate
+}
+
+// provisionOIDCUser creates a local account for a first-time SSO login
+func provisionOIDCUser(provider string, claims *oidcClaims) (string, error) {
+	base := usernameCandidate(provider, claims)
+
+	for i := 1; i < 100; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s-%d", base, i)
+		}
+
+		var errs ValidationErrors
+		validateUsername(&errs, username)
+		if len(errs) > 0 {
+			continue
+		}
+
+		// SETNX claims the name atomically against concurrent registrations
+		created, err := rdb.SetNX(ctx, username, unusablePasswordHash, 0).Result()
+		if err != nil {
+			return "", err
+		}
+		if !created {
+			continue
+		}
+
+		if err := linkIdentity(provider, claims.Subject, username); err != nil {
+			rdb.Del(ctx, username)
+			return "", err
+		}
+		rdb.SAdd(ctx, "users", username)
+
+		if claims.Name != "" {
+			profile := Profile{Username: username, DisplayName: claims.Name, UpdatedAt: time.Now()}
+			if profileJSON, err := json.Marshal(profile); err == nil {
+				rdb.Set(ctx, userProfileKey(username), profileJSON, 0)
+			}
+		}
+
+		fmt.Printf("Provisioned user %s from %s login\n", username, provider)
+		return username, nil
+	}
+	return "", errors.New("no free username for identity")
+}
+
+// oidcProvidersHandler lists the SSO providers users can log in with
+func oidcProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	names := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	providers := []map[string]string{}
+	for _, name := range names {
+		providers = append(providers, map[string]string{
+			"name":     name,
+			"loginUrl": "/auth/oidc/login?provider=" + url.QueryEscape(name),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
+
+// oidcLoginHandler starts an SSO login by redirecting to the provider
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	if rateLimited(w, loginIPRateLimit, clientIP(r)) {
+		return
+	}
+
+	provider, ok := oidcProviders[r.URL.Query().Get("provider")]
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Unknown identity provider")
+		return
+	}
+
+	authURL, state, err := provider.authorizationURL("", r.URL.Query().Get("login_hint"))
+	if err != nil {
+		fmt.Printf("Error starting %s login: %v\n", provider.Name, err)
+		writeError(w, http.StatusBadGateway, errCodeIdentityProvider, "Identity provider is unavailable")
+		return
+	}
+
+	provider.setStateCookie(w, state)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcLinkHandler returns a provider login URL that links the resulting
+// identity to the calling local account instead of logging in. The frontend
+// must send the request with credentials so the browser keeps the state cookie.
+func oidcLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	provider, ok := oidcProviders[r.URL.Query().Get("provider")]
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Unknown identity provider")
+		return
+	}
+
+	authURL, state, err := provider.authorizationURL(username, "")
+	if err != nil {
+		fmt.Printf("Error starting %s link: %v\n", provider.Name, err)
+		writeError(w, http.StatusBadGateway, errCodeIdentityProvider, "Identity provider is unavailable")
+		return
+	}
+
+	provider.setStateCookie(w, state)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"authorizationUrl": authURL,
+	})
+}
+
+// oidcCallbackHandler completes an SSO login or link. Logins end with a
+// regular session token, the same one /login hands out.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	query := r.URL.Query()
+	if idpErr := query.Get("error"); idpErr != "" {
+		writeError(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Login was refused by the identity provider: "+idpErr)
+		return
+	}
+
+	// The state must come back from the browser that started the flow
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || query.Get("state") == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Login session is invalid or expired")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+
+	// States are single use
+	stateJSON, err := rdb.GetDel(ctx, oidcStateKey(query.Get("state"))).Result()
+	if err == redis.Nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Login session is invalid or expired")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error loading login session")
+		return
+	}
+
+	var state oidcState
+	if err := json.Unmarshal([]byte(stateJSON), &state); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error loading login session")
+		return
+	}
+
+	provider, ok := oidcProviders[state.Provider]
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Unknown identity provider")
+		return
+	}
+
+	claims, err := provider.exchange(query.Get("code"), &state)
+	if err != nil {
+		fmt.Printf("Error completing %s login: %v\n", provider.Name, err)
+		writeError(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Could not verify identity provider login")
+		return
+	}
+
+	// Account linking for an already logged in user
+	if state.LinkUser != "" {
+		err := linkIdentity(provider.Name, claims.Subject, state.LinkUser)
+		if err == errIdentityLinked {
+			writeError(w, http.StatusConflict, errCodeConflict, "This identity is already linked to another account")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error linking identity")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"message":  "Identity linked",
+			"provider": provider.Name,
+			"username": state.LinkUser,
+		})
+		return
+	}
+
+	username, err := rdb.Get(ctx, oidcIdentityKey(provider.Name, claims.Subject)).Result()
+	if err == redis.Nil {
+		username, err = provisionOIDCUser(provider.Name, claims)
+	}
+	if err != nil {
+		fmt.Printf("Error resolving %s identity: %v\n", provider.Name, err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error resolving user account")
+		return
+	}
+
+	if isDisabled(username) {
+		auditLogin(r, username, false, "disabled")
+		writeError(w, http.StatusForbidden, errCodeAccountDisabled, "Account is disabled")
+		return
+	}
+
+	auditLogin(r, username, true, "oidc:"+provider.Name)
+
+	sessionToken, err := createSession(username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating session")
+		return
+	}
+
+	// Browser flows hand the session to the frontend in the URL fragment,
+	// which is never sent to servers or logged by proxies
+	if oidcSuccessRedirect != "" {
+		fragment := url.Values{"session_token": {sessionToken}, "username": {username}}
+		http.Redirect(w, r, oidcSuccessRedirect+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"message":       "Login successful",
+		"session_token": sessionToken,
+		"username":      username,
+		"provider":      provider.Name,
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useMockIDP serves the SSO endpoints and the mock identity provider from a
+// test server and registers the provider as "mock"
+func useMockIDP(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	oldIssuer, oldProviders := mockIDPIssuer, oidcProviders
+	t.Cleanup(func() { mockIDPIssuer, oidcProviders = oldIssuer, oldProviders })
+	mockIDPIssuer = srv.URL + "/mock-idp"
+	oidcProviders = map[string]*OIDCProvider{
+		mockIDPName: {
+			Name:         mockIDPName,
+			Issuer:       mockIDPIssuer,
+			ClientID:     mockIDPClientID,
+			ClientSecret: mockIDPClientSecret,
+			RedirectURL:  srv.URL + "/auth/oidc/callback",
+			Scopes:       []string{"openid", "profile", "email"},
+		},
+	}
+
+	mux.HandleFunc("/auth/oidc/login", oidcLoginHandler)
+	mux.HandleFunc("/auth/oidc/link", oidcLinkHandler)
+	mux.HandleFunc("/auth/oidc/callback", oidcCallbackHandler)
+	if err := registerMockIDP(mux); err != nil {
+		t.Fatalf("starting mock identity provider: %v", err)
+	}
+	return srv
+}
+
+// browser is an HTTP client that keeps cookies like a browser does
+func browser(t *testing.T) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("creating cookie jar: %v", err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+// callbackURL follows the provider redirects of a login URL and returns the
+// callback URL without requesting it
+func callbackURL(t *testing.T, client *http.Client, loginURL string) string {
+	t.Helper()
+
+	stop := *client
+	stop.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/auth/oidc/callback" {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	resp, err := stop.Get(loginURL)
+	if err != nil {
+		t.Fatalf("starting login: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status = %d, want a redirect to the callback", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	useTestRedis(t)
+	srv := useMockIDP(t)
+
+	resp, err := browser(t).Get(srv.URL + "/auth/oidc/login?provider=mock&login_hint=alice")
+	if err != nil {
+		t.Fatalf("logging in: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var body struct {
+		SessionToken string `json:"session_token"`
+		Username     string `json:"username"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if body.Username != "alice" || extractUsernameFromToken(body.SessionToken) != "alice" {
+		t.Errorf("logged in as %q with token for %q, want alice", body.Username, extractUsernameFromToken(body.SessionToken))
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	useTestRedis(t)
+	srv := useMockIDP(t)
+
+	// An attacker starts a login and hands the callback URL to a victim
+	attacker := browser(t)
+	callback := callbackURL(t, attacker, srv.URL+"/auth/oidc/login?provider=mock&login_hint=mallory")
+
+	resp, err := browser(t).Get(callback)
+	if err != nil {
+		t.Fatalf("following callback: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("victim callback: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// The browser that started the flow can still complete it
+	resp, err = attacker.Get(callback)
+	if err != nil {
+		t.Fatalf("following callback: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("own callback: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestOIDCLinkRequiresStateCookie(t *testing.T) {
+	useTestRedis(t)
+	srv := useMockIDP(t)
+	token := testSession(t, "alice")
+
+	// A link started by alice must not be completed by another browser,
+	// or someone else's identity could be attached to her account
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/auth/oidc/link?provider=mock", nil)
+	req.Header.Set("Authorization", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("starting link: %v", err)
+	}
+	var body struct {
+		AuthorizationURL string `json:"authorizationUrl"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+
+	authURL, err := url.Parse(body.AuthorizationURL)
+	if err != nil || authURL.Host == "" {
+		t.Fatalf("authorization URL = %q", body.AuthorizationURL)
+	}
+	query := authURL.Query()
+	query.Set("login_hint", "bob")
+	authURL.RawQuery = query.Encode()
+
+	victim := browser(t)
+	resp, err = victim.Get(authURL.String())
+	if err != nil {
+		t.Fatalf("following link: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if linked, _ := rdb.SCard(ctx, userIdentitiesKey("alice")).Result(); linked != 0 {
+		t.Errorf("alice has %d linked identities, want 0", linked)
+	}
+}
+
+func TestMockIDPPrunesExpiredCodes(t *testing.T) {
+	idp, err := newMockIDP()
+	if err != nil {
+		t.Fatalf("creating mock identity provider: %v", err)
+	}
+	idp.codes["stale"] = mockAuthCode{expiresAt: time.Now().Add(-time.Second)}
+
+	params := url.Values{
+		"client_id":     {mockIDPClientID},
+		"response_type": {"code"},
+		"redirect_uri":  {"http://localhost/auth/oidc/callback"},
+		"login_hint":    {"alice"},
+	}
+	w := httptest.NewRecorder()
+	idp.authorizeHandler(w, httptest.NewRequest(http.MethodGet, "/mock-idp/authorize?"+params.Encode(), nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusFound)
+	}
+
+	if _, ok := idp.codes["stale"]; ok || len(idp.codes) != 1 {
+		t.Errorf("codes = %v, want only the new code", idp.codes)
+	}
+	if !strings.Contains(w.Header().Get("Location"), "code=") {
+		t.Errorf("redirect %q has no code", w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// Profile field limits
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxStatusLength      = 100
+)
+
+const frameRefreshUserList = "refreshUserList"
+
+// Profile is the public information a user shares about themselves
+type Profile struct {
+	Username    string    `json:"username"`
+	DisplayName string    `json:"displayName"`
+	AvatarURL   string    `json:"avatarUrl,omitempty"`
+	Bio         string    `json:"bio,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	Timezone    string    `json:"timezone,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt,omitempty"`
+	Bot         bool      `json:"bot,omitempty"`
+}
+
+// ProfileSnippet is the part of a profile embedded in messages and presence lists
+type ProfileSnippet struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Bot         bool   `json:"bot,omitempty"`
+}
+
+func userProfileKey(username string) string {
+	return "user:" + username + ":profile"
+}
+
+// getProfile returns a user's profile, with defaults for users who never set one
+func getProfile(username string) (*Profile, error) {
+	profile := &Profile{Username: username, DisplayName: username}
+
+	profileJSON, err := rdb.Get(ctx, userProfileKey(username)).Result()
+	if err == redis.Nil {
+		profile.Bot = isBot(username)
+		return profile, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(profileJSON), profile); err != nil {
+		return nil, err
+	}
+	profile.Username = username
+	profile.Bot = isBot(username)
+	return profile, nil
+}
+
+func (p *Profile) snippet() ProfileSnippet {
+	return ProfileSnippet{
+		Username:    p.Username,
+		DisplayName: p.DisplayName,
+		AvatarURL:   p.AvatarURL,
+		Status:      p.Status,
+		Bot:         p.Bot,
+	}
+}
+
+// profileSnippet returns the snippet of a user, falling back to the bare
+// username if the profile cannot be loaded
+func profileSnippet(username string) ProfileSnippet {
+	profile, err := getProfile(username)
+	if err != nil {
+		fmt.Printf("Error loading profile of %s: %v\n", username, err)
+		return ProfileSnippet{Username: username, DisplayName: username}
+	}
+	return profile.snippet()
+}
+
+// presenceRequest asks a hub to send its user list to a connection
+type presenceRequest struct {
+	conn *websocket.Conn
+	sub  *subscriber // set instead of conn for other transports
+}
+
+// sendUserList sends the list of users present in the room to one client
+func (h *Hub) sendUserList(client *Client) {
+	if frame := h.userListFrame(); frame != nil {
+		h.writeTo(client, newFrameCache(frame))
+	}
+}
+
+// broadcastUserList sends the list of users present in the room to everyone
+// in it, after someone joined or left
+func (h *Hub) broadcastUserList() {
+	if frame := h.userListFrame(); frame != nil {
+		h.fanOut(frame, nil)
+	}
+}
+
+// userListFrame lists the users present in the room over any transport.
+// content keeps the JSON encoded list of names older clients expect.
+// Profiles are the snippets loaded when each connection joined.
+func (h *Hub) userListFrame() []byte {
+	seen := make(map[string]bool)
+	users := []ProfileSnippet{}
+	anonymous := 0
+	add := func(username string, profile ProfileSnippet) {
+		if username == "" {
+			anonymous++
+			return
+		}
+		if !seen[username] {
+			seen[username] = true
+			users = append(users, profile)
+		}
+	}
+	for _, c := range h.clients {
+		add(c.username, c.profile)
+	}
+	for sub := range h.subscribers {
+		add(sub.username, sub.profile)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Username
+	}
+	namesJSON, _ := json.Marshal(names)
+
+	msg := map[string]interface{}{
+		"type":      "userList",
+		"content":   string(namesJSON),
+		"users":     users,
+		"anonymous": anonymous,
+		"sender":    "system",
+		"timestamp": time.Now(),
+	}
+
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Printf("Error marshalling user list: %v\n", err)
+		return nil
+	}
+	return msgJSON
+}
+
+// validateProfileUpdate normalises and checks the fields of a profile update
+func validateProfileUpdate(update *profileUpdate) ValidationErrors {
+	var errs ValidationErrors
+
+	if update.DisplayName != nil {
+		*update.DisplayName = normalizeText(*update.DisplayName, false)
+		if *update.DisplayName == "" {
+			errs.add("displayName", "required", "Display name must not be empty")
+		} else if utf8.RuneCountInString(*update.DisplayName) > maxDisplayNameLength {
+			errs.add("displayName", "too_long", "Display name must be at most %d characters", maxDisplayNameLength)
+		}
+	}
+	if update.Bio != nil {
+		*update.Bio = normalizeText(*update.Bio, true)
+		if utf8.RuneCountInString(*update.Bio) > maxBioLength {
+			errs.add("bio", "too_long", "Bio must be at most %d characters", maxBioLength)
+		}
+	}
+	if update.Status != nil {
+		*update.Status = normalizeText(*update.Status, false)
+		if utf8.RuneCountInString(*update.Status) > maxStatusLength {
+			errs.add("status", "too_long", "Status must be at most %d characters", maxStatusLength)
+		}
+	}
+	if update.Timezone != nil && *update.Timezone != "" {
+		if _, err := time.LoadLocation(*update.Timezone); err != nil {
+			errs.add("timezone", "invalid", "Unknown timezone %q", *update.Timezone)
+		}
+	}
+	if update.AvatarURL != nil && *update.AvatarURL != "" {
+		validateAvatarURL(&errs, "avatarUrl", *update.AvatarURL)
+	}
+	return errs
+}
+
+// validateAvatarURL accepts http(s) URLs and links to uploaded attachments
+func validateAvatarURL(errs *ValidationErrors, field, avatarURL string) {
+	u, err := url.Parse(avatarURL)
+	if err != nil || !(u.Scheme == "https" || u.Scheme == "http" || (u.Scheme == "" && strings.HasPrefix(u.Path, "/api/attachments/"))) {
+		errs.add(field, "invalid", "Avatar URL must be an http(s) URL or an uploaded attachment")
+	}
+}
+
+// profileUpdate holds the fields of a PATCH, nil fields are left unchanged
+type profileUpdate struct {
+	DisplayName        *string `json:"displayName"`
+	AvatarURL          *string `json:"avatarUrl"`
+	AvatarAttachmentID *string `json:"avatarAttachmentId"`
+	Bio                *string `json:"bio"`
+	Status             *string `json:"status"`
+	Timezone           *string `json:"timezone"`
+}
+
+// myProfileHandler serves GET and PATCH on /api/users/me
+func myProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	profile, err := getProfile(username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching profile")
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		var update profileUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+			return
+		}
+
+		// An uploaded image can be used as avatar, its thumbnail becomes the avatar URL
+		if update.AvatarAttachmentID != nil {
+			attachment, err := getAttachment(*update.AvatarAttachmentID)
+			if err != nil || attachment.UploaderID != username || !attachment.HasThumbnail {
+				writeValidationErrors(w, ValidationErrors{{Field: "avatarAttachmentId", Code: "invalid", Message: "Avatar must be an image you uploaded"}})
+				return
+			}
+			avatarURL := attachment.withURLs().ThumbnailURL
+			update.AvatarURL = &avatarURL
+		}
+
+		if errs := validateProfileUpdate(&update); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		if update.DisplayName != nil {
+			profile.DisplayName = *update.DisplayName
+		}
+		if update.AvatarURL != nil {
+			profile.AvatarURL = *update.AvatarURL
+		}
+		if update.Bio != nil {
+			profile.Bio = *update.Bio
+		}
+		if update.Status != nil {
+			profile.Status = *update.Status
+		}
+		if update.Timezone != nil {
+			profile.Timezone = *update.Timezone
+		}
+		profile.UpdatedAt = time.Now()
+
+		profileJSON, err := json.Marshal(profile)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing profile")
+			return
+		}
+		if err := rdb.Set(ctx, userProfileKey(username), profileJSON, 0).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing profile")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// userProfileHandler serves GET /api/users/<name>
+func userProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username := strings.TrimPrefix(r.URL.Path, "/api/users/")
+	if username == "" || strings.Contains(username, "/") {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "User not found")
+		return
+	}
+
+	isUser, err := rdb.SIsMember(ctx, "users", username).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching user")
+		return
+	}
+	if !isUser {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "User not found")
+		return
+	}
+
+	profile, err := getProfile(username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching profile")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
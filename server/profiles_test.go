@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserListBroadcast(t *testing.T) {
+	useTestRedis(t)
+
+	alice, bob := testSession(t, "alice"), testSession(t, "bob")
+	room := testRoom(t, "alice")
+	profileJSON, _ := json.Marshal(Profile{Username: "bob", DisplayName: "Bob B."})
+	rdb.Set(ctx, userProfileKey("bob"), profileJSON, 0)
+
+	srv := httptest.NewServer(http.HandlerFunc(serveWs))
+	defer srv.Close()
+
+	first, _, err := dialRoom(t, srv, room.ID, alice)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+	readFrame(t, first, "userList")
+
+	second, _, err := dialRoom(t, srv, room.ID, bob)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	// Members already in the room learn about the newcomer without asking
+	users := readFrame(t, first, "userList")["users"].([]interface{})
+	if len(users) != 2 {
+		t.Fatalf("user list has %d entries, want 2: %v", len(users), users)
+	}
+	if got := users[1].(map[string]interface{})["displayName"]; got != "Bob B." {
+		t.Errorf("displayName = %v, want the profile's", got)
+	}
+
+	second.Close()
+	if users := readFrame(t, first, "userList")["users"].([]interface{}); len(users) != 1 {
+		t.Errorf("user list after leaving has %d entries, want 1", len(users))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// ratePolicy is a token bucket: up to limit requests, refilled evenly over per
+type ratePolicy struct {
+	name  string
+	limit int
+	per   time.Duration
+}
+
+// Rate limiting policies. Each can be overridden with an environment variable
+// of the form RATE_LIMIT_<NAME>=<count>/<duration>, e.g. RATE_LIMIT_LOGIN=10/1m.
+// A count of 0 disables the policy.
+var (
+	loginIPRateLimit    = loadRatePolicy("login_ip", 20, time.Minute)
+	loginUserRateLimit  = loadRatePolicy("login_user", 10, time.Minute)
+	registerRateLimit   = loadRatePolicy("register", 5, time.Hour)
+	roomCreateRateLimit = loadRatePolicy("room_create", 10, time.Hour)
+	wsConnectRateLimit  = loadRatePolicy("ws_connect", 30, time.Minute)
+	wsMessageRateLimit  = loadRatePolicy("ws_message", 20, 10*time.Second)
+	wsFrameRateLimit    = loadRatePolicy("ws_frame", 60, 10*time.Second)
+)
+
+// trustProxy makes clientIP honour X-Forwarded-For, only enable it behind a proxy
+var trustProxy = envOr("TRUST_PROXY", "false") == "true"
+
+func loadRatePolicy(name string, limit int, per time.Duration) ratePolicy {
+	policy := ratePolicy{name: name, limit: limit, per: per}
+
+	key := "RATE_LIMIT_" + strings.ToUpper(name)
+	if v := envOr(key, ""); v != "" {
+		n, d, ok := parseRateLimit(v)
+		if !ok {
+			fmt.Printf("Ignoring invalid %s=%q, expected <count>/<duration>\n", key, v)
+			return policy
+		}
+		policy.limit, policy.per = n, d
+	}
+	return policy
+}
+
+// parseRateLimit parses a "<count>/<duration>" limit such as "10/1m"
+func parseRateLimit(v string) (int, time.Duration, bool) {
+	count, window, ok := strings.Cut(v, "/")
+	n, err := strconv.Atoi(count)
+	d, derr := time.ParseDuration(window)
+	if !ok || err != nil || derr != nil || n < 0 || d <= 0 {
+		return 0, 0, false
+	}
+	return n, d, true
+}
+
+// tokenBucketScript implements a token bucket shared by all server replicas.
+// Redis time is used so replicas with skewed clocks agree.
+// Returns {allowed, retryAfterMs}.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local data = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(data[1]) or capacity
+local ts = tonumber(data[2]) or now
+tokens = math.min(capacity, tokens + (now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate))
+return {allowed, retry}
+`)
+
+// allow takes a token from the bucket identified by policy and key. On Redis
+// errors the request is let through rather than locking everybody out.
+func allow(policy ratePolicy, key string) (bool, time.Duration) {
+	if policy.limit == 0 {
+		return true, 0
+	}
+
+	rate := float64(policy.limit) / float64(policy.per.Milliseconds())
+	res, err := tokenBucketScript.Run(ctx, rdb, []string{"ratelimit:" + policy.name + ":" + key}, policy.limit, rate).Int64Slice()
+	if err != nil {
+		fmt.Printf("Error checking rate limit %s: %v\n", policy.name, err)
+		return true, 0
+	}
+
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond
+}
+
+// rateLimited checks a policy and answers with 429 when the caller is over it
+func rateLimited(w http.ResponseWriter, policy ratePolicy, key string) bool {
+	ok, retryAfter := allow(policy, key)
+	if ok {
+		return false
+	}
+
+	seconds := max(int((retryAfter+time.Second-1)/time.Second), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeErrorDetails(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests", map[string]interface{}{
+		"policy":            policy.name,
+		"retryAfterSeconds": seconds,
+	})
+	return true
+}
+
+// clientIP returns the address a request originates from
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// localBucket is an in-process token bucket for limits scoped to a single
+// connection, which never need to be shared between replicas
+type localBucket struct {
+	mu     sync.Mutex
+	policy ratePolicy
+	tokens float64
+	last   time.Time
+}
+
+func newLocalBucket(policy ratePolicy) *localBucket {
+	return &localBucket{policy: policy, tokens: float64(policy.limit), last: time.Now()}
+}
+
+func (b *localBucket) allow() bool {
+	if b.policy.limit == 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(b.policy.limit) / float64(b.policy.per)
+	b.tokens = min(float64(b.policy.limit), b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// closeRateLimited closes a WebSocket connection that sent messages too fast
+func closeRateLimited(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded")
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
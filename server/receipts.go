@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	frameChat        = "chat"
+	frameMarkRead    = "markRead"
+	frameReadReceipt = "readReceipt"
+)
+
+// userChatroom is a chatroom as seen by a specific user
+type userChatroom struct {
+	Chatroom
+	UnreadCount int64 `json:"unreadCount"`
+}
+
+// roomSeqKey holds the id of the latest chat message in a room
+func roomSeqKey(roomID string) string {
+	return "chatroom:" + roomID + ":seq"
+}
+
+// roomPublishedKey is a sorted set of the ids of the chat messages stored in
+// a room's history, so deleted and quarantined messages never count as unread
+func roomPublishedKey(roomID string) string {
+	return "chatroom:" + roomID + ":published"
+}
+
+// roomReadsKey is a hash of username to the last message id read in a room
+func roomReadsKey(roomID string) string {
+	return "chatroom:" + roomID + ":reads"
+}
+
+// markReadScript moves a read marker forward, never backwards and never past
+// the latest message. It returns the resulting marker.
+var markReadScript = redis.NewScript(`
+local latest = tonumber(redis.call('GET', KEYS[1]) or '0')
+local current = tonumber(redis.call('HGET', KEYS[2], ARGV[1]) or '0')
+local target = math.min(tonumber(ARGV[2]), latest)
+if target > current then
+	redis.call('HSET', KEYS[2], ARGV[1], target)
+	return target
+end
+return current
+`)
+
+// nextMessageID allocates the next chat message id for a room
+func nextMessageID(roomID string) (int64, error) {
+	return rdb.Incr(ctx, roomSeqKey(roomID)).Result()
+}
+
+// markRead records that a user has read a room up to messageID. It returns the
+// stored marker and whether it moved.
+func markRead(roomID, username string, messageID int64) (int64, bool, error) {
+	before, err := lastRead(roomID, username)
+	if err != nil {
+		return 0, false, err
+	}
+
+	after, err := markReadScript.Run(ctx, rdb, []string{roomSeqKey(roomID), roomReadsKey(roomID)}, username, messageID).Int64()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return after, after > before, nil
+}
+
+// lastRead returns the last message id a user has read in a room
+func lastRead(roomID, username string) (int64, error) {
+	id, err := rdb.HGet(ctx, roomReadsKey(roomID), username).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return id, err
+}
+
+// unreadCount returns how many stored chat messages a user has not read in a room
+func unreadCount(roomID, username string) (int64, error) {
+	read, err := lastRead(roomID, username)
+	if err != nil {
+		return 0, err
+	}
+	return rdb.ZCount(ctx, roomPublishedKey(roomID), "("+strconv.FormatInt(read, 10), "+inf").Result()
+}
+
+// handleMarkRead stores a markRead frame and broadcasts a read receipt to the room
+func handleMarkRead(hub *Hub, username string, msg map[string]interface{}) {
+	if username == "" {
+		fmt.Println("Ignoring markRead from anonymous connection")
+		return
+	}
+
+	id, ok := msg["messageId"].(float64)
+	if !ok || id < 1 {
+		fmt.Println("Ignoring markRead without a valid messageId")
+		return
+	}
+
+	marker, moved, err := markRead(hub.roomID, username, int64(id))
+	if err != nil {
+		fmt.Printf("Error updating read marker: %v\n", err)
+		return
+	}
+	if !moved {
+		return
+	}
+
+	receipt := map[string]interface{}{
+		"type":      frameReadReceipt,
+		"sender":    "system",
+		"username":  username,
+		"messageId": marker,
+		"timestamp": time.Now(),
+	}
+
+	receiptJSON, err := json.Marshal(receipt)
+	if err != nil {
+		fmt.Printf("Error marshalling read receipt: %v\n", err)
+		return
+	}
+	hubSend(hub, hub.broadcast, receiptJSON)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMarkRead(t *testing.T) {
+	useTestRedis(t)
+	if err := rdb.Set(ctx, roomSeqKey("room"), 5, 0).Err(); err != nil {
+		t.Fatalf("setting the latest message id: %v", err)
+	}
+
+	cases := []struct {
+		name      string
+		messageID int64
+		want      int64
+		wantMoved bool
+	}{
+		{"forward", 3, 3, true},
+		{"same message", 3, 3, false},
+		{"backwards", 2, 3, false},
+		{"past the latest message", 9, 5, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, moved, err := markRead("room", "alice", tc.messageID)
+			if err != nil {
+				t.Fatalf("markRead: %v", err)
+			}
+			if got != tc.want || moved != tc.wantMoved {
+				t.Errorf("markRead(%d) = %d, %v, want %d, %v", tc.messageID, got, moved, tc.want, tc.wantMoved)
+			}
+		})
+	}
+}
+
+func TestHandleMarkReadBroadcastsReceipt(t *testing.T) {
+	useTestRedis(t)
+	if err := rdb.Set(ctx, roomSeqKey("room"), 5, 0).Err(); err != nil {
+		t.Fatalf("setting the latest message id: %v", err)
+	}
+	hub := newHub("room")
+
+	handleMarkRead(hub, "alice", map[string]interface{}{"type": frameMarkRead, "messageId": float64(4)})
+	var receipt map[string]interface{}
+	select {
+	case message := <-hub.broadcast:
+		json.Unmarshal(message, &receipt)
+	default:
+		t.Fatal("no read receipt was broadcast")
+	}
+	if receipt["type"] != frameReadReceipt || receipt["username"] != "alice" || receipt["messageId"] != float64(4) {
+		t.Errorf("receipt = %v, want alice reading message 4", receipt)
+	}
+
+	// Markers that do not move are not announced
+	handleMarkRead(hub, "alice", map[string]interface{}{"type": frameMarkRead, "messageId": float64(2)})
+	handleMarkRead(hub, "alice", map[string]interface{}{"type": frameMarkRead})
+	if n := len(hub.broadcast); n != 0 {
+		t.Errorf("%d receipts broadcast for markers that did not move, want none", n)
+	}
+}
+
+func TestUserChatroomsUnreadCount(t *testing.T) {
+	useTestRedis(t)
+	room := testRoom(t, "alice")
+	specsJSON, _ := json.Marshal([]FilterSpec{{Type: "wordlist", Words: []string{"darn"}, Action: filterActionQuarantine}})
+	if err := rdb.Set(ctx, roomFiltersKey(room.ID), specsJSON, 0).Err(); err != nil {
+		t.Fatalf("storing filters: %v", err)
+	}
+	t.Cleanup(func() { invalidateFilterChain(room.ID) })
+
+	var ids []int64
+	for _, content := range []string{"one", "two", "three", "oh darn"} {
+		stored, err := submitChatMessage(room.ID, "bob", map[string]interface{}{"type": frameChat, "content": content})
+		if content == "oh darn" {
+			if err == nil {
+				t.Fatal("the filtered message was published, want it quarantined")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("posting: %v", err)
+		}
+		var msg struct {
+			ID int64 `json:"id"`
+		}
+		json.Unmarshal(stored, &msg)
+		ids = append(ids, msg.ID)
+	}
+
+	token := testSession(t, "alice")
+	unread := func() int64 {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/api/chatrooms/my", nil)
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		userChatroomsHandler(w, r)
+
+		var rooms []userChatroom
+		if err := json.Unmarshal(w.Body.Bytes(), &rooms); err != nil || len(rooms) != 1 {
+			t.Fatalf("my chatrooms: status %d: %s", w.Code, w.Body.String())
+		}
+		return rooms[0].UnreadCount
+	}
+
+	if got := unread(); got != 3 {
+		t.Errorf("unread with a quarantined message = %d, want 3", got)
+	}
+
+	if err := deleteMessage(room.ID, ids[1]); err != nil {
+		t.Fatalf("deleting a message: %v", err)
+	}
+	if got := unread(); got != 2 {
+		t.Errorf("unread after a deletion = %d, want 2", got)
+	}
+
+	if _, _, err := markRead(room.ID, "alice", ids[0]); err != nil {
+		t.Fatalf("marking read: %v", err)
+	}
+	if got := unread(); got != 1 {
+		t.Errorf("unread after reading the first message = %d, want 1", got)
+	}
+
+	// Posting marks the sender's own message as read
+	if _, err := submitChatMessage(room.ID, "alice", map[string]interface{}{"type": frameChat, "content": "four"}); err != nil {
+		t.Fatalf("posting: %v", err)
+	}
+	if got := unread(); got != 0 {
+		t.Errorf("unread after posting = %d, want 0", got)
+	}
+}
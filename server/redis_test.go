@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// useTestRedis points rdb at an in-memory Redis for the duration of a test.
+// Hubs started by the test are stopped before rdb is restored, so none of
+// them is left running against a closed client.
+func useTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	previous := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		hubsMutex.Lock()
+		hubs := chatHubs
+		chatHubs = make(map[string]*Hub)
+		hubsMutex.Unlock()
+		for _, hub := range hubs {
+			hubSend(hub, hub.stop, "test finished")
+			<-hub.done
+		}
+
+		rdb.Close()
+		rdb = previous
+	})
+	return mr
+}
+
+// testSession creates a user session and returns its token
+func testSession(t *testing.T, username string) string {
+	t.Helper()
+
+	token, err := createSession(username)
+	if err != nil {
+		t.Fatalf("creating session for %s: %v", username, err)
+	}
+	return token
+}
+
+// testRoom creates a chatroom owned by username
+func testRoom(t *testing.T, username string) *Chatroom {
+	t.Helper()
+
+	room, err := createChatroom(username, "test room", "")
+	if err != nil {
+		t.Fatalf("creating chatroom: %v", err)
+	}
+	return room
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Report statuses. Reports start open, may be claimed by a moderator and end
+// up resolved (action taken) or dismissed (no action needed).
+const (
+	reportOpen      = "open"
+	reportClaimed   = "claimed"
+	reportResolved  = "resolved"
+	reportDismissed = "dismissed"
+)
+
+// reportReasons are the categories a report can be filed under
+var reportReasons = map[string]bool{
+	"spam":          true,
+	"harassment":    true,
+	"hate":          true,
+	"inappropriate": true,
+	"other":         true,
+}
+
+// maxReportDetails limits the free text attached to a report
+const maxReportDetails = 1000
+
+var reportRateLimit = loadRatePolicy("report", 20, time.Hour)
+
+// Report is a member's complaint about a message or a user
+type Report struct {
+	ID           string            `json:"id"`
+	RoomID       string            `json:"roomId"`
+	MessageID    int64             `json:"messageId,omitempty"`
+	ReportedUser string            `json:"reportedUser"`
+	Reporter     string            `json:"reporter"`
+	Reason       string            `json:"reason"`
+	Details      string            `json:"details,omitempty"`
+	Snapshot     json.RawMessage   `json:"snapshot,omitempty"` // the message as it was when reported
+	Status       string            `json:"status"`
+	ClaimedBy    string            `json:"claimedBy,omitempty"`
+	Resolution   *ReportResolution `json:"resolution,omitempty"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	UpdatedAt    time.Time         `json:"updatedAt"`
+}
+
+// ReportResolution records how a report was closed
+type ReportResolution struct {
+	By                 string `json:"by"`
+	Note               string `json:"note,omitempty"`
+	DeletedMessage     bool   `json:"deletedMessage,omitempty"`
+	Banned             bool   `json:"banned,omitempty"`
+	BanDurationSeconds int64  `json:"banDurationSeconds,omitempty"`
+}
+
+func reportKey(id string) string {
+	return "report:" + id
+}
+
+func roomReportsKey(roomID string) string {
+	return "chatroom:" + roomID + ":reports"
+}
+
+func getReport(id string) (*Report, error) {
+	reportJSON, err := rdb.Get(ctx, reportKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var report Report
+	if err := json.Unmarshal([]byte(reportJSON), &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func saveReport(report *Report) error {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, reportKey(report.ID), reportJSON, 0)
+	pipe.SAdd(ctx, "reports", report.ID)
+	pipe.SAdd(ctx, roomReportsKey(report.RoomID), report.ID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// createReportHandler lets a member report a message or a user in a room
+func createReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	if rateLimited(w, reportRateLimit, username) {
+		return
+	}
+
+	var req struct {
+		RoomID    string `json:"roomId"`
+		MessageID int64  `json:"messageId"`
+		Username  string `json:"username"`
+		Reason    string `json:"reason"`
+		Details   string `json:"details"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	var errs ValidationErrors
+	if !reportReasons[req.Reason] {
+		errs.add("reason", "invalid", "Reason must be one of spam, harassment, hate, inappropriate or other")
+	}
+	req.Details = normalizeText(req.Details, true)
+	if utf8.RuneCountInString(req.Details) > maxReportDetails {
+		errs.add("details", "too_long", "Details must be at most %d characters", maxReportDetails)
+	}
+	if req.MessageID == 0 && req.Username == "" {
+		errs.add("messageId", "required", "Either a message or a user must be reported")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	room, err := getChatroom(req.RoomID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+		return
+	}
+
+	now := time.Now()
+	report := &Report{
+		ID:           uuid.New().String(),
+		RoomID:       room.ID,
+		MessageID:    req.MessageID,
+		ReportedUser: req.Username,
+		Reporter:     username,
+		Reason:       req.Reason,
+		Details:      req.Details,
+		Status:       reportOpen,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+
+	// Keep a copy of the message so deleting or editing it does not destroy evidence
+	if req.MessageID != 0 {
+		stored, err := findMessage(room.ID, req.MessageID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "Message not found")
+			return
+		}
+		report.Snapshot = json.RawMessage(stored)
+
+		// The reported user is the account that posted the message. Messages
+		// posted by integrations have none, so nobody is banned by mistake.
+		var header struct {
+			Author string `json:"author"`
+		}
+		if err := json.Unmarshal(report.Snapshot, &header); err == nil {
+			report.ReportedUser = header.Author
+		}
+	}
+
+	if err := saveReport(report); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing report")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// reportsHandler lists reports, newest first. With roomId the caller must
+// moderate that room, without it the caller must be an admin.
+// Query parameters: roomId and status.
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	indexKey := "reports"
+	if roomID := r.URL.Query().Get("roomId"); roomID != "" {
+		room, _ := moderatorRoom(w, r, roomID)
+		if room == nil {
+			return
+		}
+		indexKey = roomReportsKey(room.ID)
+	} else if requireAdmin(w, r) == "" {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+
+	ids, err := rdb.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching reports")
+		return
+	}
+
+	reports := []Report{}
+	for _, id := range ids {
+		report, err := getReport(id)
+		if err != nil {
+			continue // Skip reports that cannot be loaded
+		}
+		if status != "" && report.Status != status {
+			continue
+		}
+		reports = append(reports, *report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].CreatedAt.After(reports[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reports": reports,
+	})
+}
+
+// reportActionHandler claims, resolves or dismisses a report. Resolving can
+// delete the reported message and ban the reported user.
+func reportActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var req struct {
+		ID                 string `json:"id"`
+		Action             string `json:"action"` // claim, resolve or dismiss
+		Note               string `json:"note"`
+		DeleteMessage      bool   `json:"deleteMessage"`
+		Ban                bool   `json:"ban"`
+		BanDurationSeconds int64  `json:"banDurationSeconds"` // 0 is permanent
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	report, err := getReport(req.ID)
+	if err != nil {
+		if err == redis.Nil {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "Report not found")
+		} else {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching report")
+		}
+		return
+	}
+
+	room, username := moderatorRoom(w, r, report.RoomID)
+	if room == nil {
+		return
+	}
+
+	if report.Status == reportResolved || report.Status == reportDismissed {
+		writeError(w, http.StatusConflict, errCodeConflict, "Report is already closed")
+		return
+	}
+
+	switch req.Action {
+	case "claim":
+		if report.Status == reportClaimed && report.ClaimedBy != username {
+			writeError(w, http.StatusConflict, errCodeConflict, "Report is already claimed by "+report.ClaimedBy)
+			return
+		}
+		report.Status = reportClaimed
+		report.ClaimedBy = username
+
+	case "dismiss":
+		report.Status = reportDismissed
+		report.Resolution = &ReportResolution{By: username, Note: req.Note}
+
+	case "resolve":
+		resolution := &ReportResolution{By: username, Note: req.Note}
+
+		if req.Ban {
+			if report.ReportedUser == "" {
+				writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Report has no user to ban")
+				return
+			}
+			if roleRank(roomRole(room, report.ReportedUser)) >= roleRank(roomRole(room, username)) {
+				writeError(w, http.StatusForbidden, errCodeForbidden, "Cannot moderate a user with an equal or higher role")
+				return
+			}
+			if req.BanDurationSeconds < 0 {
+				writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Duration must not be negative")
+				return
+			}
+		}
+
+		if req.DeleteMessage && report.MessageID != 0 {
+			if err := deleteMessage(room.ID, report.MessageID); err != nil && err != redis.Nil {
+				writeError(w, http.StatusInternalServerError, errCodeInternal, "Error deleting message")
+				return
+			}
+			resolution.DeletedMessage = true
+			logModeration(room.ID, ModerationEntry{
+				Action:    "deleteMessage",
+				Username:  report.ReportedUser,
+				By:        username,
+				Reason:    "report " + report.ID,
+				Timestamp: time.Now(),
+			})
+		}
+
+		if req.Ban {
+			duration := time.Duration(req.BanDurationSeconds) * time.Second
+			if err := banUser(room.ID, report.ReportedUser, username, report.Reason, duration); err != nil {
+				writeError(w, http.StatusInternalServerError, errCodeInternal, "Error banning user")
+				return
+			}
+			resolution.Banned = true
+			resolution.BanDurationSeconds = req.BanDurationSeconds
+			logModeration(room.ID, ModerationEntry{
+				Action:          actionBan,
+				Username:        report.ReportedUser,
+				By:              username,
+				Reason:          "report " + report.ID,
+				DurationSeconds: req.BanDurationSeconds,
+				Timestamp:       time.Now(),
+			})
+		}
+
+		report.Status = reportResolved
+		report.Resolution = resolution
+
+	default:
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Action must be claim, resolve or dismiss")
+		return
+	}
+
+	report.UpdatedAt = time.Now()
+	if err := saveReport(report); err != nil {
+		fmt.Printf("Error storing report: %v\n", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing report")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReportTargetsAuthor(t *testing.T) {
+	useTestRedis(t)
+
+	carol := testSession(t, "carol")
+	room := testRoom(t, "alice")
+
+	// Client supplied sender and author fields are not trusted
+	posted, err := publishChatMessage(room.ID, "alice", map[string]interface{}{
+		"content": "hello",
+		"sender":  "bob",
+		"author":  "bob",
+	})
+	if err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+	integration, err := publishChatMessage(room.ID, "", map[string]interface{}{
+		"content": "build passed",
+		"sender":  "ci",
+		"author":  "bob",
+	})
+	if err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		message  []byte
+		username string
+		want     string
+	}{
+		{"user message", posted, "", "alice"},
+		{"named user is ignored", posted, "bob", "alice"},
+		{"integration message", integration, "bob", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var header struct {
+				ID int64 `json:"id"`
+			}
+			json.Unmarshal(tc.message, &header)
+
+			body := fmt.Sprintf(`{"roomId":%q,"messageId":%d,"username":%q,"reason":"spam"}`, room.ID, header.ID, tc.username)
+			r := httptest.NewRequest(http.MethodPost, "/api/reports", strings.NewReader(body))
+			r.Header.Set("Authorization", carol)
+			w := httptest.NewRecorder()
+			createReportHandler(w, r)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+			}
+
+			var report Report
+			if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+				t.Fatalf("decoding report: %v", err)
+			}
+			if report.ReportedUser != tc.want {
+				t.Errorf("ReportedUser = %q, want %q", report.ReportedUser, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,879 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Full-text search over stored chat messages. The index mirrors the room
+// histories: messages are added by appendHistory, removed by deleteMessage
+// and deleteChatroom, and fall out together with the history trim. Words are
+// lower cased and stripped of accents, and every search term must match.
+// Replicas using the in-process index share their changes over Redis pub/sub.
+
+// searchBackendName picks the index: "memory" for the in-process inverted
+// index, "redisearch" for the RediSearch module, or "auto" to use RediSearch
+// when the Redis server has it loaded
+var searchBackendName = envOr("SEARCH_BACKEND", "auto")
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchTerms     = 16
+	// searchSnippetRunes is about how long a highlighted excerpt is
+	searchSnippetRunes = 160
+)
+
+// searchQuery is a validated search request
+type searchQuery struct {
+	Terms  []string
+	Sender string
+	Rooms  map[string]bool // rooms the caller may read, narrowed by roomId
+	From   time.Time       // zero when unbounded
+	To     time.Time       // zero when unbounded
+	Limit  int
+	Offset int
+}
+
+// searchHit is a stored message matching a query
+type searchHit struct {
+	RoomID  string
+	Message json.RawMessage
+}
+
+// searchBackend indexes chat messages and answers queries newest first,
+// returning one page of hits and the total number of matches
+type searchBackend interface {
+	add(roomID string, message []byte) error
+	remove(roomID string, messageID int64) error
+	dropRoom(roomID string) error
+	search(q searchQuery) ([]searchHit, int, error)
+}
+
+// messageIndex is the active backend, replaced by startSearchIndex
+var messageIndex searchBackend = newMemoryIndex()
+
+// startSearchIndex picks the search backend and fills its index
+func startSearchIndex() error {
+	switch searchBackendName {
+	case "memory":
+	case "redisearch", "auto":
+		err := ensureRedisSearchIndex()
+		if err == nil {
+			messageIndex = redisSearch{}
+			fmt.Println("Search backend: RediSearch")
+			return nil
+		}
+		if searchBackendName == "redisearch" {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown SEARCH_BACKEND %q", searchBackendName)
+	}
+
+	// Subscribe before reading the history, so nothing written in between is
+	// missed. Changes seen twice are harmless, the index ignores repeats.
+	sub := rdb.Subscribe(ctx, searchSyncChannel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return err
+	}
+
+	index := sharedMemoryIndex{newMemoryIndex()}
+	count, err := reindexHistory(index.memoryIndex)
+	if err != nil {
+		sub.Close()
+		return err
+	}
+	go index.follow(sub)
+	messageIndex = index
+	fmt.Printf("Search backend: in-process index of %d messages\n", count)
+	return nil
+}
+
+// searchSyncChannel carries the index changes of every replica running the
+// in-process backend
+const searchSyncChannel = "search:sync"
+
+// searchSyncEvent is a change to the in-process index made by one replica
+type searchSyncEvent struct {
+	Op        string          `json:"op"` // "add", "remove" or "drop"
+	RoomID    string          `json:"roomId"`
+	MessageID int64           `json:"messageId,omitempty"`
+	Message   json.RawMessage `json:"message,omitempty"`
+}
+
+// sharedMemoryIndex is an in-process index kept in step across replicas:
+// changes are applied locally and published to the others
+type sharedMemoryIndex struct {
+	*memoryIndex
+}
+
+func (s sharedMemoryIndex) add(roomID string, message []byte) error {
+	if err := s.memoryIndex.add(roomID, message); err != nil {
+		return err
+	}
+	return publishSearchSync(searchSyncEvent{Op: "add", RoomID: roomID, Message: message})
+}
+
+func (s sharedMemoryIndex) remove(roomID string, messageID int64) error {
+	s.memoryIndex.remove(roomID, messageID)
+	return publishSearchSync(searchSyncEvent{Op: "remove", RoomID: roomID, MessageID: messageID})
+}
+
+func (s sharedMemoryIndex) dropRoom(roomID string) error {
+	s.memoryIndex.dropRoom(roomID)
+	return publishSearchSync(searchSyncEvent{Op: "drop", RoomID: roomID})
+}
+
+func publishSearchSync(ev searchSyncEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(ctx, searchSyncChannel, payload).Err()
+}
+
+// follow applies the changes published by every replica, this one included,
+// until the subscription is closed
+func (s sharedMemoryIndex) follow(sub *redis.PubSub) {
+	for m := range sub.Channel() {
+		var ev searchSyncEvent
+		if err := json.Unmarshal([]byte(m.Payload), &ev); err != nil {
+			fmt.Printf("Error decoding search sync event: %v\n", err)
+			continue
+		}
+
+		var err error
+		switch ev.Op {
+		case "add":
+			err = s.memoryIndex.add(ev.RoomID, ev.Message)
+		case "remove":
+			err = s.memoryIndex.remove(ev.RoomID, ev.MessageID)
+		case "drop":
+			err = s.memoryIndex.dropRoom(ev.RoomID)
+		}
+		if err != nil {
+			fmt.Printf("Error applying search sync event: %v\n", err)
+		}
+	}
+}
+
+// reindexHistory adds the stored history of every room to an index
+func reindexHistory(index searchBackend) (int, error) {
+	roomIDs, err := rdb.SUnion(ctx, "chatrooms", "chatrooms:archived").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, roomID := range roomIDs {
+		stored, err := rdb.LRange(ctx, roomMessagesKey(roomID), 0, -1).Result()
+		if err != nil {
+			return count, err
+		}
+		for _, message := range stored {
+			if err := index.add(roomID, []byte(message)); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// searchToken is a word of a text and where it is in the text
+type searchToken struct {
+	term       string
+	start, end int // byte offsets
+}
+
+// searchTokens splits text into words and folds each into a search term
+func searchTokens(text string) []searchToken {
+	var tokens []searchToken
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.Mn, r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			tokens = append(tokens, searchToken{term: foldSearchTerm(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{term: foldSearchTerm(text[start:]), start: start, end: len(text)})
+	}
+	return tokens
+}
+
+// foldSearchTerm lower cases a word and drops its accents, so "cafe" finds "Café"
+func foldSearchTerm(word string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(word) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// searchTerms returns the distinct terms of a query or a message
+func searchTerms(text string) []string {
+	seen := make(map[string]bool)
+	terms := []string{}
+	for _, token := range searchTokens(text) {
+		if !seen[token.term] {
+			seen[token.term] = true
+			terms = append(terms, token.term)
+		}
+	}
+	return terms
+}
+
+// indexedMessage holds the fields of a stored message the index uses
+type indexedMessage struct {
+	id        int64
+	sender    string
+	timestamp time.Time
+	terms     []string
+	message   json.RawMessage
+}
+
+func parseIndexedMessage(message []byte) (*indexedMessage, error) {
+	var header struct {
+		ID        int64  `json:"id"`
+		Sender    string `json:"sender"`
+		Content   string `json:"content"`
+		Timestamp string `json:"timestamp"`
+	}
+	if err := json.Unmarshal(message, &header); err != nil {
+		return nil, err
+	}
+
+	// Timestamps are stamped by the server, history from before that may
+	// hold unparseable client values which sort oldest
+	timestamp, _ := time.Parse(time.RFC3339Nano, header.Timestamp)
+	return &indexedMessage{
+		id:        header.ID,
+		sender:    header.Sender,
+		timestamp: timestamp,
+		terms:     searchTerms(header.Content),
+		message:   json.RawMessage(message),
+	}, nil
+}
+
+type searchDocKey struct {
+	roomID string
+	id     int64
+}
+
+// memoryIndex is an in-process inverted index from terms to messages
+type memoryIndex struct {
+	mu       sync.RWMutex
+	docs     map[searchDocKey]*indexedMessage
+	postings map[string]map[searchDocKey]struct{}
+	rooms    map[string][]int64 // message ids per room, oldest first
+}
+
+func newMemoryIndex() *memoryIndex {
+	return &memoryIndex{
+		docs:     make(map[searchDocKey]*indexedMessage),
+		postings: make(map[string]map[searchDocKey]struct{}),
+		rooms:    make(map[string][]int64),
+	}
+}
+
+func (m *memoryIndex) add(roomID string, message []byte) error {
+	doc, err := parseIndexedMessage(message)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := searchDocKey{roomID, doc.id}
+	if _, ok := m.docs[key]; ok {
+		return nil
+	}
+	m.docs[key] = doc
+	for _, term := range doc.terms {
+		if m.postings[term] == nil {
+			m.postings[term] = make(map[searchDocKey]struct{})
+		}
+		m.postings[term][key] = struct{}{}
+	}
+
+	// Keep ids in order when replicas' messages arrive out of order, then
+	// follow the history trim
+	ids := m.rooms[roomID]
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] > doc.id })
+	ids = append(ids[:i], append([]int64{doc.id}, ids[i:]...)...)
+	for len(ids) > maxRoomHistory {
+		m.removeLocked(searchDocKey{roomID, ids[0]})
+		ids = ids[1:]
+	}
+	m.rooms[roomID] = ids
+	return nil
+}
+
+// removeLocked drops a message from the documents and postings
+func (m *memoryIndex) removeLocked(key searchDocKey) {
+	doc, ok := m.docs[key]
+	if !ok {
+		return
+	}
+	delete(m.docs, key)
+	for _, term := range doc.terms {
+		delete(m.postings[term], key)
+		if len(m.postings[term]) == 0 {
+			delete(m.postings, term)
+		}
+	}
+}
+
+func (m *memoryIndex) remove(roomID string, messageID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(searchDocKey{roomID, messageID})
+	ids := m.rooms[roomID]
+	for i, id := range ids {
+		if id == messageID {
+			m.rooms[roomID] = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryIndex) dropRoom(roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range m.rooms[roomID] {
+		m.removeLocked(searchDocKey{roomID, id})
+	}
+	delete(m.rooms, roomID)
+	return nil
+}
+
+func (m *memoryIndex) search(q searchQuery) ([]searchHit, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var candidates []searchDocKey
+	if len(q.Terms) > 0 {
+		// Walk the rarest term's postings and check the others against it
+		terms := append([]string{}, q.Terms...)
+		sort.Slice(terms, func(i, j int) bool {
+			return len(m.postings[terms[i]]) < len(m.postings[terms[j]])
+		})
+	next:
+		for key := range m.postings[terms[0]] {
+			for _, term := range terms[1:] {
+				if _, ok := m.postings[term][key]; !ok {
+					continue next
+				}
+			}
+			candidates = append(candidates, key)
+		}
+	} else {
+		for roomID := range q.Rooms {
+			for _, id := range m.rooms[roomID] {
+				candidates = append(candidates, searchDocKey{roomID, id})
+			}
+		}
+	}
+
+	matches := []searchDocKey{}
+	for _, key := range candidates {
+		doc := m.docs[key]
+		switch {
+		case !q.Rooms[key.roomID]:
+		case q.Sender != "" && doc.sender != q.Sender:
+		case !q.From.IsZero() && doc.timestamp.Before(q.From):
+		case !q.To.IsZero() && doc.timestamp.After(q.To):
+		default:
+			matches = append(matches, key)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := m.docs[matches[i]], m.docs[matches[j]]
+		if !a.timestamp.Equal(b.timestamp) {
+			return a.timestamp.After(b.timestamp)
+		}
+		return a.id > b.id
+	})
+
+	hits := []searchHit{}
+	for i := q.Offset; i < len(matches) && len(hits) < q.Limit; i++ {
+		hits = append(hits, searchHit{RoomID: matches[i].roomID, Message: m.docs[matches[i]].message})
+	}
+	return hits, len(matches), nil
+}
+
+// RediSearch backend. Each message is a hash under searchDocPrefix holding
+// the folded terms, so both backends match the same way, and a sorted set
+// per room tracks the room's documents for trimming and deletion.
+const (
+	redisSearchIndex = "idx:messages"
+	searchDocPrefix  = "search:msg:"
+)
+
+func redisSearchDocKey(roomID string, id int64) string {
+	return searchDocPrefix + roomID + ":" + strconv.FormatInt(id, 10)
+}
+
+func redisSearchRoomKey(roomID string) string {
+	return "search:room:" + roomID
+}
+
+// ensureRedisSearchIndex creates the RediSearch index unless it exists and
+// fills it from the stored histories. It fails when the module is missing.
+func ensureRedisSearchIndex() error {
+	_, err := rdb.Do(ctx, "FT.INFO", redisSearchIndex).Result()
+	if err == nil {
+		return nil
+	}
+	if msg := strings.ToLower(err.Error()); !strings.Contains(msg, "unknown index") && !strings.Contains(msg, "no such index") {
+		return err
+	}
+
+	err = rdb.Do(ctx, "FT.CREATE", redisSearchIndex, "ON", "HASH", "PREFIX", 1, searchDocPrefix, "STOPWORDS", 0,
+		"SCHEMA",
+		"terms", "TEXT",
+		"sender", "TAG", "CASESENSITIVE",
+		"room", "TAG", "CASESENSITIVE",
+		"ts", "NUMERIC", "SORTABLE",
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	count, err := reindexHistory(redisSearch{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d messages in RediSearch\n", count)
+	return nil
+}
+
+type redisSearch struct{}
+
+func (redisSearch) add(roomID string, message []byte) error {
+	doc, err := parseIndexedMessage(message)
+	if err != nil {
+		return err
+	}
+
+	key := redisSearchDocKey(roomID, doc.id)
+	roomKey := redisSearchRoomKey(roomID)
+
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, key, map[string]interface{}{
+		"terms":   strings.Join(doc.terms, " "),
+		"sender":  doc.sender,
+		"room":    roomID,
+		"ts":      doc.timestamp.UnixMilli(),
+		"message": string(message),
+	})
+	pipe.ZAdd(ctx, roomKey, redis.Z{Score: float64(doc.id), Member: key})
+	// Follow the history trim
+	stale := pipe.ZRange(ctx, roomKey, 0, -int64(maxRoomHistory)-1)
+	pipe.ZRemRangeByRank(ctx, roomKey, 0, -int64(maxRoomHistory)-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	if keys := stale.Val(); len(keys) > 0 {
+		return rdb.Del(ctx, keys...).Err()
+	}
+	return nil
+}
+
+func (redisSearch) remove(roomID string, messageID int64) error {
+	key := redisSearchDocKey(roomID, messageID)
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.ZRem(ctx, redisSearchRoomKey(roomID), key)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (redisSearch) dropRoom(roomID string) error {
+	keys, err := rdb.ZRange(ctx, redisSearchRoomKey(roomID), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	return rdb.Del(ctx, append(keys, redisSearchRoomKey(roomID))...).Err()
+}
+
+func (redisSearch) search(q searchQuery) ([]searchHit, int, error) {
+	if len(q.Rooms) == 0 {
+		return []searchHit{}, 0, nil
+	}
+
+	var parts []string
+	if len(q.Terms) > 0 {
+		// Terms are letters and digits only, nothing to escape
+		parts = append(parts, "@terms:("+strings.Join(q.Terms, " ")+")")
+	}
+	if q.Sender != "" {
+		parts = append(parts, "@sender:{"+escapeSearchTag(q.Sender)+"}")
+	}
+	rooms := make([]string, 0, len(q.Rooms))
+	for roomID := range q.Rooms {
+		rooms = append(rooms, escapeSearchTag(roomID))
+	}
+	parts = append(parts, "@room:{"+strings.Join(rooms, " | ")+"}")
+	if !q.From.IsZero() || !q.To.IsZero() {
+		from, to := "-inf", "+inf"
+		if !q.From.IsZero() {
+			from = strconv.FormatInt(q.From.UnixMilli(), 10)
+		}
+		if !q.To.IsZero() {
+			to = strconv.FormatInt(q.To.UnixMilli(), 10)
+		}
+		parts = append(parts, "@ts:["+from+" "+to+"]")
+	}
+
+	res, err := rdb.Do(ctx, "FT.SEARCH", redisSearchIndex, strings.Join(parts, " "),
+		"VERBATIM", "NOCONTENT", "SORTBY", "ts", "DESC", "LIMIT", q.Offset, q.Limit, "DIALECT", 2).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	total, keys := parseFTSearchKeys(res)
+
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HMGet(ctx, key, "room", "message")
+	}
+	if len(keys) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, 0, err
+		}
+	}
+
+	hits := []searchHit{}
+	for _, cmd := range cmds {
+		values := cmd.Val()
+		if len(values) != 2 {
+			continue
+		}
+		roomID, _ := values[0].(string)
+		message, _ := values[1].(string)
+		if message != "" {
+			hits = append(hits, searchHit{RoomID: roomID, Message: json.RawMessage(message)})
+		}
+	}
+	return hits, total, nil
+}
+
+// escapeSearchTag escapes a value for a RediSearch tag query
+func escapeSearchTag(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// parseFTSearchKeys reads the total and the document keys of an FT.SEARCH
+// NOCONTENT reply, which is an array over RESP2 and a map over RESP3
+func parseFTSearchKeys(res interface{}) (int, []string) {
+	var total int64
+	keys := []string{}
+
+	switch reply := res.(type) {
+	case []interface{}:
+		if len(reply) > 0 {
+			total, _ = reply[0].(int64)
+			for _, key := range reply[1:] {
+				if s, ok := key.(string); ok {
+					keys = append(keys, s)
+				}
+			}
+		}
+	case map[interface{}]interface{}:
+		total, _ = reply["total_results"].(int64)
+		results, _ := reply["results"].([]interface{})
+		for _, result := range results {
+			fields, _ := result.(map[interface{}]interface{})
+			if s, ok := fields["id"].(string); ok {
+				keys = append(keys, s)
+			}
+		}
+	}
+	return int(total), keys
+}
+
+// highlightSnippet returns an HTML escaped excerpt of content around the
+// first matching term, with every matching word wrapped in <mark>
+func highlightSnippet(content string, terms []string) string {
+	want := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		want[term] = true
+	}
+	var spans []searchToken
+	for _, token := range searchTokens(content) {
+		if want[token.term] {
+			spans = append(spans, token)
+		}
+	}
+
+	start, end := 0, len(content)
+	if utf8.RuneCountInString(content) > searchSnippetRunes {
+		if len(spans) > 0 {
+			start = moveRunes(content, spans[0].start, -searchSnippetRunes/4)
+		}
+		end = moveRunes(content, start, searchSnippetRunes)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, span := range spans {
+		if span.start < pos || span.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(content[pos:span.start]))
+		b.WriteString("<mark>" + html.EscapeString(content[span.start:span.end]) + "</mark>")
+		pos = span.end
+	}
+	b.WriteString(html.EscapeString(content[pos:end]))
+	if end < len(content) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// moveRunes returns the byte offset n runes after (or before, for negative
+// n) offset i of s, stopping at either end
+func moveRunes(s string, i, n int) int {
+	for ; n > 0 && i < len(s); n-- {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	for ; n < 0 && i > 0; n++ {
+		_, size := utf8.DecodeLastRuneInString(s[:i])
+		i -= size
+	}
+	return i
+}
+
+// parseSearchTime accepts an RFC 3339 time or a date. A date given as the
+// end of a range includes that whole day.
+func parseSearchTime(v string, endOfRange bool) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if endOfRange {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, true
+}
+
+// readableRooms returns the ids of the rooms a user may read: every live and
+// archived room except those the user is banned from. The bans of all rooms
+// are looked up in one round trip.
+func readableRooms(username string) (map[string]bool, error) {
+	roomIDs, err := rdb.SUnion(ctx, "chatrooms", "chatrooms:archived").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := rdb.Pipeline()
+	bans := make([]*redis.StringCmd, len(roomIDs))
+	for i, id := range roomIDs {
+		bans[i] = pipe.HGet(ctx, roomBansKey(id), username)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	rooms := make(map[string]bool, len(roomIDs))
+	for i, id := range roomIDs {
+		restrictionJSON, err := bans[i].Result()
+		if err == nil {
+			// Unreadable bans keep the room hidden, as isBanned would
+			if ban, err := parseRestriction(restrictionJSON); ban != nil || err != nil {
+				continue
+			}
+		}
+		rooms[id] = true
+	}
+	return rooms, nil
+}
+
+// roomNames looks up the names of the rooms in a page of search hits
+func roomNames(hits []searchHit) map[string]string {
+	var roomIDs, keys []string
+	seen := make(map[string]bool)
+	for _, hit := range hits {
+		if !seen[hit.RoomID] {
+			seen[hit.RoomID] = true
+			roomIDs = append(roomIDs, hit.RoomID)
+			keys = append(keys, "chatroom:"+hit.RoomID)
+		}
+	}
+
+	names := make(map[string]string, len(roomIDs))
+	if len(keys) == 0 {
+		return names
+	}
+	stored, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		fmt.Printf("Error fetching chatrooms: %v\n", err)
+		return names
+	}
+	for i, v := range stored {
+		chatroomJSON, ok := v.(string)
+		if !ok {
+			continue // Deleted since it was searched
+		}
+		var room Chatroom
+		if json.Unmarshal([]byte(chatroomJSON), &room) == nil {
+			names[roomIDs[i]] = room.Name
+		}
+	}
+	return names
+}
+
+// searchHandler finds chat messages in the rooms the caller may read, newest
+// first. Query parameters: q (search terms), sender, roomId, from and to
+// (RFC 3339 times or dates), limit and offset. Either q or sender is required.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	params := r.URL.Query()
+	q := searchQuery{
+		Terms:  searchTerms(params.Get("q")),
+		Sender: strings.TrimSpace(params.Get("sender")),
+		Limit:  defaultSearchLimit,
+	}
+
+	var errs ValidationErrors
+	if len(q.Terms) == 0 && q.Sender == "" {
+		errs.add("q", "required", "Search terms or a sender are required")
+	}
+	if len(q.Terms) > maxSearchTerms {
+		errs.add("q", "too_many_terms", "At most %d search terms are allowed", maxSearchTerms)
+	}
+	if v := params.Get("from"); v != "" {
+		var ok bool
+		if q.From, ok = parseSearchTime(v, false); !ok {
+			errs.add("from", "invalid", "From must be an RFC 3339 time or a YYYY-MM-DD date")
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		var ok bool
+		if q.To, ok = parseSearchTime(v, true); !ok {
+			errs.add("to", "invalid", "To must be an RFC 3339 time or a YYYY-MM-DD date")
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.To.Before(q.From) {
+		errs.add("to", "before_from", "To must not be before from")
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			errs.add("limit", "invalid", "Limit must be between 1 and %d", maxSearchLimit)
+		}
+		q.Limit = limit
+	}
+	if v := params.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			errs.add("offset", "invalid", "Offset must be a non-negative number")
+		}
+		q.Offset = offset
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if roomID := params.Get("roomId"); roomID != "" {
+		room, err := getChatroom(roomID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+			return
+		}
+		if isBanned(room.ID, username) {
+			writeError(w, http.StatusForbidden, errCodeBanned, "You are banned from this chatroom")
+			return
+		}
+		q.Rooms = map[string]bool{room.ID: true}
+	} else {
+		var err error
+		if q.Rooms, err = readableRooms(username); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching chatrooms")
+			return
+		}
+	}
+
+	hits, total, err := messageIndex.search(q)
+	if err != nil {
+		fmt.Printf("Error searching messages: %v\n", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error searching messages")
+		return
+	}
+
+	names := roomNames(hits)
+	results := make([]map[string]interface{}, 0, len(hits))
+	for _, hit := range hits {
+		var body struct {
+			Content string `json:"content"`
+		}
+		json.Unmarshal(hit.Message, &body)
+
+		results = append(results, map[string]interface{}{
+			"roomId":    hit.RoomID,
+			"roomName":  names[hit.RoomID],
+			"message":   hit.Message,
+			"highlight": highlightSnippet(body.Content, q.Terms),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+		"total":   total,
+		"limit":   q.Limit,
+		"offset":  q.Offset,
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchTokens(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+		want []searchToken
+	}{
+		{"empty", "", nil},
+		{"punctuation only", "?! -- ...", nil},
+		{"words", "Hello, world!", []searchToken{{"hello", 0, 5}, {"world", 7, 12}}},
+		{"numbers", "room 42b", []searchToken{{"room", 0, 4}, {"42b", 5, 8}}},
+		{"accents folded", "Café crème", []searchToken{{"cafe", 0, 5}, {"creme", 6, 12}}},
+		{"combining marks kept in the word", "cafe\u0301 ok", []searchToken{{"cafe", 0, 6}, {"ok", 7, 9}}},
+		{"compatibility forms", "ﬁne", []searchToken{{"fine", 0, 5}}},
+		{"non latin", "Привет мир", []searchToken{{"привет", 0, 12}, {"мир", 13, 19}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := searchTokens(tc.text)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("token %d = %v, want %v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"the cat saw THE Cat", "the cat saw"},
+		{"Résumé resume", "resume"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.text, func(t *testing.T) {
+			if got := strings.Join(searchTerms(tc.text), " "); got != tc.want {
+				t.Errorf("searchTerms(%q) = %q, want %q", tc.text, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	long := strings.Repeat("x ", 100) + "needle" + strings.Repeat(" y", 100)
+
+	cases := []struct {
+		name    string
+		content string
+		terms   []string
+		want    string
+	}{
+		{"no match", "nothing here", []string{"cat"}, "nothing here"},
+		{"every occurrence", "Cat and cat", []string{"cat"}, "<mark>Cat</mark> and <mark>cat</mark>"},
+		{"several terms", "big red dog", []string{"dog", "big"}, "<mark>big</mark> red <mark>dog</mark>"},
+		{"accented match", "un café noir", []string{"cafe"}, "un <mark>café</mark> noir"},
+		{"escaped", "<b>cat</b> & co", []string{"cat"}, "&lt;b&gt;<mark>cat</mark>&lt;/b&gt; &amp; co"},
+		{"whole words only", "concatenate", []string{"cat"}, "concatenate"},
+		{"long text around the first match", long, []string{"needle"},
+			"…" + strings.Repeat("x ", 20) + "<mark>needle</mark>" + strings.Repeat(" y", 57) + "…"},
+		{"long text without a match", long, []string{"cat"}, strings.Repeat("x ", 80) + "…"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := highlightSnippet(tc.content, tc.terms); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// useTestIndex gives a test its own in-process search index
+func useTestIndex(t *testing.T) {
+	t.Helper()
+
+	previous := messageIndex
+	messageIndex = newMemoryIndex()
+	t.Cleanup(func() { messageIndex = previous })
+}
+
+// search calls the search handler as username and returns the results
+func search(t *testing.T, username, query string) []map[string]interface{} {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil)
+	r.Header.Set("Authorization", testSession(t, username))
+	w := httptest.NewRecorder()
+	searchHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("search %q: status %d: %s", query, w.Code, w.Body.String())
+	}
+
+	var body struct {
+		Results []map[string]interface{} `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding search results: %v", err)
+	}
+	return body.Results
+}
+
+func TestSearchUsesServerTimestamps(t *testing.T) {
+	useTestRedis(t)
+	useTestIndex(t)
+	room := testRoom(t, "alice")
+
+	before := time.Now()
+	backdated := before.AddDate(-5, 0, 0).Format(time.RFC3339)
+	stored, err := submitChatMessage(room.ID, "alice", map[string]interface{}{
+		"type": frameChat, "content": "backdated hello", "timestamp": backdated,
+	})
+	if err != nil {
+		t.Fatalf("posting: %v", err)
+	}
+
+	var msg struct {
+		Timestamp time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(stored, &msg); err != nil {
+		t.Fatalf("decoding stored message: %v", err)
+	}
+	if msg.Timestamp.Before(before) {
+		t.Errorf("stored timestamp %v, want the time it was posted", msg.Timestamp)
+	}
+
+	from := before.AddDate(0, 0, -1).Format(time.DateOnly)
+	if got := search(t, "alice", "q=hello&from="+from); len(got) != 1 {
+		t.Errorf("search from %s found %d messages, want 1", from, len(got))
+	}
+	to := before.AddDate(-1, 0, 0).Format(time.DateOnly)
+	if got := search(t, "alice", "q=hello&to="+to); len(got) != 0 {
+		t.Errorf("search to %s found %d messages, want 0", to, len(got))
+	}
+}
+
+func TestSearchSkipsBannedRooms(t *testing.T) {
+	mr := useTestRedis(t)
+	useTestIndex(t)
+	open := testRoom(t, "alice")
+	banned := testRoom(t, "alice")
+	lapsed := testRoom(t, "alice")
+
+	for _, room := range []*Chatroom{open, banned, lapsed} {
+		if _, err := submitChatMessage(room.ID, "alice", map[string]interface{}{"type": frameChat, "content": "hello " + room.ID}); err != nil {
+			t.Fatalf("posting: %v", err)
+		}
+	}
+	if err := restrictUser(roomBansKey(banned.ID), "bob", "alice", "", 0); err != nil {
+		t.Fatalf("banning bob: %v", err)
+	}
+	expired := time.Now().Add(-time.Minute)
+	restriction, _ := json.Marshal(Restriction{Username: "bob", By: "alice", ExpiresAt: &expired})
+	mr.HSet(roomBansKey(lapsed.ID), "bob", string(restriction))
+
+	got := map[string]string{}
+	for _, result := range search(t, "bob", "q=hello") {
+		got[result["roomId"].(string)], _ = result["roomName"].(string)
+	}
+	if _, ok := got[banned.ID]; ok {
+		t.Errorf("results include the room bob is banned from")
+	}
+	for _, room := range []*Chatroom{open, lapsed} {
+		if name, ok := got[room.ID]; !ok || name != room.Name {
+			t.Errorf("result for room %s = %q, %v, want %q", room.ID, name, ok, room.Name)
+		}
+	}
+}
+
+func TestSharedMemoryIndex(t *testing.T) {
+	useTestRedis(t)
+
+	replica := func() sharedMemoryIndex {
+		sub := rdb.Subscribe(ctx, searchSyncChannel)
+		if _, err := sub.Receive(ctx); err != nil {
+			t.Fatalf("subscribing: %v", err)
+		}
+		t.Cleanup(func() { sub.Close() })
+		index := sharedMemoryIndex{newMemoryIndex()}
+		go index.follow(sub)
+		return index
+	}
+	a, b := replica(), replica()
+
+	found := func(index sharedMemoryIndex, term string) int {
+		_, total, err := index.search(searchQuery{Terms: []string{term}, Rooms: map[string]bool{"r1": true, "r2": true}, Limit: 10})
+		if err != nil {
+			t.Fatalf("searching: %v", err)
+		}
+		return total
+	}
+
+	a.add("r1", []byte(`{"id":1,"sender":"alice","content":"apple"}`))
+	b.add("r2", []byte(`{"id":1,"sender":"bob","content":"apple"}`))
+	a.add("r1", []byte(`{"id":2,"sender":"alice","content":"pear"}`))
+	for _, index := range []sharedMemoryIndex{a, b} {
+		waitFor(t, "messages of both replicas", func() bool { return found(index, "apple") == 2 && found(index, "pear") == 1 })
+	}
+
+	b.remove("r1", 2)
+	waitFor(t, "the removal on the other replica", func() bool { return found(a, "pear") == 0 })
+
+	a.dropRoom("r2")
+	waitFor(t, "the dropped room on the other replica", func() bool { return found(b, "apple") == 1 })
+}
@@ -3,16 +3,20 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Chatroom struct defines the properties of a chatroom
@@ -23,6 +27,74 @@ type Chatroom struct {
 	CreatorID   string    `json:"creatorId"`
 	CreatedAt   time.Time `json:"createdAt"`
 	UserCount   int       `json:"userCount"`
+	Topic       string    `json:"topic,omitempty"`
+	Archived    bool      `json:"archived,omitempty"`
+}
+
+// getChatroom loads a chatroom from Redis
+func getChatroom(roomID string) (*Chatroom, error) {
+	if roomID == "" {
+		return nil, redis.Nil
+	}
+
+	chatroomJSON, err := rdb.Get(ctx, "chatroom:"+roomID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var chatroom Chatroom
+	if err := json.Unmarshal([]byte(chatroomJSON), &chatroom); err != nil {
+		return nil, err
+	}
+	return &chatroom, nil
+}
+
+// maxChatroomUpdateAttempts bounds the retries of updateChatroom
+const maxChatroomUpdateAttempts = 10
+
+var errChatroomContended = errors.New("chatroom kept changing during the update")
+
+// updateChatroom applies change to the stored chatroom and returns the result.
+// The read and the write run in a WATCH transaction that is retried when
+// another writer got in between, so concurrent changes to different fields,
+// such as a rename and a user count update, are never lost.
+func updateChatroom(roomID string, change func(room *Chatroom)) (*Chatroom, error) {
+	key := "chatroom:" + roomID
+	var room Chatroom
+
+	update := func(tx *redis.Tx) error {
+		chatroomJSON, err := tx.Get(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		room = Chatroom{}
+		if err := json.Unmarshal([]byte(chatroomJSON), &room); err != nil {
+			return err
+		}
+
+		change(&room)
+		roomJSON, err := json.Marshal(room)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, roomJSON, 0)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxChatroomUpdateAttempts; i++ {
+		err := rdb.Watch(ctx, update, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &room, nil
+	}
+	return nil, errChatroomContended
 }
 
 var rdb *redis.Client
@@ -32,38 +104,102 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	EnableCompression: compressionEnabled,
+	Subprotocols:      supportedSubprotocols,
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeError(w, status, errCodeUpgradeFailed, "Could not upgrade connection: "+reason.Error())
+	},
+}
+
+// Client is a WebSocket connection registered with a hub
+type Client struct {
+	conn     *websocket.Conn
+	id       string
+	username string
+	encoding string         // frame encoding negotiated through Sec-WebSocket-Protocol
+	profile  ProfileSnippet // loaded on connect, so Run never reads profiles
 }
 
 // Hub manages WebSocket connections for a specific chatroom
 type Hub struct {
-	clients    map[*websocket.Conn]string
-	broadcast  chan []byte
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
-	roomID     string
+	clients map[*websocket.Conn]*Client
+	// subscribers receive the same frames over SSE and long polling
+	subscribers map[*subscriber]bool
+	subscribe   chan *subscriber
+	unsubscribe chan *subscriber
+	broadcast   chan []byte
+	register    chan *Client
+	unregister  chan *websocket.Conn
+	ephemeral   chan ephemeralSignal
+	direct      chan directMessage
+	kick        chan kickRequest
+	inspect     chan chan HubStats
+	closeAll    chan string
+	presence    chan presenceRequest
+	notify      chan userNotice
+	typing      map[*websocket.Conn]typingState
+	roomID      string
+	// stop disconnects everyone and ends Run, done is closed once it has
+	stop chan string
+	done chan struct{}
+}
+
+// hubSend hands v to a hub's loop through ch. It gives up once the hub has
+// stopped, so connections left over from a deleted room never block.
+func hubSend[T any](h *Hub, ch chan T, v T) {
+	select {
+	case ch <- v:
+	case <-h.done:
+	}
 }
 
+// broadcastQueueSize is how many broadcasts may wait for a busy hub
+const broadcastQueueSize = 256
+
 // Map to keep track of all active hubs (one per chatroom)
 var chatHubs = make(map[string]*Hub)
 var hubsMutex = &sync.Mutex{}
 
+// lookupHub returns the running hub of a room, or nil when nobody is connected
+func lookupHub(roomID string) *Hub {
+	hubsMutex.Lock()
+	defer hubsMutex.Unlock()
+	return chatHubs[roomID]
+}
+
 func newHub(roomID string) *Hub {
 	return &Hub{
-		clients:    make(map[*websocket.Conn]string),
-		broadcast:  make(chan []byte),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
-		roomID:     roomID,
+		clients:     make(map[*websocket.Conn]*Client),
+		subscribers: make(map[*subscriber]bool),
+		subscribe:   make(chan *subscriber),
+		unsubscribe: make(chan *subscriber),
+		broadcast:   make(chan []byte, broadcastQueueSize),
+		register:    make(chan *Client),
+		unregister:  make(chan *websocket.Conn),
+		ephemeral:   make(chan ephemeralSignal),
+		direct:      make(chan directMessage),
+		kick:        make(chan kickRequest),
+		inspect:     make(chan chan HubStats),
+		closeAll:    make(chan string),
+		stop:        make(chan string),
+		done:        make(chan struct{}),
+		presence:    make(chan presenceRequest),
+		notify:      make(chan userNotice),
+		typing:      make(map[*websocket.Conn]typingState),
+		roomID:      roomID,
 	}
 }
 
 func (h *Hub) Run() {
+	// Periodically expire typing indicators of clients that went quiet
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case conn := <-h.register:
-			// on register, set a unique session in Redis
-			userID := generateUserID()
-			h.clients[conn] = userID
+		case client := <-h.register:
+			conn := client.conn
+			h.clients[conn] = client
 
 			// Increment user count in chatroom
 			h.updateUserCount(1)
@@ -71,20 +207,29 @@ func (h *Hub) Run() {
 			fmt.Printf("Client connected to room %s: %s\n", h.roomID, conn.RemoteAddr())
 
 			// Notify all clients in the room about new user
-			h.sendSystemMessage("A new user has joined the chat")
+			h.sendSystemMessage(noticeUserJoined)
+			h.emitPresenceEvent(eventUserJoined, client.username, client.id)
+
+			// Everyone sees the updated list of online users
+			h.broadcastUserList()
 
 		case conn := <-h.unregister:
-			if _, ok := h.clients[conn]; ok {
+			if client, ok := h.clients[conn]; ok {
 				delete(h.clients, conn)
 				conn.Close()
 
+				// Clear any typing indicator left behind by the client
+				h.clearTyping(conn)
+
 				// Decrement user count in chatroom
 				h.updateUserCount(-1)
 
 				fmt.Printf("Client disconnected from room %s: %s\n", h.roomID, conn.RemoteAddr())
 
 				// Notify all clients in the room
-				h.sendSystemMessage("A user has left the chat")
+				h.sendSystemMessage(noticeUserLeft)
+				h.emitPresenceEvent(eventUserLeft, client.username, client.id)
+				h.broadcastUserList()
 
 				// If no clients left, consider cleaning up the hub
 				if len(h.clients) == 0 {
@@ -93,52 +238,109 @@ func (h *Hub) Run() {
 				}
 			}
 
+		case sub := <-h.subscribe:
+			h.subscribers[sub] = true
+			h.updateUserCount(1)
+			h.sendSystemMessage(noticeUserJoined)
+			h.emitPresenceEvent(eventUserJoined, sub.username, sub.id)
+			h.broadcastUserList()
+
+		case sub := <-h.unsubscribe:
+			if h.subscribers[sub] {
+				h.dropSubscriber(sub)
+				h.updateUserCount(-1)
+				h.sendSystemMessage(noticeUserLeft)
+				h.emitPresenceEvent(eventUserLeft, sub.username, sub.id)
+				h.broadcastUserList()
+			}
+
 		case message := <-h.broadcast:
-			for client := range h.clients {
-				err := client.WriteMessage(websocket.TextMessage, message)
-				if err != nil {
-					fmt.Println("Error writing message to client:", err)
-					client.Close()
-					delete(h.clients, client)
+			h.fanOut(message, nil)
+
+		case sig := <-h.ephemeral:
+			h.handleEphemeral(sig)
+
+		case dm := <-h.direct:
+			if client, ok := h.clients[dm.conn]; ok {
+				h.writeTo(client, newFrameCache(dm.message))
+			}
+
+		case req := <-h.kick:
+			h.handleKick(req)
+
+		case reply := <-h.inspect:
+			reply <- h.stats()
+
+		case reason := <-h.closeAll:
+			h.disconnectAll(reason)
+
+		case reason := <-h.stop:
+			h.disconnectAll(reason)
+			close(h.done)
+			return
+
+		case req := <-h.presence:
+			if req.sub != nil {
+				if h.subscribers[req.sub] {
+					h.deliver(req.sub, h.userListFrame())
 				}
+			} else if client, ok := h.clients[req.conn]; ok {
+				h.sendUserList(client)
 			}
+
+		case notice := <-h.notify:
+			h.sendToUser(notice)
+
+		case now := <-ticker.C:
+			h.expireTyping(now)
 		}
 	}
 }
 
-// updateUserCount updates the user count in the chatroom stored in Redis
-func (h *Hub) updateUserCount(delta int) {
-	chatroomKey := "chatroom:" + h.roomID
-
-	// Get current chatroom data
-	chatroomJSON, err := rdb.Get(ctx, chatroomKey).Result()
-	if err != nil {
-		fmt.Printf("Error getting chatroom data: %v\n", err)
-		return
+// fanOut writes a message to every client in the room except the given one
+func (h *Hub) fanOut(message []byte, except *websocket.Conn) {
+	frames := newFrameCache(message)
+	for conn, client := range h.clients {
+		if conn == except {
+			continue
+		}
+		h.writeTo(client, frames)
+	}
+	for sub := range h.subscribers {
+		h.deliver(sub, message)
 	}
+}
 
-	var chatroom Chatroom
-	if err := json.Unmarshal([]byte(chatroomJSON), &chatroom); err != nil {
-		fmt.Printf("Error unmarshalling chatroom data: %v\n", err)
+// writeTo writes a frame to a single client, dropping the client if it fails
+func (h *Hub) writeTo(client *Client, frames *frameCache) {
+	prepared, size, err := frames.prepare(client.encoding)
+	if err != nil {
+		fmt.Println("Error encoding message for client:", err)
 		return
 	}
 
-	// Update user count
-	chatroom.UserCount = len(h.clients) // Use actual count instead of incrementing
-
-	// Save updated chatroom
-	updatedJSON, err := json.Marshal(chatroom)
+	err = writeFrame(client.conn, prepared, size)
 	if err != nil {
-		fmt.Printf("Error marshalling chatroom data: %v\n", err)
-		return
+		fmt.Println("Error writing message to client:", err)
+		client.conn.Close()
+		delete(h.clients, client.conn)
+		delete(h.typing, client.conn)
 	}
+}
 
-	if err := rdb.Set(ctx, chatroomKey, updatedJSON, 0).Err(); err != nil {
+// updateUserCount updates the user count in the chatroom stored in Redis
+func (h *Hub) updateUserCount(delta int) {
+	// Use actual count instead of incrementing
+	count := len(h.clients) + len(h.subscribers)
+
+	if _, err := updateChatroom(h.roomID, func(room *Chatroom) { room.UserCount = count }); err != nil {
 		fmt.Printf("Error updating chatroom data: %v\n", err)
 	}
 }
 
-// sendSystemMessage broadcasts a system message to all clients in the room
+// sendSystemMessage broadcasts a system message to all clients in the room.
+// It is called from within Run, so it writes to the clients directly instead
+// of going through the broadcast channel.
 func (h *Hub) sendSystemMessage(text string) {
 	msg := map[string]interface{}{
 		"type":      "system",
@@ -149,76 +351,188 @@ func (h *Hub) sendSystemMessage(text string) {
 
 	msgJSON, err := json.Marshal(msg)
 	if err == nil {
-		h.broadcast <- msgJSON
+		h.fanOut(msgJSON, nil)
+	}
+}
+
+// System messages announcing that someone joined or left a room
+const (
+	noticeUserJoined = "A new user has joined the chat"
+	noticeUserLeft   = "A user has left the chat"
+)
+
+// directMessage is a frame meant for a single client of a hub
+type directMessage struct {
+	conn    *websocket.Conn
+	message []byte
+}
+
+// errorFrame builds an error message sent privately to a client
+func errorFrame(code, text string) []byte {
+	msg := map[string]interface{}{
+		"type":      "error",
+		"code":      code,
+		"content":   text,
+		"sender":    "system",
+		"timestamp": time.Now(),
 	}
+
+	msgJSON, _ := json.Marshal(msg)
+	return msgJSON
 }
 
 func serveWs(w http.ResponseWriter, r *http.Request) {
 	// Get room ID from query parameters
 	roomID := r.URL.Query().Get("roomId")
 	if roomID == "" {
-		http.Error(w, "Room ID is required", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Room ID is required")
+		return
+	}
+
+	if rateLimited(w, wsConnectRateLimit, clientIP(r)) {
 		return
 	}
 
 	// Check if the chatroom exists in Redis
-	existsVal, err := rdb.Exists(ctx, "chatroom:"+roomID).Result()
-	if err != nil || existsVal == 0 {
-		http.Error(w, "Chatroom not found", http.StatusNotFound)
+	room, err := getChatroom(roomID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+		return
+	}
+	if room.Archived {
+		writeError(w, http.StatusGone, errCodeRoomArchived, "Chatroom is archived")
 		return
 	}
 
-	// Get or create hub for this room
-	hubsMutex.Lock()
-	hub, ok := chatHubs[roomID]
-	if !ok {
-		hub = newHub(roomID)
-		chatHubs[roomID] = hub
-		go hub.Run()
+	// Bans and mutes are keyed on the username, so every connection needs a session
+	username := extractUsernameFromToken(requestToken(r))
+	if username == "" {
+		writeError(w, http.StatusUnauthorized, errCodeAuthRequired, "Authorization required")
+		return
+	}
+
+	if isBanned(roomID, username) {
+		writeError(w, http.StatusForbidden, errCodeBanned, "You are banned from this chatroom")
+		return
 	}
-	hubsMutex.Unlock()
 
 	// Upgrade HTTP connection to WebSocket
+	// On failure the upgrader has already answered through upgrader.Error
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		http.Error(w, "Could not upgrade connection", http.StatusInternalServerError)
+		fmt.Println("Error upgrading connection:", err)
 		return
 	}
 
-	// Register the client with the hub
-	hub.register <- conn
+	if compressionEnabled {
+		if err := conn.SetCompressionLevel(compressionLevel); err != nil {
+			fmt.Println("Error setting compression level:", err)
+		}
+	}
+
+	// Get or create hub for this room and register the client with it
+	hub := hubFor(roomID)
+	client := &Client{conn: conn, id: generateUserID(), username: username, encoding: clientEncoding(conn), profile: profileSnippet(username)}
+	hubSend(hub, hub.register, client)
+
+	// Every frame counts against the per connection frame limit before it is
+	// even decoded. The message limit applies on top to everything but
+	// ephemeral signals, which typing clients send far more often.
+	frameLimit := newLocalBucket(wsFrameRateLimit)
+	messageLimit := newLocalBucket(wsMessageRateLimit)
 
 	// Handle incoming messages
 	go func() {
 		defer func() {
-			hub.unregister <- conn
+			hubSend(hub, hub.unregister, conn)
 		}()
 
 		for {
-			_, message, err := conn.ReadMessage()
+			messageType, message, err := conn.ReadMessage()
 			if err != nil {
 				fmt.Println("Error reading message:", err)
 				break
 			}
 
-			// Process and broadcast the message
+			if !frameLimit.allow() {
+				closeRateLimited(conn)
+				break
+			}
+
+			// Binary clients are translated to the JSON envelope on the way in
+			message, err = decodeFrame(client.encoding, messageType, message)
+			if err != nil {
+				fmt.Println("Error decoding message:", err)
+				continue
+			}
+
+			// Only JSON envelopes are understood, anything else is dropped
 			var msg map[string]interface{}
-			if err := json.Unmarshal(message, &msg); err == nil {
-				// Add timestamp if not present
-				if _, ok := msg["timestamp"]; !ok {
-					msg["timestamp"] = time.Now()
+			invalid := json.Unmarshal(message, &msg) != nil || msg == nil
+			msgType, _ := msg["type"].(string)
+
+			if !isEphemeralFrame(msgType) && !messageLimit.allow() {
+				closeRateLimited(conn)
+				break
+			}
+
+			if invalid {
+				hubSend(hub, hub.direct, directMessage{conn: conn, message: errorFrame(errCodeInvalidRequest, "Frames must be JSON objects")})
+				continue
+			}
+
+			// Frames carry the time the server received them, whatever the
+			// client claims
+			msg["timestamp"] = time.Now()
+
+			// Clients cannot speak under someone else's name
+			msg["sender"] = client.username
+
+			// Muted users are read-only, they may only mark messages as read
+			// and ask who is online
+			readOnly := msgType == frameMarkRead || msgType == frameRefreshUserList
+			if !readOnly && isMuted(roomID, client.username) {
+				if msgType == frameChat {
+					hubSend(hub, hub.direct, directMessage{conn: conn, message: errorFrame(errCodeMuted, "You are muted in this chatroom")})
+				}
+				continue
+			}
+
+			switch {
+			case isEphemeralFrame(msgType):
+				// Ephemeral signals skip the chat message path entirely
+				if payload, err := json.Marshal(msg); err == nil {
+					hubSend(hub, hub.ephemeral, ephemeralSignal{conn: conn, kind: msgType, sender: client.username, payload: payload})
 				}
 
-				// Re-marshal with added/modified fields
-				updatedMsg, err := json.Marshal(msg)
-				if err == nil {
-					hub.broadcast <- updatedMsg
-				} else {
-					hub.broadcast <- message
+			case msgType == frameRefreshUserList:
+				// User list requests are answered privately
+				hubSend(hub, hub.presence, presenceRequest{conn: conn})
+
+			case msgType == frameMarkRead:
+				// Read markers are stored and announced as receipts, not relayed
+				handleMarkRead(hub, client.username, msg)
+
+			case msgType == frameChat && isCommand(msg):
+				// Slash commands are dispatched instead of being posted
+				runCommand(hub, client, msg)
+
+			case msgType == frameChat:
+				// Chat messages are validated, filtered, stored and then broadcast
+				if _, err := submitChatMessage(roomID, client.username, msg); err != nil {
+					var rejection *messageRejection
+					if errors.As(err, &rejection) {
+						hubSend(hub, hub.direct, directMessage{conn: conn, message: errorFrame(rejection.Code, rejection.Message)})
+					} else {
+						fmt.Printf("Error publishing message: %v\n", err)
+					}
 				}
-			} else {
-				// If we couldn't parse as JSON, broadcast as-is
-				hub.broadcast <- message
+
+			default:
+				// Every other frame type is sent by the server only, relaying
+				// it would let clients forge system notices, topic changes
+				// or kicks
+				hubSend(hub, hub.direct, directMessage{conn: conn, message: errorFrame(errCodeInvalidRequest, fmt.Sprintf("Unsupported frame type %q", msgType))})
 			}
 		}
 	}()
@@ -226,7 +540,7 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 
 func registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
 		return
 	}
 
@@ -235,29 +549,44 @@ func registerUserHandler(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 
+	if rateLimited(w, registerRateLimit, clientIP(r)) {
+		return
+	}
+
 	var user User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	if errs := validateRegistration(user.Username, user.Password); len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
 
 	// check if the username already exists
 	exists, err := rdb.Exists(ctx, user.Username).Result()
 	if err != nil {
-		http.Error(w, "Error checking username", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error checking username")
 		return
 	}
 
 	if exists > 0 {
-		http.Error(w, "Username already exists", http.StatusConflict)
+		writeError(w, http.StatusConflict, errCodeUsernameTaken, "Username already exists")
 		return
 	}
 
 	// Store username and hashed password in Redis
-	hasedPassword := hashPassword(user.Password)
-	err = rdb.Set(ctx, user.Username, hasedPassword, 0).Err()
+	err = setPassword(user.Username, user.Password)
 	if err != nil {
-		http.Error(w, "Error storing user data", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing user data")
+		return
+	}
+
+	// Add to users index
+	err = rdb.SAdd(ctx, "users", user.Username).Err()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error updating users index")
 		return
 	}
 
@@ -270,9 +599,38 @@ func registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// backfillUsersIndex adds accounts created before the users set existed.
+// User records are the string keys shaped like a username, apart from the
+// reserved names that share the keyspace.
+func backfillUsersIndex() error {
+	var cursor uint64
+	for {
+		keys, next, err := rdb.ScanType(ctx, cursor, "*", 1000, "string").Result()
+		if err != nil {
+			return err
+		}
+
+		var usernames []interface{}
+		for _, key := range keys {
+			if rules.usernamePattern.MatchString(key) && !rules.reservedNames[strings.ToLower(key)] {
+				usernames = append(usernames, key)
+			}
+		}
+		if len(usernames) > 0 {
+			if err := rdb.SAdd(ctx, "users", usernames...).Err(); err != nil {
+				return err
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
 func loginUserHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
 		return
 	}
 
@@ -281,30 +639,75 @@ func loginUserHandler(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 
+	if rateLimited(w, loginIPRateLimit, clientIP(r)) {
+		return
+	}
+
 	var loginReq LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&loginReq); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	// Also limit per account so a distributed attack cannot guess one password
+	if rateLimited(w, loginUserRateLimit, loginReq.Username) {
+		return
+	}
+
+	// Locked accounts are rejected before the password is even checked
+	if lockout := lockedOutFor(loginReq.Username); lockout > 0 {
+		auditLogin(r, loginReq.Username, false, "locked")
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockout.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, errCodeAccountLocked, "Too many failed login attempts, try again later")
 		return
 	}
 
 	// check if the username exists in Redis
 	storedHash, err := rdb.Get(ctx, loginReq.Username).Result()
-	if err != nil {
+	if err != nil && err != redis.Nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error checking username")
+		return
+	}
+
+	// Unknown usernames and wrong passwords get the same answer, so the
+	// response cannot be used to find out which usernames exist. Unknown
+	// usernames are checked against a dummy hash to take just as long.
+	if err == redis.Nil {
+		storedHash = dummyPasswordHash
+	}
+	matches, legacy := passwordMatches(storedHash, loginReq.Password)
+	if err == redis.Nil || !matches {
+		reason := "invalid_password"
 		if err == redis.Nil {
-			http.Error(w, "Username not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Error checking username", http.StatusInternalServerError)
+			reason = "unknown_user"
 		}
+		auditLogin(r, loginReq.Username, false, reason)
+		time.Sleep(recordLoginFailure(loginReq.Username))
+		writeError(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Invalid username or password")
 		return
 	}
 
-	if hashPassword(loginReq.Password) != storedHash {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+	clearLoginFailures(loginReq.Username)
+
+	if legacy {
+		upgradePasswordHash(loginReq.Username, loginReq.Password)
+	}
+
+	// Disabled accounts are only revealed to callers who know the password
+	if isDisabled(loginReq.Username) {
+		auditLogin(r, loginReq.Username, false, "disabled")
+		writeError(w, http.StatusForbidden, errCodeAccountDisabled, "Account is disabled")
 		return
 	}
 
-	// Generate a session token (you can use JWT or any other method)
-	sessionToken := generateSessionToken(loginReq.Username)
+	auditLogin(r, loginReq.Username, true, "")
+
+	// Generate a session token
+	sessionToken, err := createSession(loginReq.Username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating session")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -317,9 +720,9 @@ func loginUserHandler(w http.ResponseWriter, r *http.Request) {
 
 func pingHandler(w http.ResponseWriter, r *http.Request) {
 	// Check if the user is logged in
-	sessionToken := r.Header.Get("Authorization")
+	sessionToken := requestToken(r)
 	if sessionToken == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, errCodeAuthRequired, "Unauthorized")
 		return
 	}
 	// In a real application, you would validate the session token here
@@ -333,22 +736,16 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 
 func createChatroomHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
 		return
 	}
 
-	// Get token from Authorization header
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Authorization required", http.StatusUnauthorized)
+	username, _ := sessionUser(w, r)
+	if username == "" {
 		return
 	}
 
-	// In a real application with proper session management, you would validate the token
-	// and get the user ID. For this implementation, we'll extract username from token
-	username := extractUsernameFromToken(token)
-	if username == "" {
-		http.Error(w, "Invalid session token", http.StatusUnauthorized)
+	if rateLimited(w, roomCreateRateLimit, username) {
 		return
 	}
 
@@ -359,23 +756,38 @@ func createChatroomHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&chatroomRequest); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
 		return
 	}
 
-	if chatroomRequest.Name == "" {
-		http.Error(w, "Chatroom name is required", http.StatusBadRequest)
+	name, description, errs := validateChatroom(chatroomRequest.Name, chatroomRequest.Description)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	chatroom, err := createChatroom(username, name, description)
+	if err != nil {
+		fmt.Printf("Error creating chatroom: %v\n", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating chatroom")
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(chatroom)
+}
+
+// createChatroom stores a new, already validated chatroom owned by username
+func createChatroom(username, name, description string) (*Chatroom, error) {
 	// Create a unique ID for the chatroom
 	chatroomID := generateChatroomID()
 
 	// Create chatroom object
-	chatroom := Chatroom{
+	chatroom := &Chatroom{
 		ID:          chatroomID,
-		Name:        chatroomRequest.Name,
-		Description: chatroomRequest.Description,
+		Name:        name,
+		Description: description,
 		CreatorID:   username,
 		CreatedAt:   time.Now(),
 		UserCount:   0,
@@ -384,46 +796,30 @@ func createChatroomHandler(w http.ResponseWriter, r *http.Request) {
 	// Serialize to JSON for Redis storage
 	chatroomJSON, err := json.Marshal(chatroom)
 	if err != nil {
-		http.Error(w, "Error creating chatroom", http.StatusInternalServerError)
-		return
-	}
-
-	// Store in Redis - individual chatroom
-	err = rdb.Set(ctx, "chatroom:"+chatroomID, chatroomJSON, 0).Err()
-	if err != nil {
-		http.Error(w, "Error storing chatroom data", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	// Add to chatrooms index
-	err = rdb.SAdd(ctx, "chatrooms", chatroomID).Err()
-	if err != nil {
-		http.Error(w, "Error updating chatroom index", http.StatusInternalServerError)
-		return
+	// Store the chatroom and add it to the global and the user's index
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, "chatroom:"+chatroomID, chatroomJSON, 0)
+	pipe.SAdd(ctx, "chatrooms", chatroomID)
+	pipe.SAdd(ctx, "user:"+username+":chatrooms", chatroomID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
 	}
-
-	// Add to user's chatrooms
-	err = rdb.SAdd(ctx, "user:"+username+":chatrooms", chatroomID).Err()
-	if err != nil {
-		http.Error(w, "Error updating user's chatrooms", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(chatroom)
+	return chatroom, nil
 }
 
 func chatroomsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
 		return
 	}
 
 	// Get all chatroom IDs from the index
 	chatroomIDs, err := rdb.SMembers(ctx, "chatrooms").Result()
 	if err != nil {
-		http.Error(w, "Error fetching chatrooms", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching chatrooms")
 		return
 	}
 
@@ -453,32 +849,23 @@ func chatroomsHandler(w http.ResponseWriter, r *http.Request) {
 
 func userChatroomsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Get token from Authorization header
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Authorization required", http.StatusUnauthorized)
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
 		return
 	}
 
-	// Extract username from token
-	username := extractUsernameFromToken(token)
+	username, _ := sessionUser(w, r)
 	if username == "" {
-		http.Error(w, "Invalid session token", http.StatusUnauthorized)
 		return
 	}
 
 	// Get user's chatroom IDs from Redis
 	userChatroomIDs, err := rdb.SMembers(ctx, "user:"+username+":chatrooms").Result()
 	if err != nil {
-		http.Error(w, "Error fetching user's chatrooms", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching user's chatrooms")
 		return
 	}
 
-	chatrooms := []Chatroom{}
+	chatrooms := []userChatroom{}
 
 	// For each ID, get the chatroom data
 	for _, id := range userChatroomIDs {
@@ -492,7 +879,12 @@ func userChatroomsHandler(w http.ResponseWriter, r *http.Request) {
 			continue // Skip this chatroom if there was an error
 		}
 
-		chatrooms = append(chatrooms, chatroom)
+		unread, err := unreadCount(id, username)
+		if err != nil {
+			fmt.Printf("Error counting unread messages: %v\n", err)
+		}
+
+		chatrooms = append(chatrooms, userChatroom{Chatroom: chatroom, UnreadCount: unread})
 	}
 
 	// Return the list of user's chatrooms
@@ -500,35 +892,64 @@ func userChatroomsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(chatrooms)
 }
 
+// extractUsernameFromToken returns the user of a valid session token, or an
+// empty string when the token is unknown, expired or revoked
 func extractUsernameFromToken(token string) string {
-	// In a real application with proper token validation,
-	// you would decode and validate JWT or other token format.
-	// This is a simple implementation for this demo.
 	if token == "" {
 		return ""
 	}
 
-	// Split by underscore, assuming token format is "username_timestamp"
-	parts := strings.Split(token, "_")
-	if len(parts) < 1 {
+	if isAPIKeyToken(token) {
+		if key := lookupAPIKey(token); key != nil {
+			return key.Username
+		}
 		return ""
 	}
 
-	return parts[0]
+	return lookupSession(token)
 }
 
 func generateChatroomID() string {
 	return fmt.Sprintf("chatroom_%d", time.Now().UnixNano())
 }
 
-func generateSessionToken(username string) string {
-	// In a real application, you would use a more secure method to generate session tokens
-	return fmt.Sprintf("%s_%d", username, time.Now().Unix())
+// hashPassword returns a bcrypt hash of a password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
 }
 
-func hashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
-	return hex.EncodeToString(hash[:1])
+// setPassword stores the hash of a new password for a user
+func setPassword(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, username, hash, 0).Err()
+}
+
+// dummyPasswordHash is compared against when a username does not exist
+var dummyPasswordHash, _ = hashPassword("no such user")
+
+// passwordMatches reports whether password matches a stored hash. Hashes
+// stored before bcrypt was introduced are truncated SHA-256 digests, they
+// still match but are reported as legacy so they can be upgraded.
+func passwordMatches(storedHash, password string) (matches, legacy bool) {
+	if strings.HasPrefix(storedHash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)) == nil, false
+	}
+	digest := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(digest[:1])), []byte(storedHash)) == 1, true
+}
+
+// upgradePasswordHash replaces a legacy hash once the user proved the password
+func upgradePasswordHash(username, password string) {
+	if err := setPassword(username, password); err != nil {
+		fmt.Printf("Error upgrading password hash of %s: %v\n", username, err)
+	}
 }
 
 // Generate a unique user ID (you can use a better strategy in production)
@@ -551,12 +972,53 @@ func main() {
 	}
 	fmt.Println("Connected to Redis")
 
+	// index accounts registered before the users set existed
+	if err := backfillUsersIndex(); err != nil {
+		fmt.Println("Error indexing users:", err)
+		return
+	}
+
+	// initialize attachment storage
+	blobs, err = newBlobStore()
+	if err != nil {
+		fmt.Println("Error initializing blob storage:", err)
+		return
+	}
+
+	// build the message search index
+	if err := startSearchIndex(); err != nil {
+		fmt.Println("Error starting search index:", err)
+		return
+	}
+
+	// start delivering room webhooks
+	startWebhookWorkers()
+
+	// start the gRPC API
+	if err := serveGRPC(); err != nil {
+		fmt.Println("Error starting gRPC server:", err)
+		return
+	}
+
+	// start the IRC gateway
+	if err := serveIRC(); err != nil {
+		fmt.Println("Error starting IRC gateway:", err)
+		return
+	}
+
+	// start bridging MQTT topics into rooms
+	if err := startMQTTBridge(); err != nil {
+		fmt.Println("Error starting MQTT bridge:", err)
+		return
+	}
+
 	// Enable CORS middleware
 	corsMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -579,8 +1041,69 @@ func main() {
 	mux.HandleFunc("/api/chatrooms", chatroomsHandler)
 	mux.HandleFunc("/api/chatrooms/create", createChatroomHandler)
 	mux.HandleFunc("/api/chatrooms/my", userChatroomsHandler)
+	mux.HandleFunc("/api/chatrooms/history", historyHandler)
+	mux.HandleFunc("/api/search", searchHandler)
+	mux.HandleFunc("/api/chatrooms/moderation", moderationHandler)
+	mux.HandleFunc("/api/chatrooms/moderation/log", moderationLogHandler)
+	mux.HandleFunc("/api/chatrooms/filters", roomFiltersHandler)
+	mux.HandleFunc("/api/chatrooms/quarantine", quarantineHandler)
+	mux.HandleFunc("/api/reports", reportsHandler)
+	mux.HandleFunc("/api/reports/create", createReportHandler)
+	mux.HandleFunc("/api/reports/action", reportActionHandler)
+	mux.HandleFunc("/api/attachments", uploadAttachmentHandler)
+	mux.HandleFunc("/api/attachments/", attachmentHandler)
+	mux.HandleFunc("/api/users/me", myProfileHandler)
+	mux.HandleFunc("/api/users/me/password", changePasswordHandler)
+	mux.HandleFunc("/api/users/me/invites", invitesHandler)
+	mux.HandleFunc("/api/users/me/delete", deleteAccountHandler)
+	mux.HandleFunc("/api/password-reset/request", requestPasswordResetHandler)
+	mux.HandleFunc("/api/password-reset/confirm", confirmPasswordResetHandler)
+	mux.HandleFunc("/api/users/", userProfileHandler)
+	mux.HandleFunc("/admin/api/audit/logins", loginAuditHandler)
+	mux.HandleFunc("/admin/api/users", adminUsersHandler)
+	mux.HandleFunc("/admin/api/users/action", adminUserActionHandler)
+	mux.HandleFunc("/admin/api/rooms", adminRoomsHandler)
+	mux.HandleFunc("/admin/api/rooms/close", adminCloseRoomHandler)
+	mux.HandleFunc("/admin/api/hubs", adminHubsHandler)
+	mux.HandleFunc("/admin/api/announce", adminAnnounceHandler)
+
+	// Bot accounts and API keys
+	mux.HandleFunc("/api/bots", botsHandler)
+	mux.HandleFunc("/api/bots/keys", botKeysHandler)
+	mux.HandleFunc("/api/bots/keys/revoke", revokeAPIKeyHandler)
+
+	// Room webhooks
+	mux.HandleFunc("/api/chatrooms/webhooks", webhooksHandler)
+	mux.HandleFunc("/api/chatrooms/webhooks/delete", deleteWebhookHandler)
+	mux.HandleFunc("/api/chatrooms/webhooks/deliveries", webhookDeliveriesHandler)
+	mux.HandleFunc("/api/chatrooms/webhooks/test", testWebhookHandler)
+
+	// Fallback transports
+	mux.HandleFunc("/api/chatrooms/events", sseHandler)
+	mux.HandleFunc("/api/chatrooms/poll/open", openPollHandler)
+	mux.HandleFunc("/api/chatrooms/poll", pollHandler)
+	mux.HandleFunc("/api/chatrooms/poll/close", closePollHandler)
+	mux.HandleFunc("/api/chatrooms/messages", sendMessageHandler)
+
+	// Incoming webhooks
+	mux.HandleFunc("/api/chatrooms/incoming-webhooks", incomingWebhooksHandler)
+	mux.HandleFunc("/api/chatrooms/incoming-webhooks/delete", deleteIncomingWebhookHandler)
+	mux.HandleFunc("/hooks/", incomingWebhookPostHandler)
+
+	// Single sign-on
+	mux.HandleFunc("/auth/oidc/providers", oidcProvidersHandler)
+	mux.HandleFunc("/auth/oidc/login", oidcLoginHandler)
+	mux.HandleFunc("/auth/oidc/link", oidcLinkHandler)
+	mux.HandleFunc("/auth/oidc/callback", oidcCallbackHandler)
+	if mockIDPEnabled {
+		if err := registerMockIDP(mux); err != nil {
+			fmt.Printf("Error starting mock identity provider: %v\n", err)
+			return
+		}
+		fmt.Println("Mock identity provider enabled at", mockIDPIssuer)
+	}
 
-	handler := corsMiddleware(mux)
+	handler := requestIDMiddleware(corsMiddleware(apiKeyMiddleware(mux)))
 
 	port := ":8080"
 	fmt.Println("Chatroom Server started on :8080")
@@ -591,6 +1114,23 @@ func main() {
 	fmt.Println("- Chatrooms API: http://localhost:8080/api/chatrooms")
 	fmt.Println("- User's Chatrooms API: http://localhost:8080/api/chatrooms/my")
 	fmt.Println("- Create Chatroom API: POST http://localhost:8080/api/chatrooms/create")
+	fmt.Println("- Chatroom History API: http://localhost:8080/api/chatrooms/history?roomId=<room-id>")
+	fmt.Println("- Search API: http://localhost:8080/api/search?q=<terms>")
+	fmt.Println("- Upload Attachment API: POST http://localhost:8080/api/attachments")
+	fmt.Println("- Server-Sent Events: http://localhost:8080/api/chatrooms/events?roomId=<room-id>")
+	fmt.Println("- Send Message API: POST http://localhost:8080/api/chatrooms/messages")
+	fmt.Println("- Incoming Webhooks: POST http://localhost:8080/hooks/<id>/<secret>")
+	fmt.Println("- SSO Login: http://localhost:8080/auth/oidc/login?provider=<name>")
+	fmt.Println("- Password Reset API: POST http://localhost:8080/api/password-reset/request")
+	if grpcAddr != "" {
+		fmt.Println("- gRPC Chat API:", grpcAddr)
+	}
+	if ircAddr != "" {
+		fmt.Println("- IRC Gateway:", ircAddr)
+	}
+	if bridge != nil {
+		fmt.Println("- MQTT Bridge:", mqttBrokerURL)
+	}
 
 	if err := http.ListenAndServe(port, handler); err != nil {
 		fmt.Println("Error starting server:", err)
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// legacyHash is the truncated SHA-256 digest stored before bcrypt
+func legacyHash(password string) string {
+	digest := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(digest[:1])
+}
+
+func TestPasswordMatches(t *testing.T) {
+	bcryptHash, err := hashPassword("correct-horse")
+	if err != nil {
+		t.Fatalf("hashPassword: %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		storedHash string
+		password   string
+		wantMatch  bool
+		wantLegacy bool
+	}{
+		{"bcrypt", bcryptHash, "correct-horse", true, false},
+		{"bcrypt wrong password", bcryptHash, "battery-staple", false, false},
+		{"legacy", legacyHash("correct-horse"), "correct-horse", true, true},
+		{"legacy wrong password", legacyHash("correct-horse"), "battery-staple", false, true},
+		{"sso account", unusablePasswordHash, "", false, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			match, legacy := passwordMatches(tc.storedHash, tc.password)
+			if match != tc.wantMatch || legacy != tc.wantLegacy {
+				t.Errorf("passwordMatches() = %v, %v, want %v, %v", match, legacy, tc.wantMatch, tc.wantLegacy)
+			}
+		})
+	}
+}
+
+func TestLoginUpgradesLegacyHash(t *testing.T) {
+	useTestRedis(t)
+
+	if err := rdb.Set(ctx, "alice", legacyHash("correct-horse"), 0).Err(); err != nil {
+		t.Fatalf("storing legacy hash: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username":"alice","password":"correct-horse"}`))
+	w := httptest.NewRecorder()
+	loginUserHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	stored, err := rdb.Get(ctx, "alice").Result()
+	if err != nil {
+		t.Fatalf("reading hash: %v", err)
+	}
+	if match, legacy := passwordMatches(stored, "correct-horse"); !match || legacy {
+		t.Errorf("stored hash %q was not upgraded to bcrypt", stored)
+	}
+}
+
+// dialRoom opens a WebSocket to serveWs, the token is left out when empty
+func dialRoom(t *testing.T, srv *httptest.Server, roomID, token string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?roomId=" + url.QueryEscape(roomID)
+	if token != "" {
+		u += "&token=" + url.QueryEscape(token)
+	}
+	return websocket.DefaultDialer.Dial(u, nil)
+}
+
+// readFrame returns the next frame of the given type from a connection
+func readFrame(t *testing.T, conn *websocket.Conn, frameType string) map[string]interface{} {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for a %s frame: %v", frameType, err)
+		}
+		var frame map[string]interface{}
+		if json.Unmarshal(data, &frame) == nil && frame["type"] == frameType {
+			return frame
+		}
+	}
+}
+
+func TestServeWsRequiresSession(t *testing.T) {
+	useTestRedis(t)
+
+	alice, bob := testSession(t, "alice"), testSession(t, "bob")
+	room := testRoom(t, "alice")
+	if err := restrictUser(roomBansKey(room.ID), "bob", "alice", "", 0); err != nil {
+		t.Fatalf("banning bob: %v", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(serveWs))
+	defer srv.Close()
+
+	cases := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{"no session", "", http.StatusUnauthorized},
+		{"forged session", "alice_forged", http.StatusUnauthorized},
+		{"banned user", bob, http.StatusForbidden},
+		{"member", alice, http.StatusSwitchingProtocols},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, resp, err := dialRoom(t, srv, room.ID, tc.token)
+			if resp == nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if conn == nil {
+				return
+			}
+			defer conn.Close()
+
+			// The session decides the sender, not the frame
+			conn.WriteJSON(map[string]interface{}{"type": frameChat, "content": "hello", "sender": "bob"})
+			if frame := readFrame(t, conn, frameChat); frame["sender"] != "alice" {
+				t.Errorf("sender = %v, want alice", frame["sender"])
+			}
+		})
+	}
+}
+
+func TestServeWsRejectsServerFrames(t *testing.T) {
+	useTestRedis(t)
+
+	alice, bob := testSession(t, "alice"), testSession(t, "bob")
+	room := testRoom(t, "alice")
+
+	srv := httptest.NewServer(http.HandlerFunc(serveWs))
+	defer srv.Close()
+
+	sender, _, err := dialRoom(t, srv, room.ID, alice)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer sender.Close()
+	listener, _, err := dialRoom(t, srv, room.ID, bob)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer listener.Close()
+
+	cases := []struct {
+		name  string
+		frame string
+	}{
+		{"system notice", `{"type":"system","sender":"system","content":"Server restarting"}`},
+		{"topic change", `{"type":"topicChanged","topic":"forged"}`},
+		{"kick", `{"type":"kicked","username":"bob"}`},
+		{"no type", `{"content":"hello"}`},
+		{"not json", `hello`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sender.WriteMessage(websocket.TextMessage, []byte(tc.frame))
+			if frame := readFrame(t, sender, "error"); frame["code"] != errCodeInvalidRequest {
+				t.Errorf("error code = %v, want %s", frame["code"], errCodeInvalidRequest)
+			}
+		})
+	}
+
+	// A chat message sent last is the first thing the other member sees
+	// apart from presence updates
+	sender.WriteJSON(map[string]interface{}{"type": frameChat, "content": "real"})
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := listener.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		var frame map[string]interface{}
+		json.Unmarshal(data, &frame)
+		if frame["type"] == frameChat {
+			break
+		}
+		if strings.Contains(string(data), "forged") || strings.Contains(string(data), "Server restarting") || string(data) == "hello" {
+			t.Fatalf("forged frame was relayed: %s", data)
+		}
+	}
+}
+
+func TestServeWsLimitsUndecodableFrames(t *testing.T) {
+	if wsFrameRateLimit.limit == 0 {
+		t.Skip("the frame rate limit is disabled")
+	}
+	useTestRedis(t)
+	room := testRoom(t, "alice")
+
+	srv := httptest.NewServer(http.HandlerFunc(serveWs))
+	defer srv.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{encodingMsgpack}}
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?roomId=" + url.QueryEscape(room.ID) + "&token=" + url.QueryEscape(testSession(t, "alice"))
+	conn, _, err := dialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Frames that fail to decode still use up the limit
+	for i := 0; i <= wsFrameRateLimit.limit; i++ {
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0xc1}); err != nil {
+			break
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("connection ended with %v, want a policy violation close", err)
+			}
+			return
+		}
+	}
+}
+
+func TestUpdateChatroom(t *testing.T) {
+	useTestRedis(t)
+	room := testRoom(t, "alice")
+
+	// Another writer changes the room between the read and the write of the
+	// first attempt. The update is retried on top of it instead of undoing it.
+	attempts := 0
+	updated, err := updateChatroom(room.ID, func(stored *Chatroom) {
+		attempts++
+		if attempts == 1 {
+			if _, err := updateChatroom(room.ID, func(other *Chatroom) { other.UserCount = 5 }); err != nil {
+				t.Errorf("concurrent update: %v", err)
+			}
+		}
+		stored.Name = "Renamed"
+	})
+	if err != nil {
+		t.Fatalf("updateChatroom: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+
+	stored, err := getChatroom(room.ID)
+	if err != nil {
+		t.Fatalf("getChatroom: %v", err)
+	}
+	if stored.Name != "Renamed" || stored.UserCount != 5 || *updated != *stored {
+		t.Errorf("stored %+v, returned %+v, want the rename and the user count", stored, updated)
+	}
+
+	// Deleted rooms are not brought back
+	rdb.Del(ctx, "chatroom:"+room.ID)
+	if _, err := updateChatroom(room.ID, func(stored *Chatroom) { stored.UserCount = 1 }); err != redis.Nil {
+		t.Errorf("err = %v, want redis.Nil", err)
+	}
+	if n, _ := rdb.Exists(ctx, "chatroom:"+room.ID).Result(); n != 0 {
+		t.Errorf("deleted room was recreated")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionTTL is how long a session token stays valid after login
+var sessionTTL = time.Duration(envInt("SESSION_TTL_HOURS", 24*7)) * time.Hour
+
+func sessionKey(token string) string {
+	return "session:" + token
+}
+
+// userSessionsKey is the set of session tokens issued to a user
+func userSessionsKey(username string) string {
+	return "user:" + username + ":sessions"
+}
+
+func userDisabledKey(username string) string {
+	return "user:" + username + ":disabled"
+}
+
+// randomToken returns n random bytes, hex encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createSession issues a session token for a user. Tokens keep the
+// "<username>_<secret>" shape but are only valid while stored in Redis.
+func createSession(username string) (string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	token := username + "_" + secret
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, sessionKey(token), username, sessionTTL)
+	pipe.SAdd(ctx, userSessionsKey(username), token)
+	pipe.Expire(ctx, userSessionsKey(username), sessionTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// lookupSession returns the user a session token belongs to, or an empty
+// string for unknown, expired or revoked tokens and disabled accounts
+func lookupSession(token string) string {
+	username, err := rdb.Get(ctx, sessionKey(token)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			fmt.Printf("Error looking up session: %v\n", err)
+		}
+		return ""
+	}
+
+	if !strings.HasPrefix(token, username+"_") || isDisabled(username) {
+		return ""
+	}
+	return username
+}
+
+// revokeSessions invalidates every session of a user except the given token
+// and returns how many were revoked
+func revokeSessions(username, except string) (int, error) {
+	tokens, err := rdb.SMembers(ctx, userSessionsKey(username)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	pipe := rdb.TxPipeline()
+	revoked := 0
+	for _, token := range tokens {
+		if token == except {
+			continue
+		}
+		pipe.Del(ctx, sessionKey(token))
+		pipe.SRem(ctx, userSessionsKey(username), token)
+		revoked++
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+
+	_, err = pipe.Exec(ctx)
+	return revoked, err
+}
+
+// activeSessions counts the sessions of a user that have not expired
+func activeSessions(username string) int {
+	tokens, err := rdb.SMembers(ctx, userSessionsKey(username)).Result()
+	if err != nil {
+		return 0
+	}
+
+	active := 0
+	for _, token := range tokens {
+		if exists, err := rdb.Exists(ctx, sessionKey(token)).Result(); err == nil && exists > 0 {
+			active++
+		} else if err == nil {
+			// Expired on its own, tidy up the index
+			rdb.SRem(ctx, userSessionsKey(username), token)
+		}
+	}
+	return active
+}
+
+func isDisabled(username string) bool {
+	exists, err := rdb.Exists(ctx, userDisabledKey(username)).Result()
+	if err != nil {
+		fmt.Printf("Error checking disabled account: %v\n", err)
+		return false
+	}
+	return exists > 0
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fallback transports for clients that cannot keep a WebSocket open. Server-
+// Sent Events and long polling subscribe to the same hub fan-out as WebSocket
+// clients and receive the same JSON envelopes; messages are sent through
+// sendMessageHandler.
+
+const (
+	// subscriberBufferSize is how many frames may wait for a slow subscriber
+	// before the hub drops it
+	subscriberBufferSize = 256
+	sseHeartbeat         = 25 * time.Second
+	maxPollTimeout       = 55 * time.Second
+	defaultPollTimeout   = 25 * time.Second
+	// pollSessionTTL closes long-poll sessions whose client stopped polling
+	pollSessionTTL = 60 * time.Second
+	// maxPendingPollFrames bounds the frames kept between two polls
+	maxPendingPollFrames = 500
+)
+
+// subscriber receives a hub's frames over a transport other than WebSocket.
+// The hub closes frames when it drops the subscriber.
+type subscriber struct {
+	id       string
+	username string
+	profile  ProfileSnippet // loaded on subscribe, so Run never reads profiles
+	frames   chan []byte
+}
+
+func newSubscriber(username string) *subscriber {
+	return &subscriber{
+		id:       generateUserID(),
+		username: username,
+		profile:  profileSnippet(username),
+		frames:   make(chan []byte, subscriberBufferSize),
+	}
+}
+
+// deliver queues a frame for a subscriber, dropping subscribers that fall too
+// far behind instead of stalling the room. Called from Run.
+func (h *Hub) deliver(sub *subscriber, message []byte) {
+	if message == nil {
+		return
+	}
+	select {
+	case sub.frames <- message:
+	default:
+		fmt.Printf("Dropping slow subscriber %s from room %s\n", sub.id, h.roomID)
+		h.dropSubscriber(sub)
+		h.updateUserCount(-1)
+	}
+}
+
+// dropSubscriber removes a subscriber and ends its stream. Called from Run.
+func (h *Hub) dropSubscriber(sub *subscriber) {
+	if h.subscribers[sub] {
+		delete(h.subscribers, sub)
+		close(sub.frames)
+	}
+}
+
+// hubFor returns the hub of a room, starting it if needed
+func hubFor(roomID string) *Hub {
+	hubsMutex.Lock()
+	defer hubsMutex.Unlock()
+
+	hub, ok := chatHubs[roomID]
+	if !ok {
+		hub = newHub(roomID)
+		chatHubs[roomID] = hub
+		go hub.Run()
+	}
+	return hub
+}
+
+// requestToken returns the credential of a request: the Authorization header,
+// or on real-time paths the token query parameter, since browsers cannot set
+// headers on WebSocket or EventSource requests. apiKeyMiddleware and the
+// handlers both resolve the token here, so the key whose scopes and limits
+// were checked is always the one the handler authenticates.
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("Authorization"); token != "" {
+		return token
+	}
+	if realtimePaths[r.URL.Path] {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// joinRoom runs the checks every real-time transport does before subscribing
+// to a room. It writes the error response and returns nil when they fail.
+func joinRoom(w http.ResponseWriter, r *http.Request, roomID string) (*Chatroom, string) {
+	if roomID == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Room ID is required")
+		return nil, ""
+	}
+
+	if rateLimited(w, wsConnectRateLimit, clientIP(r)) {
+		return nil, ""
+	}
+
+	room, err := getChatroom(roomID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+		return nil, ""
+	}
+	if room.Archived {
+		writeError(w, http.StatusGone, errCodeRoomArchived, "Chatroom is archived")
+		return nil, ""
+	}
+
+	username := extractUsernameFromToken(requestToken(r))
+	if username == "" {
+		writeError(w, http.StatusUnauthorized, errCodeAuthRequired, "Authorization required")
+		return nil, ""
+	}
+	if isBanned(roomID, username) {
+		writeError(w, http.StatusForbidden, errCodeBanned, "You are banned from this chatroom")
+		return nil, ""
+	}
+	return room, username
+}
+
+// writeSSE writes one frame as an event. Chat messages carry their id so a
+// reconnecting EventSource resumes from Last-Event-ID.
+func writeSSE(w http.ResponseWriter, frame []byte) {
+	var header struct {
+		Type string `json:"type"`
+		ID   int64  `json:"id"`
+	}
+	if json.Unmarshal(frame, &header) == nil && header.Type == frameChat && header.ID > 0 {
+		fmt.Fprintf(w, "id: %d\n", header.ID)
+	}
+	for _, line := range strings.Split(string(frame), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// sseHandler streams a room's frames as Server-Sent Events
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	room, username := joinRoom(w, r, r.URL.Query().Get("roomId"))
+	if room == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Subscribe before replaying so nothing falls between the two
+	hub := hubFor(room.ID)
+	sub := newSubscriber(username)
+	hubSend(hub, hub.subscribe, sub)
+	defer func() {
+		hubSend(hub, hub.unsubscribe, sub)
+	}()
+
+	// Replay chat messages missed while reconnecting
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	if after, err := strconv.ParseInt(lastEventID, 10, 64); err == nil {
+		missed, err := messagesAfter(room.ID, after)
+		if err != nil {
+			fmt.Printf("Error replaying history: %v\n", err)
+		}
+		for _, message := range missed {
+			writeSSE(w, message)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case frame, ok := <-sub.frames:
+			if !ok {
+				// Dropped by the hub: kicked, room closed or too slow
+				return
+			}
+			writeSSE(w, frame)
+			flusher.Flush()
+
+		case <-heartbeat.C:
+			// Comments keep proxies from closing an idle stream
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// pollSession buffers a subscriber's frames between long-poll requests
+type pollSession struct {
+	id       string
+	roomID   string
+	username string
+	hub      *Hub
+	sub      *subscriber
+
+	mu       sync.Mutex
+	pending  []json.RawMessage
+	first    int64 // sequence number of pending[0]
+	missed   bool  // frames were discarded because the client polled too slowly
+	closed   bool
+	lastPoll time.Time
+	wake     chan struct{}
+}
+
+var (
+	pollSessions      = make(map[string]*pollSession)
+	pollSessionsMutex = &sync.Mutex{}
+)
+
+// pump moves frames from the hub into the session buffer and closes the
+// session once the client stops polling
+func (s *pollSession) pump() {
+	expiry := time.NewTicker(pollSessionTTL / 4)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case frame, ok := <-s.sub.frames:
+			s.mu.Lock()
+			if !ok {
+				s.closed = true
+			} else {
+				s.pending = append(s.pending, frame)
+				if len(s.pending) > maxPendingPollFrames {
+					s.pending = s.pending[1:]
+					s.first++
+					s.missed = true
+				}
+			}
+			s.mu.Unlock()
+			s.notify()
+			if !ok {
+				s.remove()
+				return
+			}
+
+		case <-expiry.C:
+			s.mu.Lock()
+			idle := time.Since(s.lastPoll) > pollSessionTTL
+			s.mu.Unlock()
+			if idle {
+				s.close()
+				return
+			}
+		}
+	}
+}
+
+func (s *pollSession) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *pollSession) remove() {
+	pollSessionsMutex.Lock()
+	delete(pollSessions, s.id)
+	pollSessionsMutex.Unlock()
+}
+
+// close leaves the room and ends the session
+func (s *pollSession) close() {
+	s.remove()
+	hubSend(s.hub, s.hub.unsubscribe, s.sub)
+
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.notify()
+}
+
+// openPollHandler starts a long-poll session in a room
+func openPollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var req struct {
+		RoomID string `json:"roomId"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	room, username := joinRoom(w, r, req.RoomID)
+	if room == nil {
+		return
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating session")
+		return
+	}
+
+	session := &pollSession{
+		id:       id,
+		roomID:   room.ID,
+		username: username,
+		hub:      hubFor(room.ID),
+		sub:      newSubscriber(username),
+		first:    1,
+		lastPoll: time.Now(),
+		wake:     make(chan struct{}, 1),
+	}
+
+	pollSessionsMutex.Lock()
+	pollSessions[id] = session
+	pollSessionsMutex.Unlock()
+
+	hubSend(session.hub, session.hub.subscribe, session.sub)
+	go session.pump()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessionId":          id,
+		"roomId":             room.ID,
+		"pollTimeoutSeconds": int(defaultPollTimeout / time.Second),
+		"sessionTTLSeconds":  int(pollSessionTTL / time.Second),
+	})
+}
+
+// pollSessionFor looks up a long-poll session and checks it belongs to the
+// caller. It writes the error response and returns nil otherwise.
+func pollSessionFor(w http.ResponseWriter, r *http.Request, id string) *pollSession {
+	pollSessionsMutex.Lock()
+	session, ok := pollSessions[id]
+	pollSessionsMutex.Unlock()
+
+	if !ok || session.username != extractUsernameFromToken(requestToken(r)) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Poll session not found or expired")
+		return nil
+	}
+	return session
+}
+
+// pollHandler waits for frames of a long-poll session.
+// Query parameters: sessionId, ack (the cursor returned by the previous poll,
+// frames up to it are discarded) and timeout in seconds.
+// Frames after ack are sent again until acknowledged, so a response lost on
+// the way to the client is not lost for good.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	session := pollSessionFor(w, r, r.URL.Query().Get("sessionId"))
+	if session == nil {
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxPollTimeout {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid timeout")
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	var ack int64
+	if v := r.URL.Query().Get("ack"); v != "" {
+		var err error
+		if ack, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid ack")
+			return
+		}
+	}
+
+	session.mu.Lock()
+	session.lastPoll = time.Now()
+	if drop := ack - session.first + 1; drop > 0 {
+		drop = min(drop, int64(len(session.pending)))
+		session.pending = session.pending[drop:]
+		session.first += drop
+	}
+	waiting := len(session.pending) == 0 && !session.closed
+	session.mu.Unlock()
+
+	if waiting {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-session.wake:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+	}
+
+	session.mu.Lock()
+	session.lastPoll = time.Now()
+	frames := append([]json.RawMessage{}, session.pending...)
+	cursor := session.first + int64(len(frames)) - 1
+	missed, closed := session.missed, session.closed
+	session.missed = false
+	session.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": frames,
+		"cursor":   cursor,
+		"missed":   missed,
+		"closed":   closed,
+	})
+}
+
+// closePollHandler ends a long-poll session right away
+func closePollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var req struct {
+		SessionID string `json:"sessionId"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	session := pollSessionFor(w, r, req.SessionID)
+	if session == nil {
+		return
+	}
+	session.close()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
+// sendMessageHandler posts a chat message without a real-time connection.
+// The body is the same envelope WebSocket clients send, plus the roomId.
+func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	username, _ := sessionUser(w, r)
+	if username == "" {
+		return
+	}
+
+	var msg map[string]interface{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&msg); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	roomID, _ := msg["roomId"].(string)
+	delete(msg, "roomId")
+
+	room, err := getChatroom(roomID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Chatroom not found")
+		return
+	}
+	if room.Archived {
+		writeError(w, http.StatusGone, errCodeRoomArchived, "Chatroom is archived")
+		return
+	}
+	if isBanned(room.ID, username) {
+		writeError(w, http.StatusForbidden, errCodeBanned, "You are banned from this chatroom")
+		return
+	}
+	if isMuted(room.ID, username) {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "You are muted in this chatroom")
+		return
+	}
+
+	if rateLimited(w, wsMessageRateLimit, username) {
+		return
+	}
+
+	// Commands answer privately over a live connection, which REST lacks
+	if isCommand(msg) {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Slash commands are only available over WebSocket")
+		return
+	}
+
+	msg["type"] = frameChat
+	msg["sender"] = username
+	msg["timestamp"] = time.Now()
+
+	message, err := submitChatMessage(room.ID, username, msg)
+	if err != nil {
+		var rejection *messageRejection
+		if errors.As(err, &rejection) {
+			writeError(w, http.StatusUnprocessableEntity, rejection.Code, rejection.Message)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error posting message")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(message)
+}
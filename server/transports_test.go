@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRequestToken(t *testing.T) {
+	cases := []struct {
+		name          string
+		path          string
+		header, query string
+		want          string
+	}{
+		{"header", "/api/chatrooms", "h", "", "h"},
+		{"query on a real-time path", "/api/chatrooms/events", "", "q", "q"},
+		{"query elsewhere", "/api/chatrooms", "", "q", ""},
+		{"header wins", "/api/chatrooms/poll", "h", "q", "h"},
+		{"neither", "/ws", "", "", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			target := tc.path
+			if tc.query != "" {
+				target += "?token=" + url.QueryEscape(tc.query)
+			}
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			if got := requestToken(r); got != tc.want {
+				t.Errorf("requestToken = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// testPollSession registers a long-poll session holding the given frames
+func testPollSession(t *testing.T, username string, frames ...string) *pollSession {
+	t.Helper()
+
+	session := &pollSession{
+		id:       "poll-" + username,
+		username: username,
+		first:    1,
+		lastPoll: time.Now(),
+		wake:     make(chan struct{}, 1),
+	}
+	for _, frame := range frames {
+		session.pending = append(session.pending, json.RawMessage(frame))
+	}
+
+	pollSessionsMutex.Lock()
+	pollSessions[session.id] = session
+	pollSessionsMutex.Unlock()
+	t.Cleanup(session.remove)
+	return session
+}
+
+type pollResponse struct {
+	Messages []json.RawMessage `json:"messages"`
+	Cursor   int64             `json:"cursor"`
+	Missed   bool              `json:"missed"`
+}
+
+// poll calls pollHandler without waiting for new frames
+func poll(t *testing.T, session *pollSession, token string, ack int64) (int, pollResponse) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/chatrooms/poll?timeout=0&sessionId="+session.id+"&ack="+strconv.FormatInt(ack, 10), nil)
+	r.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	pollHandler(w, r)
+
+	var resp pollResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestPollCursor(t *testing.T) {
+	useTestRedis(t)
+	token := testSession(t, "alice")
+	session := testPollSession(t, "alice", `{"n":1}`, `{"n":2}`, `{"n":3}`)
+
+	steps := []struct {
+		name       string
+		ack        int64
+		wantFrames int
+		wantCursor int64
+	}{
+		{"nothing acknowledged", 0, 3, 3},
+		{"lost response is sent again", 0, 3, 3},
+		{"partial ack", 2, 1, 3},
+		{"stale ack", 1, 1, 3},
+		{"all acknowledged", 3, 0, 3},
+		{"ack past the end", 10, 0, 3},
+	}
+
+	for _, step := range steps {
+		code, resp := poll(t, session, token, step.ack)
+		if code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", step.name, code, http.StatusOK)
+		}
+		if len(resp.Messages) != step.wantFrames || resp.Cursor != step.wantCursor {
+			t.Errorf("%s: got %d frames up to %d, want %d up to %d", step.name, len(resp.Messages), resp.Cursor, step.wantFrames, step.wantCursor)
+		}
+	}
+
+	// Frames arriving later continue the sequence
+	session.mu.Lock()
+	session.pending = append(session.pending, json.RawMessage(`{"n":4}`))
+	session.missed = true
+	session.mu.Unlock()
+
+	_, resp := poll(t, session, token, 3)
+	if len(resp.Messages) != 1 || string(resp.Messages[0]) != `{"n":4}` || resp.Cursor != 4 || !resp.Missed {
+		t.Errorf("got %s up to %d, missed %v, want frame 4 and missed", resp.Messages, resp.Cursor, resp.Missed)
+	}
+	if _, resp := poll(t, session, token, 4); resp.Missed {
+		t.Errorf("missed is reported again")
+	}
+}
+
+func TestPollSessionOwner(t *testing.T) {
+	useTestRedis(t)
+	alice, bob := testSession(t, "alice"), testSession(t, "bob")
+	session := testPollSession(t, "alice", `{"n":1}`)
+
+	if code, _ := poll(t, session, bob, 0); code != http.StatusNotFound {
+		t.Errorf("other user: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// The header decides even when a query token names the owner
+	r := httptest.NewRequest(http.MethodGet, "/api/chatrooms/poll?timeout=0&sessionId="+session.id+"&token="+url.QueryEscape(alice), nil)
+	r.Header.Set("Authorization", bob)
+	w := httptest.NewRecorder()
+	pollHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("bob's header with alice's query token: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/chatrooms/poll?timeout=0&sessionId="+session.id+"&token="+url.QueryEscape(alice), nil)
+	w = httptest.NewRecorder()
+	pollHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("query token: status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// FieldError describes why a single request field was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every field error found in a request
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(field, code, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// validationRules holds the configurable input rules, see loadValidationRules
+type validationRules struct {
+	usernameMin     int
+	usernameMax     int
+	usernamePattern *regexp.Regexp
+	reservedNames   map[string]bool
+	passwordMin     int
+	passwordClasses int // distinct character classes (lower, upper, digit, symbol) required
+	roomNameMax     int
+	roomDescMax     int
+	messageMax      int
+}
+
+var rules = loadValidationRules()
+
+// globalKeys are the Redis keys stored next to the user records without a
+// prefix. They stay reserved whatever RESERVED_USERNAMES says, registering
+// one would turn the key into a user record.
+var globalKeys = []string{"users", "admins", "bots", "outbox", "reports", "chatrooms"}
+
+func loadValidationRules() validationRules {
+	// Underscores are not allowed as session tokens are "<username>_<secret>".
+	// Reserved names include the sender used for server messages and Redis
+	// keys that live next to the user records.
+	pattern := envOr("USERNAME_PATTERN", `^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Printf("Ignoring invalid USERNAME_PATTERN %q: %v\n", pattern, err)
+		compiled = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+	}
+
+	reserved := parseList(strings.ToLower(envOr("RESERVED_USERNAMES", "system,admin,administrator,root,moderator,server")))
+	for _, key := range globalKeys {
+		reserved[key] = true
+	}
+
+	return validationRules{
+		usernameMin:     int(envInt("USERNAME_MIN_LENGTH", 3)),
+		usernameMax:     int(envInt("USERNAME_MAX_LENGTH", 32)),
+		usernamePattern: compiled,
+		reservedNames:   reserved,
+		passwordMin:     int(envInt("PASSWORD_MIN_LENGTH", 8)),
+		passwordClasses: int(envInt("PASSWORD_MIN_CLASSES", 2)),
+		roomNameMax:     int(envInt("ROOM_NAME_MAX_LENGTH", 64)),
+		roomDescMax:     int(envInt("ROOM_DESCRIPTION_MAX_LENGTH", 500)),
+		messageMax:      int(envInt("MESSAGE_MAX_LENGTH", 4000)),
+	}
+}
+
+// normalizeText applies Unicode NFC normalisation, trims surrounding space and
+// drops control characters other than newlines and tabs when multiline is set
+func normalizeText(s string, multiline bool) string {
+	s = norm.NFC.String(s)
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			if multiline {
+				return r
+			}
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+func validateUsername(errs *ValidationErrors, username string) {
+	n := utf8.RuneCountInString(username)
+	switch {
+	case n == 0:
+		errs.add("username", "required", "Username is required")
+	case n < rules.usernameMin || n > rules.usernameMax:
+		errs.add("username", "length", "Username must be between %d and %d characters", rules.usernameMin, rules.usernameMax)
+	case !rules.usernamePattern.MatchString(username):
+		errs.add("username", "charset", "Username may only contain letters, digits, dots and dashes")
+	case rules.reservedNames[strings.ToLower(username)]:
+		errs.add("username", "reserved", "Username is reserved")
+	}
+}
+
+func validatePassword(errs *ValidationErrors, field, password, username string) {
+	if password == "" {
+		errs.add(field, "required", "Password is required")
+		return
+	}
+	if utf8.RuneCountInString(password) < rules.passwordMin {
+		errs.add(field, "too_short", "Password must be at least %d characters", rules.passwordMin)
+		return
+	}
+	if strings.EqualFold(password, username) {
+		errs.add(field, "matches_username", "Password must not match the username")
+		return
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < rules.passwordClasses {
+		errs.add(field, "too_weak", "Password must mix at least %d of lowercase, uppercase, digits and symbols", rules.passwordClasses)
+	}
+}
+
+// validateRegistration checks a new account's username and password
+func validateRegistration(username, password string) ValidationErrors {
+	var errs ValidationErrors
+	validateUsername(&errs, username)
+	validatePassword(&errs, "password", password, username)
+	return errs
+}
+
+// validateChatroom normalises and checks a room's name and description
+func validateChatroom(name, description string) (string, string, ValidationErrors) {
+	var errs ValidationErrors
+	name = normalizeText(name, false)
+	description = normalizeText(description, true)
+
+	if name == "" {
+		errs.add("name", "required", "Chatroom name is required")
+	} else if utf8.RuneCountInString(name) > rules.roomNameMax {
+		errs.add("name", "too_long", "Chatroom name must be at most %d characters", rules.roomNameMax)
+	}
+	if utf8.RuneCountInString(description) > rules.roomDescMax {
+		errs.add("description", "too_long", "Description must be at most %d characters", rules.roomDescMax)
+	}
+	return name, description, errs
+}
+
+// validateMessageContent normalises and checks the content of a chat message
+func validateMessageContent(content string) (string, ValidationErrors) {
+	var errs ValidationErrors
+	content = normalizeText(content, true)
+	if utf8.RuneCountInString(content) > rules.messageMax {
+		errs.add("content", "too_long", "Message must be at most %d characters", rules.messageMax)
+	}
+	return content, errs
+}
+
+// writeValidationErrors answers a request with its field level errors
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	writeErrorDetails(w, http.StatusBadRequest, errCodeValidationFailed, "Validation failed", errs)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// fieldCodes lists the codes of validation errors, in order
+func fieldCodes(errs ValidationErrors) []string {
+	codes := []string{}
+	for _, fe := range errs {
+		codes = append(codes, fe.Field+":"+fe.Code)
+	}
+	return codes
+}
+
+func TestValidateRegistration(t *testing.T) {
+	cases := []struct {
+		name     string
+		username string
+		password string
+		want     []string
+	}{
+		{"valid", "alice", "correct-horse", nil},
+		{"missing username", "", "correct-horse", []string{"username:required"}},
+		{"short username", "al", "correct-horse", []string{"username:length"}},
+		{"long username", strings.Repeat("a", 33), "correct-horse", []string{"username:length"}},
+		{"underscore", "ali_ce", "correct-horse", []string{"username:charset"}},
+		{"leading dot", ".alice", "correct-horse", []string{"username:charset"}},
+		{"reserved", "System", "correct-horse", []string{"username:reserved"}},
+		{"global key", "outbox", "correct-horse", []string{"username:reserved"}},
+		{"users index", "Users", "correct-horse", []string{"username:reserved"}},
+		{"missing password", "alice", "", []string{"password:required"}},
+		{"short password", "alice", "a-1", []string{"password:too_short"}},
+		{"password matches username", "alice123", "ALICE123", []string{"password:matches_username"}},
+		{"single class password", "alice", "horsebattery", []string{"password:too_weak"}},
+		{"both invalid", "", "", []string{"username:required", "password:required"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := fieldCodes(validateRegistration(tc.username, tc.password))
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("validateRegistration(%q, %q) = %v, want %v", tc.username, tc.password, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateChatroom(t *testing.T) {
+	cases := []struct {
+		name        string
+		roomName    string
+		description string
+		wantName    string
+		wantDesc    string
+		want        []string
+	}{
+		{"valid", "General", "Talk about\nanything", "General", "Talk about\nanything", nil},
+		{"trimmed", "  General \t", "", "General", "", nil},
+		{"newline in name", "Gen\neral", "", "Gen eral", "", nil},
+		{"control characters dropped", "Gen\x00eral", "a\x07b", "General", "ab", nil},
+		{"nfc normalised", "Cafe\u0301", "", "Caf\u00e9", "", nil},
+		{"missing name", "   ", "", "", "", []string{"name:required"}},
+		{"long name", strings.Repeat("n", 65), "", strings.Repeat("n", 65), "", []string{"name:too_long"}},
+		{"long description", "General", strings.Repeat("d", 501), "General", strings.Repeat("d", 501), []string{"description:too_long"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			name, desc, errs := validateChatroom(tc.roomName, tc.description)
+			if name != tc.wantName || desc != tc.wantDesc {
+				t.Errorf("validateChatroom() = %q, %q, want %q, %q", name, desc, tc.wantName, tc.wantDesc)
+			}
+			if got := fieldCodes(errs); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("validateChatroom() errors = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateMessageContent(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{"plain", "hello", "hello", false},
+		{"keeps newlines", " line one\nline two ", "line one\nline two", false},
+		{"drops control characters", "he\x1bllo", "hello", false},
+		{"at limit", strings.Repeat("x", 4000), strings.Repeat("x", 4000), false},
+		{"over limit", strings.Repeat("x", 4001), strings.Repeat("x", 4001), true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, errs := validateMessageContent(tc.content)
+			if got != tc.want {
+				t.Errorf("validateMessageContent() = %q, want %q", got, tc.want)
+			}
+			if (len(errs) > 0) != tc.wantErr {
+				t.Errorf("validateMessageContent() errors = %v, want error %v", errs, tc.wantErr)
+			}
+		})
+	}
+}
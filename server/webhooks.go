@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Room events webhooks can subscribe to
+const (
+	eventMessagePosted = "message.posted"
+	eventUserJoined    = "user.joined"
+	eventUserLeft      = "user.left"
+	eventRoomUpdated   = "room.updated"
+	eventPing          = "ping" // sent by the test endpoint only
+)
+
+var webhookEvents = map[string]bool{
+	eventMessagePosted: true,
+	eventUserJoined:    true,
+	eventUserLeft:      true,
+	eventRoomUpdated:   true,
+}
+
+// Webhook delivery settings. Failed deliveries are retried with exponential
+// backoff starting at WEBHOOK_RETRY_BASE_SECONDS, and moved to the webhook's
+// dead-letter list after WEBHOOK_MAX_ATTEMPTS attempts.
+var (
+	webhookWorkers       = int(envInt("WEBHOOK_WORKERS", 4))
+	webhookMaxAttempts   = int(envInt("WEBHOOK_MAX_ATTEMPTS", 6))
+	webhookRetryBase     = time.Duration(envInt("WEBHOOK_RETRY_BASE_SECONDS", 5)) * time.Second
+	webhookRetryMax      = time.Hour
+	webhookTimeout       = time.Duration(envInt("WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second
+	webhookAllowPrivate  = envOr("WEBHOOK_ALLOW_PRIVATE_HOSTS", "false") == "true"
+	maxWebhooksPerRoom   = int(envInt("WEBHOOK_MAX_PER_ROOM", 10))
+	maxWebhookLog        = int64(100)
+	maxWebhookDeadLetter = int64(1000)
+)
+
+const (
+	webhookQueueKey = "webhooks:queue"
+	webhookRetryKey = "webhooks:retry"
+)
+
+// roomEvent is an emitted event waiting to be matched against the webhooks
+// of its room
+type roomEvent struct {
+	roomID string
+	event  string
+	data   json.RawMessage
+}
+
+// roomEvents hands events from hubs and message posting to the event loop
+// started by startWebhookWorkers, so neither waits on Redis to emit one
+var roomEvents = make(chan roomEvent, envInt("WEBHOOK_EVENT_BUFFER", 4096))
+
+// Webhook posts room events to an external URL
+type Webhook struct {
+	ID        string    `json:"id"`
+	RoomID    string    `json:"roomId"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"` // only returned when the webhook is created
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// webhookDelivery is one event on its way to one webhook
+type webhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhookId"`
+	RoomID    string          `json:"roomId"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempt   int             `json:"attempt"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// DeliveryAttempt is an entry in a webhook's delivery log
+type DeliveryAttempt struct {
+	DeliveryID string    `json:"deliveryId"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	Outcome    string    `json:"outcome"` // delivered, retrying or dead
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+func roomWebhooksKey(roomID string) string {
+	return "chatroom:" + roomID + ":webhooks"
+}
+
+func webhookLogKey(id string) string {
+	return "webhook:" + id + ":deliveries"
+}
+
+func webhookDeadLetterKey(id string) string {
+	return "webhook:" + id + ":deadletter"
+}
+
+// errPrivateAddress is returned when a webhook resolves to an internal address
+var errPrivateAddress = errors.New("webhook host resolves to a private address")
+
+// webhookClient refuses to connect to loopback, private and link-local
+// addresses unless WEBHOOK_ALLOW_PRIVATE_HOSTS is set. The check runs on the
+// resolved address so DNS tricks cannot get around it.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				if webhookAllowPrivate {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+	// Redirects could point anywhere, receivers must answer directly
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (wh *Webhook) subscribed(event string) bool {
+	if event == eventPing {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func listWebhooks(roomID string) ([]Webhook, error) {
+	stored, err := rdb.HGetAll(ctx, roomWebhooksKey(roomID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []Webhook{}
+	for _, webhookJSON := range stored {
+		var wh Webhook
+		if err := json.Unmarshal([]byte(webhookJSON), &wh); err == nil {
+			webhooks = append(webhooks, wh)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt) })
+	return webhooks, nil
+}
+
+func getWebhook(roomID, id string) (*Webhook, error) {
+	webhookJSON, err := rdb.HGet(ctx, roomWebhooksKey(roomID), id).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var wh Webhook
+	if err := json.Unmarshal([]byte(webhookJSON), &wh); err != nil {
+		return nil, err
+	}
+	return &wh, nil
+}
+
+// emitRoomEvent hands an event to the event loop, which queues it for every
+// webhook of the room subscribed to it. It never blocks: the data is encoded
+// right away and the event is dropped when the loop has fallen behind.
+func emitRoomEvent(roomID, event string, data interface{}) {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		fmt.Printf("Error encoding %s event: %v\n", event, err)
+		return
+	}
+
+	select {
+	case roomEvents <- roomEvent{roomID: roomID, event: event, data: dataJSON}:
+	default:
+		fmt.Printf("Dropping %s event of room %s, the event queue is full\n", event, roomID)
+	}
+}
+
+// queueRoomEvent queues a delivery of an event to each subscribed webhook
+func queueRoomEvent(ev roomEvent) {
+	webhooks, err := listWebhooks(ev.roomID)
+	if err != nil {
+		fmt.Printf("Error loading webhooks of room %s: %v\n", ev.roomID, err)
+		return
+	}
+
+	for _, wh := range webhooks {
+		if wh.subscribed(ev.event) {
+			queueWebhookDelivery(&wh, ev.event, ev.data)
+		}
+	}
+}
+
+// emitRoomUpdated reports a change to a room's settings or moderators. The
+// payload is the room along with its current moderators.
+func emitRoomUpdated(room *Chatroom) {
+	moderators, err := rdb.SMembers(ctx, roomModeratorsKey(room.ID)).Result()
+	if err != nil {
+		fmt.Printf("Error fetching moderators of room %s: %v\n", room.ID, err)
+	}
+	sort.Strings(moderators)
+
+	emitRoomEvent(room.ID, eventRoomUpdated, struct {
+		*Chatroom
+		Moderators []string `json:"moderators"`
+	}{room, moderators})
+}
+
+// emitPresenceEvent reports a connection joining or leaving the hub's room
+func (h *Hub) emitPresenceEvent(event, username, clientID string) {
+	emitRoomEvent(h.roomID, event, map[string]interface{}{
+		"username":  username,
+		"clientId":  clientID,
+		"userCount": len(h.clients) + len(h.subscribers),
+	})
+}
+
+func queueWebhookDelivery(wh *Webhook, event string, data interface{}) (string, error) {
+	deliveryID, err := randomToken(8)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":        deliveryID,
+		"event":     event,
+		"roomId":    wh.RoomID,
+		"timestamp": now,
+		"data":      data,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	deliveryJSON, err := json.Marshal(webhookDelivery{
+		ID:        deliveryID,
+		WebhookID: wh.ID,
+		RoomID:    wh.RoomID,
+		Event:     event,
+		Payload:   payload,
+		Attempt:   0,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := rdb.LPush(ctx, webhookQueueKey, deliveryJSON).Err(); err != nil {
+		fmt.Printf("Error queueing webhook delivery: %v\n", err)
+		return "", err
+	}
+	return deliveryID, nil
+}
+
+// signWebhook signs "<timestamp>.<body>" so receivers can reject replays of
+// old deliveries as well as forged ones
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// startWebhookWorkers starts the event loop, the delivery workers and the
+// retry scheduler. Delivery queues live in Redis, so pending deliveries
+// survive restarts and are shared between server replicas.
+func startWebhookWorkers() {
+	go func() {
+		for ev := range roomEvents {
+			queueRoomEvent(ev)
+		}
+	}()
+
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for {
+				res, err := rdb.BRPop(ctx, 5*time.Second, webhookQueueKey).Result()
+				if err == redis.Nil {
+					continue
+				}
+				if err != nil {
+					fmt.Printf("Error reading webhook queue: %v\n", err)
+					time.Sleep(time.Second)
+					continue
+				}
+
+				var delivery webhookDelivery
+				if err := json.Unmarshal([]byte(res[1]), &delivery); err != nil {
+					fmt.Printf("Error decoding webhook delivery: %v\n", err)
+					continue
+				}
+				attemptDelivery(&delivery)
+			}
+		}()
+	}
+
+	// Move retries that are due back onto the queue
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+			due, err := rdb.ZRangeByScore(ctx, webhookRetryKey, &redis.ZRangeBy{Min: "-inf", Max: now, Count: 100}).Result()
+			if err != nil {
+				continue
+			}
+			for _, deliveryJSON := range due {
+				// Only the replica that removes the entry requeues it
+				if removed, err := rdb.ZRem(ctx, webhookRetryKey, deliveryJSON).Result(); err == nil && removed == 1 {
+					rdb.LPush(ctx, webhookQueueKey, deliveryJSON)
+				}
+			}
+		}
+	}()
+}
+
+// retryDelay is the backoff before the given attempt number is retried
+func retryDelay(attempt int) time.Duration {
+	delay := webhookRetryBase << (attempt - 1)
+	if delay <= 0 || delay > webhookRetryMax {
+		return webhookRetryMax
+	}
+	return delay
+}
+
+func attemptDelivery(delivery *webhookDelivery) {
+	wh, err := getWebhook(delivery.RoomID, delivery.WebhookID)
+	if err != nil {
+		// The webhook was deleted while the delivery was pending
+		return
+	}
+
+	delivery.Attempt++
+	entry := DeliveryAttempt{
+		DeliveryID: delivery.ID,
+		Event:      delivery.Event,
+		Attempt:    delivery.Attempt,
+		Timestamp:  time.Now(),
+	}
+
+	start := time.Now()
+	statusCode, err := postWebhook(wh, delivery)
+	entry.DurationMs = time.Since(start).Milliseconds()
+	entry.StatusCode = statusCode
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	deliveryJSON, _ := json.Marshal(delivery)
+	switch {
+	case err == nil:
+		entry.Outcome = "delivered"
+
+	case delivery.Attempt >= webhookMaxAttempts || errors.Is(err, errPrivateAddress):
+		entry.Outcome = "dead"
+		pipe := rdb.TxPipeline()
+		pipe.LPush(ctx, webhookDeadLetterKey(wh.ID), deliveryJSON)
+		pipe.LTrim(ctx, webhookDeadLetterKey(wh.ID), 0, maxWebhookDeadLetter-1)
+		if _, err := pipe.Exec(ctx); err != nil {
+			fmt.Printf("Error storing dead webhook delivery: %v\n", err)
+		}
+
+	default:
+		entry.Outcome = "retrying"
+		due := time.Now().Add(retryDelay(delivery.Attempt))
+		if err := rdb.ZAdd(ctx, webhookRetryKey, redis.Z{Score: float64(due.UnixMilli()), Member: deliveryJSON}).Err(); err != nil {
+			fmt.Printf("Error scheduling webhook retry: %v\n", err)
+		}
+	}
+
+	entryJSON, _ := json.Marshal(entry)
+	pipe := rdb.TxPipeline()
+	pipe.LPush(ctx, webhookLogKey(wh.ID), entryJSON)
+	pipe.LTrim(ctx, webhookLogKey(wh.ID), 0, maxWebhookLog-1)
+	pipe.Exec(ctx)
+}
+
+// postWebhook sends one delivery. Any 2xx answer counts as delivered.
+func postWebhook(wh *Webhook, delivery *webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-websocket-demo-webhooks/1")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(wh.Secret, timestamp, delivery.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func validateWebhookURL(errs *ValidationErrors, raw string) {
+	u, err := url.Parse(raw)
+	switch {
+	case raw == "":
+		errs.add("url", "required", "URL is required")
+	case err != nil || u.Host == "":
+		errs.add("url", "invalid", "URL is not valid")
+	case u.Scheme != "https" && u.Scheme != "http":
+		errs.add("url", "scheme", "URL must use http or https")
+	case u.User != nil:
+		errs.add("url", "credentials", "URL must not contain credentials")
+	}
+}
+
+// webhooksHandler lists (GET ?roomId=) or creates (POST) a room's webhooks.
+// Webhooks are managed by the room owner.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		room, _ := roomWithRole(w, r, r.URL.Query().Get("roomId"), roleOwner)
+		if room == nil {
+			return
+		}
+
+		webhooks, err := listWebhooks(room.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching webhooks")
+			return
+		}
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webhooks)
+
+	case http.MethodPost:
+		createWebhook(w, r)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+	}
+}
+
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID string   `json:"roomId"`
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	room, username := roomWithRole(w, r, req.RoomID, roleOwner)
+	if room == nil {
+		return
+	}
+
+	var errs ValidationErrors
+	validateWebhookURL(&errs, req.URL)
+	if len(req.Events) == 0 {
+		errs.add("events", "required", "At least one event is required")
+	}
+	for _, event := range req.Events {
+		if !webhookEvents[event] {
+			errs.add("events", "invalid", "Unknown event %q", event)
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	count, err := rdb.HLen(ctx, roomWebhooksKey(room.ID)).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching webhooks")
+		return
+	}
+	if count >= int64(maxWebhooksPerRoom) {
+		writeError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("A room can have at most %d webhooks", maxWebhooksPerRoom))
+		return
+	}
+
+	id, err := randomToken(8)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating webhook")
+		return
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating webhook")
+		return
+	}
+
+	wh := Webhook{
+		ID:        id,
+		RoomID:    room.ID,
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    secret,
+		CreatedBy: username,
+		CreatedAt: time.Now(),
+	}
+	webhookJSON, err := json.Marshal(wh)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error creating webhook")
+		return
+	}
+
+	if err := rdb.HSet(ctx, roomWebhooksKey(room.ID), id, webhookJSON).Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error storing webhook")
+		return
+	}
+
+	// The secret is returned once, receivers need it to verify signatures
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(wh)
+}
+
+// webhookRequest decodes {roomId, id} and loads the webhook for its room owner
+func webhookRequest(w http.ResponseWriter, r *http.Request) *Webhook {
+	var req struct {
+		RoomID string `json:"roomId"`
+		ID     string `json:"id"`
+	}
+
+	if r.Method == http.MethodGet {
+		req.RoomID, req.ID = r.URL.Query().Get("roomId"), r.URL.Query().Get("id")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request payload")
+		return nil
+	}
+
+	room, _ := roomWithRole(w, r, req.RoomID, roleOwner)
+	if room == nil {
+		return nil
+	}
+
+	wh, err := getWebhook(room.ID, req.ID)
+	if err == redis.Nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Webhook not found")
+		return nil
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching webhook")
+		return nil
+	}
+	return wh
+}
+
+// deleteWebhookHandler removes a webhook along with its logs
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	wh := webhookRequest(w, r)
+	if wh == nil {
+		return
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.HDel(ctx, roomWebhooksKey(wh.RoomID), wh.ID)
+	pipe.Del(ctx, webhookLogKey(wh.ID), webhookDeadLetterKey(wh.ID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error deleting webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Webhook deleted",
+	})
+}
+
+// webhookDeliveriesHandler returns a webhook's delivery log and dead letters
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	wh := webhookRequest(w, r)
+	if wh == nil {
+		return
+	}
+
+	logged, err := rdb.LRange(ctx, webhookLogKey(wh.ID), 0, -1).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching delivery log")
+		return
+	}
+	attempts := []DeliveryAttempt{}
+	for _, entryJSON := range logged {
+		var entry DeliveryAttempt
+		if err := json.Unmarshal([]byte(entryJSON), &entry); err == nil {
+			attempts = append(attempts, entry)
+		}
+	}
+
+	dead, err := rdb.LRange(ctx, webhookDeadLetterKey(wh.ID), 0, -1).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error fetching dead letters")
+		return
+	}
+	deadLetters := []webhookDelivery{}
+	for _, deliveryJSON := range dead {
+		var delivery webhookDelivery
+		if err := json.Unmarshal([]byte(deliveryJSON), &delivery); err == nil {
+			deadLetters = append(deadLetters, delivery)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deliveries":  attempts,
+		"deadLetters": deadLetters,
+	})
+}
+
+// testWebhookHandler queues a ping event so owners can check their receiver
+func testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	wh := webhookRequest(w, r)
+	if wh == nil {
+		return
+	}
+
+	deliveryID, err := queueWebhookDelivery(wh, eventPing, map[string]string{"message": "Webhook test"})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error queueing test delivery")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"deliveryId": deliveryID,
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextRoomEvent takes the next event off the queue the event loop reads
+func nextRoomEvent(t *testing.T) roomEvent {
+	t.Helper()
+
+	select {
+	case ev := <-roomEvents:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no room event was emitted")
+		return roomEvent{}
+	}
+}
+
+func TestRoomUpdatedWebhook(t *testing.T) {
+	useTestRedis(t)
+
+	allowPrivate := webhookAllowPrivate
+	webhookAllowPrivate = true
+	t.Cleanup(func() { webhookAllowPrivate = allowPrivate })
+
+	// Events left over by other tests would be taken for ours
+	for len(roomEvents) > 0 {
+		<-roomEvents
+	}
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan received, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- received{r.Header, body}
+	}))
+	defer receiver.Close()
+
+	room := testRoom(t, "owner")
+	wh := Webhook{ID: "wh1", RoomID: room.ID, URL: receiver.URL, Events: []string{eventRoomUpdated}, Secret: "s3cret", CreatedAt: time.Now()}
+	whJSON, _ := json.Marshal(wh)
+	rdb.HSet(ctx, roomWebhooksKey(room.ID), wh.ID, whJSON)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/chatrooms/moderation", strings.NewReader(`{"roomId":"`+room.ID+`","action":"addModerator","username":"bob"}`))
+	r.Header.Set("Authorization", testSession(t, "owner"))
+	w := httptest.NewRecorder()
+	moderationHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	// Run what the event loop and a delivery worker would
+	ev := nextRoomEvent(t)
+	if ev.event != eventRoomUpdated {
+		t.Fatalf("event = %q, want %q", ev.event, eventRoomUpdated)
+	}
+	queueRoomEvent(ev)
+	deliveryJSON, err := rdb.RPop(ctx, webhookQueueKey).Result()
+	if err != nil {
+		t.Fatalf("no delivery was queued: %v", err)
+	}
+	var delivery webhookDelivery
+	json.Unmarshal([]byte(deliveryJSON), &delivery)
+	attemptDelivery(&delivery)
+
+	var got received
+	select {
+	case got = <-deliveries:
+	default:
+		t.Fatal("receiver got nothing")
+	}
+
+	if sig := signWebhook(wh.Secret, got.header.Get("X-Webhook-Timestamp"), got.body); got.header.Get("X-Webhook-Signature") != sig {
+		t.Errorf("signature = %q, want %q", got.header.Get("X-Webhook-Signature"), sig)
+	}
+	var payload struct {
+		Event string `json:"event"`
+		Data  struct {
+			ID         string   `json:"id"`
+			Moderators []string `json:"moderators"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(got.body, &payload); err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+	if payload.Event != eventRoomUpdated || payload.Data.ID != room.ID || len(payload.Data.Moderators) != 1 || payload.Data.Moderators[0] != "bob" {
+		t.Errorf("payload = %s", got.body)
+	}
+
+	entries, _ := rdb.LRange(ctx, webhookLogKey(wh.ID), 0, -1).Result()
+	if len(entries) != 1 || !strings.Contains(entries[0], `"outcome":"delivered"`) {
+		t.Errorf("delivery log = %v", entries)
+	}
+}
+
+func TestEmitRoomEventDoesNotBlock(t *testing.T) {
+	for len(roomEvents) > 0 {
+		<-roomEvents
+	}
+	t.Cleanup(func() {
+		for len(roomEvents) > 0 {
+			<-roomEvents
+		}
+	})
+
+	// Nothing reads the queue here, emitting must still return once it is full
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i <= cap(roomEvents); i++ {
+			emitRoomEvent("room", eventMessagePosted, i)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emitRoomEvent blocked on a full queue")
+	}
+}